@@ -101,7 +101,12 @@ func NewCDCRunnerAction(
 
 // Do Run a loop of trying to sync objects needing to sync
 func (c CDCRunnerAction) Do() error {
-	ctx := context.Background()
+	return c.DoContext(context.Background())
+}
+
+// DoContext Run a loop of trying to sync objects needing to sync, stopping if
+// ctx is cancelled
+func (c CDCRunnerAction) DoContext(ctx context.Context) error {
 	if c.limit == 0 {
 		c.limit = 1
 	}
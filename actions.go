@@ -1,5 +1,10 @@
 package queue
 
+import (
+	"context"
+	"fmt"
+)
+
 // ScheduledAction A scheduled action to be run
 type ScheduledAction interface {
 	Do() error      // Perform the action
@@ -10,3 +15,68 @@ type ScheduledAction interface {
 type TaskAction interface {
 	Do(task Task) (TaskResult, string) // Perform the action for the task
 }
+
+// ContextScheduledAction A scheduled action that is given a context, which is
+// cancelled when the SyncManager is stopped.  ScheduledActions that also
+// implement this are run with DoContext
+type ContextScheduledAction interface {
+	DoContext(ctx context.Context) error // Perform the action
+	Stream() string                      // Returns the stream (for simultaneous running)
+}
+
+// ContextTaskAction An action for a task that is given a context, which is
+// cancelled when the SyncManager is stopped, and expires at the handler's
+// timeout or if the lease on the task is lost.  TaskActions that also
+// implement this are run with DoContext
+type ContextTaskAction interface {
+	DoContext(ctx context.Context, task Task) (TaskResult, string) // Perform the action for the task
+}
+
+// AdaptScheduledAction Returns act as a ContextScheduledAction.  Unless act
+// implements ContextScheduledAction itself, the context is ignored
+func AdaptScheduledAction(act ScheduledAction) ContextScheduledAction {
+	if c, ok := act.(ContextScheduledAction); ok {
+		return c
+	}
+
+	return scheduledActionAdapter{act}
+}
+
+type scheduledActionAdapter struct {
+	ScheduledAction
+}
+
+func (a scheduledActionAdapter) DoContext(ctx context.Context) error {
+	return a.Do()
+}
+
+// AdaptTaskAction Returns act as a ContextTaskAction.  Unless act implements
+// ContextTaskAction itself, the context is ignored
+func AdaptTaskAction(act TaskAction) ContextTaskAction {
+	if c, ok := act.(ContextTaskAction); ok {
+		return c
+	}
+
+	return taskActionAdapter{act}
+}
+
+type taskActionAdapter struct {
+	TaskAction
+}
+
+func (a taskActionAdapter) DoContext(ctx context.Context, task Task) (TaskResult, string) {
+	return a.Do(task)
+}
+
+// actionType Returns the type of the action as given to SyncManager, for
+// error messages
+func actionType(act interface{}) string {
+	switch a := act.(type) {
+	case scheduledActionAdapter:
+		return fmt.Sprintf("%T", a.ScheduledAction)
+	case taskActionAdapter:
+		return fmt.Sprintf("%T", a.TaskAction)
+	}
+
+	return fmt.Sprintf("%T", act)
+}
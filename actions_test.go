@@ -1,5 +1,11 @@
 package queue
 
+import (
+	"context"
+	"sync"
+	"time"
+)
+
 func NewExampleScheduledAction(result chan bool, panicCount int) ExampleScheduledAction {
 	ea := ExampleScheduledAction{panicCount: panicCount}
 
@@ -44,3 +50,94 @@ func (ea *ExampleTaskAction) Do(task Task) (TaskResult, string) {
 	ea.result <- true
 	return TaskResultSuccess, "Done"
 }
+
+// blockingTaskAction Signals when a task starts, then waits to be released
+type blockingTaskAction struct {
+	started chan string
+	release chan bool
+}
+
+func newBlockingTaskAction() blockingTaskAction {
+	return blockingTaskAction{
+		started: make(chan string, 10),
+		release: make(chan bool),
+	}
+}
+
+func (ba blockingTaskAction) Do(task Task) (TaskResult, string) {
+	ba.started <- task.Key
+	<-ba.release
+	return TaskResultSuccess, "Done"
+}
+
+// retryTaskAction Asks for a retry the first time it sees each task, and
+// reports each attempt
+type retryTaskAction struct {
+	attempts chan string
+	seen     map[string]bool
+	mx       *sync.Mutex
+}
+
+func newRetryTaskAction() retryTaskAction {
+	return retryTaskAction{
+		attempts: make(chan string, 10),
+		seen:     make(map[string]bool),
+		mx:       &sync.Mutex{},
+	}
+}
+
+func (ra retryTaskAction) Do(task Task) (TaskResult, string) {
+	ra.attempts <- task.Key
+
+	ra.mx.Lock()
+	defer ra.mx.Unlock()
+
+	if !ra.seen[task.Key] {
+		ra.seen[task.Key] = true
+		return TaskResultRetryFailure, "Try again"
+	}
+
+	return TaskResultSuccess, "Done"
+}
+
+// resultTaskAction Returns the same result for every task, and reports each
+// attempt
+type resultTaskAction struct {
+	result   TaskResult
+	message  string
+	attempts chan string
+}
+
+func (ra resultTaskAction) Do(task Task) (TaskResult, string) {
+	ra.attempts <- task.Key
+	return ra.result, ra.message
+}
+
+// contextTaskAction Reports the deadline of each task's context when it
+// starts, then waits for the context to be done
+type contextTaskAction struct {
+	started chan time.Time
+	done    chan error
+}
+
+func newContextTaskAction() contextTaskAction {
+	return contextTaskAction{
+		started: make(chan time.Time, 10),
+		done:    make(chan error, 10),
+	}
+}
+
+func (ca contextTaskAction) DoContext(ctx context.Context, task Task) (TaskResult, string) {
+	deadline, _ := ctx.Deadline()
+	ca.started <- deadline
+	<-ctx.Done()
+	ca.done <- ctx.Err()
+	return TaskResultRetryFailure, "Stopped"
+}
+
+// panicTaskAction Panics for every task
+type panicTaskAction struct{}
+
+func (pa panicTaskAction) Do(task Task) (TaskResult, string) {
+	panic("failing here")
+}
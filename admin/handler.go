@@ -0,0 +1,455 @@
+// Package admin provides an http.Handler exposing the state of a queue, and
+// actions on it, as a JSON API with a small dashboard on top.  Mount it
+// behind your service's own authentication, since it has none of its own:
+//
+//	http.Handle("/queue/", http.StripPrefix("/queue", admin.NewHandler(driver)))
+package admin
+
+import (
+	_ "embed" // For the dashboard
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/episub/queue"
+)
+
+//go:embed dashboard.html
+var dashboard []byte
+
+// Handler Serves the dashboard and JSON API for a queue
+type Handler struct {
+	tm       queue.TaskManager
+	readOnly bool
+}
+
+// Option Configures a Handler
+type Option func(*Handler)
+
+// WithReadOnly Disables the operator actions, so that the queue can be looked
+// at but not changed
+func WithReadOnly() Option {
+	return func(h *Handler) {
+		h.readOnly = true
+	}
+}
+
+// NewHandler Returns a handler for the queue behind driver.  The driver needs
+// to implement queue.TaskReader, and queue.TaskEditor for the actions.
+// Failures are read from the dead-letter store, if the driver has one
+func NewHandler(driver queue.Driver, opts ...Option) *Handler {
+	h := &Handler{tm: queue.NewTaskManager(driver)}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	return h
+}
+
+// taskView A task as returned by the API
+type taskView struct {
+	ID                 string                 `json:"id"`
+	Key                string                 `json:"key"`
+	Name               string                 `json:"name"`
+	State              queue.TaskState        `json:"state"`
+	Attempts           int                    `json:"attempts"`
+	Created            time.Time              `json:"created"`
+	CreatedBy          string                 `json:"created_by"`
+	DoAfter            *time.Time             `json:"do_after,omitempty"`
+	LastAttempted      *time.Time             `json:"last_attempted,omitempty"`
+	LastAttemptMessage string                 `json:"last_attempt_message"`
+	Data               map[string]interface{} `json:"data,omitempty"`
+	Dead               bool                   `json:"dead,omitempty"` // In the dead-letter store, rather than the queue
+}
+
+func newTaskView(t queue.Task, withData bool) taskView {
+	v := taskView{
+		ID:                 t.ID(),
+		Key:                t.Key,
+		Name:               t.Name,
+		State:              t.State,
+		Attempts:           t.Attempts,
+		Created:            t.Created,
+		CreatedBy:          t.CreatedBy,
+		LastAttemptMessage: t.LastAttemptMessage,
+	}
+
+	if !t.DoAfter.IsZero() {
+		v.DoAfter = &t.DoAfter
+	}
+
+	if !t.LastAttempted.IsZero() {
+		v.LastAttempted = &t.LastAttempted
+	}
+
+	if withData {
+		v.Data = t.Data
+	}
+
+	return v
+}
+
+func newDeadTaskView(t queue.DeadTask, withData bool) taskView {
+	v := taskView{
+		ID:                 t.ID,
+		Key:                t.Key,
+		Name:               t.Name,
+		State:              queue.TaskFailed,
+		Attempts:           t.Attempts,
+		Created:            t.Created,
+		CreatedBy:          t.CreatedBy,
+		LastAttemptMessage: t.Error,
+		Dead:               true,
+	}
+
+	if !t.FailedAt.IsZero() {
+		v.LastAttempted = &t.FailedAt
+	}
+
+	if withData {
+		v.Data = t.Data
+	}
+
+	return v
+}
+
+// apiError The body returned with an error status
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// ServeHTTP Routes the request to the dashboard or the API:
+//
+//	GET  /                          The dashboard
+//	GET  /api/counts                Tasks for each name and state, filtered as for /api/tasks
+//	GET  /api/tasks                 Tasks, filtered by name, key, state, created_by, created_after,
+//	                                created_before, due_after, due_before, limit and offset
+//	GET  /api/tasks/{id}            A task with its data, from the queue or the dead-letter store
+//	POST /api/tasks/{id}/cancel     Cancels a pending task.  Takes {"message": "..."}
+//	POST /api/tasks/{id}/retry      Requeues a failed or cancelled task, or runs a pending task now
+//	GET  /api/failures              The most recent failures.  Takes limit and offset
+//	POST /api/dead/{id}/requeue     Requeues a task from the dead-letter store
+//
+// Actions must be sent as application/json, which browsers won't do across
+// sites without the service's permission
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(route, "/")
+
+	switch {
+	case route == "":
+		h.serveDashboard(w, r)
+	case route == "api/counts":
+		h.get(w, r, h.counts)
+	case route == "api/tasks":
+		h.get(w, r, h.tasks)
+	case route == "api/failures":
+		h.get(w, r, h.failures)
+	case len(parts) == 3 && parts[0] == "api" && parts[1] == "tasks":
+		h.get(w, r, func(r *http.Request) (interface{}, error) { return h.task(parts[2]) })
+	case len(parts) == 4 && parts[0] == "api" && parts[1] == "tasks" && parts[3] == "cancel":
+		h.post(w, r, func(body actionBody) error {
+			return h.tm.CancelTask(parts[2], body.message("Cancelled from dashboard"))
+		})
+	case len(parts) == 4 && parts[0] == "api" && parts[1] == "tasks" && parts[3] == "retry":
+		h.post(w, r, func(body actionBody) error { return h.retry(parts[2]) })
+	case len(parts) == 4 && parts[0] == "api" && parts[1] == "dead" && parts[3] == "requeue":
+		h.post(w, r, func(body actionBody) error { return h.tm.RequeueDeadTask(parts[2], time.Now()) })
+	default:
+		writeJSON(w, http.StatusNotFound, apiError{Error: "not found"})
+	}
+}
+
+func (h *Handler) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "method not allowed"})
+		return
+	}
+
+	// The dashboard uses relative links, so needs to be served from a path
+	// ending in a slash.  The path as requested is used, since the handler's
+	// prefix may have been stripped:
+	if requested := strings.SplitN(r.RequestURI, "?", 2)[0]; len(requested) > 0 && !strings.HasSuffix(requested, "/") {
+		w.Header().Set("Location", path.Base(requested)+"/")
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Write(dashboard)
+}
+
+// get Serves the result of fetch as JSON
+func (h *Handler) get(w http.ResponseWriter, r *http.Request, fetch func(r *http.Request) (interface{}, error)) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "method not allowed"})
+		return
+	}
+
+	result, err := fetch(r)
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// actionBody The optional body of an action
+type actionBody struct {
+	Message string `json:"message"`
+}
+
+func (b actionBody) message(defaultMessage string) string {
+	if len(b.Message) > 0 {
+		return b.Message
+	}
+
+	return defaultMessage
+}
+
+// post Performs the action, provided that the request is allowed to
+func (h *Handler) post(w http.ResponseWriter, r *http.Request, action func(body actionBody) error) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "method not allowed"})
+		return
+	}
+
+	if h.readOnly {
+		writeJSON(w, http.StatusForbidden, apiError{Error: "actions are disabled"})
+		return
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeJSON(w, http.StatusUnsupportedMediaType, apiError{Error: "actions must be sent as application/json"})
+		return
+	}
+
+	var body actionBody
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("invalid body: %s", err)})
+			return
+		}
+	}
+
+	if err := action(body); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		OK bool `json:"ok"`
+	}{true})
+}
+
+// filter Returns the filter given by the request's query
+func filter(r *http.Request) (queue.TaskFilter, error) {
+	q := r.URL.Query()
+
+	f := queue.TaskFilter{
+		IDs:       q["id"],
+		Names:     q["name"],
+		Keys:      q["key"],
+		CreatedBy: q.Get("created_by"),
+	}
+
+	for _, state := range q["state"] {
+		f.States = append(f.States, queue.TaskState(state))
+	}
+
+	times := []struct {
+		param string
+		t     *time.Time
+	}{
+		{"created_after", &f.CreatedAfter},
+		{"created_before", &f.CreatedBefore},
+		{"due_after", &f.DueAfter},
+		{"due_before", &f.DueBefore},
+	}
+
+	for _, tt := range times {
+		if v := q.Get(tt.param); len(v) > 0 {
+			t, err := time.Parse(time.RFC3339, v)
+
+			if err != nil {
+				return f, badRequest{fmt.Errorf("%s must be an RFC 3339 time", tt.param)}
+			}
+
+			*tt.t = t
+		}
+	}
+
+	return f, nil
+}
+
+// page Returns the limit and offset given by the request's query, with a
+// default limit of 50
+func page(r *http.Request) (int, int, error) {
+	limit, offset := 50, 0
+	q := r.URL.Query()
+
+	for _, p := range []struct {
+		param string
+		value *int
+	}{{"limit", &limit}, {"offset", &offset}} {
+		if v := q.Get(p.param); len(v) > 0 {
+			n, err := strconv.Atoi(v)
+
+			if err != nil || n < 0 {
+				return 0, 0, badRequest{fmt.Errorf("%s must be a number", p.param)}
+			}
+
+			*p.value = n
+		}
+	}
+
+	return limit, offset, nil
+}
+
+func (h *Handler) counts(r *http.Request) (interface{}, error) {
+	f, err := filter(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return h.tm.CountTasks(f)
+}
+
+func (h *Handler) tasks(r *http.Request) (interface{}, error) {
+	f, err := filter(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Limit, f.Offset, err = page(r); err != nil {
+		return nil, err
+	}
+
+	tasks, err := h.tm.ListTasks(f)
+
+	if err != nil {
+		return nil, err
+	}
+
+	views := []taskView{}
+	for _, t := range tasks {
+		views = append(views, newTaskView(t, false))
+	}
+
+	return views, nil
+}
+
+// task Returns the task from the queue, or else the dead-letter store
+func (h *Handler) task(id string) (interface{}, error) {
+	task, err := h.tm.GetTask(id)
+
+	if err == nil {
+		return newTaskView(task, true), nil
+	}
+
+	if err != queue.ErrTaskNotFound {
+		return nil, err
+	}
+
+	dead, deadErr := h.tm.GetDeadTask(id)
+
+	if deadErr == queue.ErrNotSupported {
+		return nil, err
+	}
+
+	if deadErr != nil {
+		return nil, deadErr
+	}
+
+	return newDeadTaskView(dead, true), nil
+}
+
+// failures Returns the most recent failures from the dead-letter store, or
+// failed tasks in the queue if the driver has no dead-letter store
+func (h *Handler) failures(r *http.Request) (interface{}, error) {
+	limit, offset, err := page(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	views := []taskView{}
+	dead, err := h.tm.ListDeadTasks(limit, offset)
+
+	if err == queue.ErrNotSupported {
+		tasks, err := h.tm.ListTasks(queue.TaskFilter{States: []queue.TaskState{queue.TaskFailed}, Limit: limit, Offset: offset})
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, t := range tasks {
+			views = append(views, newTaskView(t, false))
+		}
+
+		return views, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range dead {
+		views = append(views, newDeadTaskView(t, false))
+	}
+
+	return views, nil
+}
+
+// retry Requeues a failed or cancelled task, or else brings a pending task
+// forward to be performed now
+func (h *Handler) retry(id string) error {
+	err := h.tm.RequeueTask(id, time.Now())
+
+	if err == queue.ErrTaskNotFound {
+		return h.tm.RescheduleTask(id, time.Now())
+	}
+
+	return err
+}
+
+// badRequest An error in the request, rather than with the queue
+type badRequest struct {
+	error
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+
+	switch err.(type) {
+	case badRequest:
+		status = http.StatusBadRequest
+	}
+
+	switch err {
+	case queue.ErrTaskNotFound:
+		status = http.StatusNotFound
+	case queue.ErrNotSupported:
+		status = http.StatusNotImplemented
+	}
+
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
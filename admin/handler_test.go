@@ -0,0 +1,239 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/episub/queue"
+)
+
+// request Sends a request to h, returning the response
+func request(h http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+	var r *http.Request
+	if len(body) > 0 {
+		r = httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+	} else {
+		r = httptest.NewRequest(method, target, nil)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	return w
+}
+
+// decode Decodes the response body into v
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but was %d: %s", w.Code, w.Body.String())
+	}
+
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// getTask Fetches the task through the API
+func getTask(t *testing.T, h http.Handler, id string) taskView {
+	t.Helper()
+
+	var task taskView
+	decode(t, request(h, http.MethodGet, "/api/tasks/"+id, ""), &task)
+
+	return task
+}
+
+func TestDashboard(t *testing.T) {
+	h := http.StripPrefix("/queue", NewHandler(queue.NewMemoryDriver()))
+
+	w := request(h, http.MethodGet, "/queue/", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<title>Queue</title>") {
+		t.Errorf("Expected the dashboard, but got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Without the trailing slash, the dashboard's relative links would break:
+	w = request(h, http.MethodGet, "/queue", "")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "queue/" {
+		t.Errorf("Expected redirect to queue/, but got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+
+	w = request(h, http.MethodGet, "/queue/api/unknown", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown route, but was %d", w.Code)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	driver := queue.NewMemoryDriver()
+	tm := queue.NewTaskManager(driver)
+	h := NewHandler(driver)
+
+	email, err := tm.AddTask("sendEmail", "customer1", time.Now(), "test", map[string]interface{}{"to": "a@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	later, err := tm.AddTask("sendEmail", "customer2", time.Now().Add(time.Hour), "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = tm.AddTask("syncInvoice", "invoice1", time.Now().Add(-time.Minute), "test", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail the invoice sync, moving it to the dead-letter store:
+	failed, err := driver.Pop(queue.PopOptions{Names: []string{"syncInvoice"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = driver.Fail(failed, "Invoice not found"); err != nil {
+		t.Fatal(err)
+	}
+
+	var counts []queue.TaskCount
+	decode(t, request(h, http.MethodGet, "/api/counts", ""), &counts)
+
+	if len(counts) != 1 || counts[0].Name != "sendEmail" || counts[0].Count != 2 {
+		t.Errorf("Expected 2 sendEmail tasks, but counts were %+v", counts)
+	}
+
+	var tasks []taskView
+	decode(t, request(h, http.MethodGet, "/api/tasks?key=customer2", ""), &tasks)
+
+	if len(tasks) != 1 || tasks[0].ID != later {
+		t.Errorf("Expected only task %s, but got %+v", later, tasks)
+	}
+
+	decode(t, request(h, http.MethodGet, "/api/tasks?due_before="+time.Now().Add(time.Minute).Format(time.RFC3339), ""), &tasks)
+
+	if len(tasks) != 1 || tasks[0].ID != email {
+		t.Errorf("Expected only task %s to be due, but got %+v", email, tasks)
+	}
+
+	if w := request(h, http.MethodGet, "/api/tasks?due_before=tomorrow", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a bad time, but was %d", w.Code)
+	}
+
+	task := getTask(t, h, email)
+
+	if task.Key != "customer1" || task.Data["to"] != "a@example.com" {
+		t.Errorf("Expected customer1's task with its data, but got %+v", task)
+	}
+
+	// Failed tasks are found in the dead-letter store:
+	var failures []taskView
+	decode(t, request(h, http.MethodGet, "/api/failures", ""), &failures)
+
+	if len(failures) != 1 || failures[0].ID != failed.ID() || !failures[0].Dead {
+		t.Fatalf("Expected the failed task, but got %+v", failures)
+	}
+
+	task = getTask(t, h, failed.ID())
+
+	if !task.Dead || task.LastAttemptMessage != "Invoice not found" {
+		t.Errorf("Expected the dead task with its error, but got %+v", task)
+	}
+
+	if w := request(h, http.MethodGet, "/api/tasks/missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing task, but was %d", w.Code)
+	}
+
+	// Actions:
+	if w := request(h, http.MethodPost, "/api/tasks/"+email+"/cancel", `{"message": "Customer deleted"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected cancel to succeed, but got %d: %s", w.Code, w.Body.String())
+	}
+
+	task = getTask(t, h, email)
+
+	if task.State != queue.TaskCancelled || task.LastAttemptMessage != "Customer deleted" {
+		t.Errorf("Expected task to be cancelled, but got %+v", task)
+	}
+
+	// Retrying brings a cancelled task back, and a pending task forward:
+	for _, id := range []string{email, later} {
+		if w := request(h, http.MethodPost, "/api/tasks/"+id+"/retry", "{}"); w.Code != http.StatusOK {
+			t.Fatalf("Expected retry to succeed, but got %d: %s", w.Code, w.Body.String())
+		}
+
+		task = getTask(t, h, id)
+
+		if task.State != queue.TaskReady || task.DoAfter.After(time.Now()) {
+			t.Errorf("Expected task to be ready now, but got %+v", task)
+		}
+	}
+
+	if w := request(h, http.MethodPost, "/api/dead/"+failed.ID()+"/requeue", "{}"); w.Code != http.StatusOK {
+		t.Fatalf("Expected requeue to succeed, but got %d: %s", w.Code, w.Body.String())
+	}
+
+	task = getTask(t, h, failed.ID())
+
+	if task.Dead || task.State != queue.TaskReady {
+		t.Errorf("Expected task to be back in the queue, but got %+v", task)
+	}
+
+	if w := request(h, http.MethodPost, "/api/tasks/missing/cancel", "{}"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 cancelling a missing task, but was %d", w.Code)
+	}
+}
+
+func TestActionGuards(t *testing.T) {
+	driver := queue.NewMemoryDriver()
+	tm := queue.NewTaskManager(driver)
+
+	id, err := tm.AddTask("sendEmail", "customer1", time.Now(), "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHandler(driver)
+
+	// Forms can be posted across sites, so aren't accepted:
+	r := httptest.NewRequest(http.MethodPost, "/api/tasks/"+id+"/cancel", strings.NewReader("message=x"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected status 415 for a form, but was %d", w.Code)
+	}
+
+	if w = request(h, http.MethodGet, "/api/tasks/"+id+"/cancel", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for GET, but was %d", w.Code)
+	}
+
+	readOnly := NewHandler(driver, WithReadOnly())
+
+	if w = request(readOnly, http.MethodPost, "/api/tasks/"+id+"/cancel", "{}"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 when read-only, but was %d", w.Code)
+	}
+
+	task, err := tm.GetTask(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if task.State != queue.TaskReady {
+		t.Errorf("Expected task to be untouched, but was %s", task.State)
+	}
+}
+
+func TestTaskViewZeroTimes(t *testing.T) {
+	b, err := json.Marshal(newTaskView(queue.Task{Name: "sendEmail"}, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(b), "do_after") || strings.Contains(string(b), "last_attempted") {
+		t.Errorf("Expected unset times to be omitted, but had %s", b)
+	}
+}
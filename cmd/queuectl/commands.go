@@ -0,0 +1,648 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/episub/queue"
+)
+
+// client The connected queue, and where to write output
+type client struct {
+	driver queue.Driver
+	tm     queue.TaskManager
+	out    io.Writer
+	errOut io.Writer
+}
+
+// flagSet Returns a flag set for the named command
+func (c *client) flagSet(name string, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.errOut)
+	fs.Usage = func() {
+		fmt.Fprintf(c.errOut, "Usage: queuectl %s [flags] %s\n\nFlags:\n", name, args)
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+// taskView A task as output with -json
+type taskView struct {
+	ID                 string                 `json:"id"`
+	Key                string                 `json:"key"`
+	Name               string                 `json:"name"`
+	State              queue.TaskState        `json:"state"`
+	Attempts           int                    `json:"attempts"`
+	Created            time.Time              `json:"created"`
+	CreatedBy          string                 `json:"created_by"`
+	DoAfter            time.Time              `json:"do_after"`
+	LastAttempted      time.Time              `json:"last_attempted"`
+	LastAttemptMessage string                 `json:"last_attempt_message"`
+	Data               map[string]interface{} `json:"data"`
+}
+
+func newTaskView(t queue.Task) taskView {
+	return taskView{
+		ID:                 t.ID(),
+		Key:                t.Key,
+		Name:               t.Name,
+		State:              t.State,
+		Attempts:           t.Attempts,
+		Created:            t.Created,
+		CreatedBy:          t.CreatedBy,
+		DoAfter:            t.DoAfter,
+		LastAttempted:      t.LastAttempted,
+		LastAttemptMessage: t.LastAttemptMessage,
+		Data:               t.Data,
+	}
+}
+
+// formatTime Formats t for tables, in local time to the second
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+// oneLine Shortens a message to fit on one line of a table
+func oneLine(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+
+	if len(s) > 60 {
+		return s[:57] + "..."
+	}
+
+	return s
+}
+
+func (c *client) writeTasks(tasks []queue.Task) {
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tKEY\tSTATE\tATTEMPTS\tCREATED\tDO AFTER\tLAST ATTEMPTED\tMESSAGE")
+
+	for _, t := range tasks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n", t.ID(), t.Name, t.Key, t.State, t.Attempts, formatTime(t.Created), formatTime(t.DoAfter), formatTime(t.LastAttempted), oneLine(t.LastAttemptMessage))
+	}
+
+	w.Flush()
+}
+
+func (c *client) writeJSON(v interface{}) error {
+	return json.NewEncoder(c.out).Encode(v)
+}
+
+func runAdd(c *client, args []string) error {
+	var name, key, data, after, createdBy, unique, idempotencyKey string
+
+	fs := c.flagSet("add", "")
+	fs.StringVar(&name, "name", "", "Task name.  Required")
+	fs.StringVar(&key, "key", "", "Task key.  Required")
+	fs.StringVar(&data, "data", "{}", "Task data, as a JSON object")
+	fs.StringVar(&after, "after", "", "When to perform the task, as an RFC 3339 time or a duration from now.  Now, if empty")
+	fs.StringVar(&createdBy, "created-by", "queuectl", "Who the task was created by")
+	fs.StringVar(&unique, "unique", "", "Don't add the task if an unfinished task has the same key (KEY), or key and name (KEY_NAME)")
+	fs.StringVar(&idempotencyKey, "idempotency-key", "", "Don't add the task if an unfinished task has this idempotency key")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if len(name) == 0 || len(key) == 0 {
+		return fmt.Errorf("add needs a -name and a -key")
+	}
+
+	var taskData map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &taskData); err != nil {
+		return fmt.Errorf("data must be a JSON object: %s", err)
+	}
+
+	now := time.Now()
+	doAfter, err := parseTime(after, now)
+
+	if err != nil {
+		return err
+	}
+
+	if doAfter.IsZero() {
+		doAfter = now
+	}
+
+	var opts []queue.AddTaskOption
+	if len(unique) > 0 {
+		opts = append(opts, queue.WithUnique(queue.Uniqueness(strings.ToUpper(unique))))
+	}
+
+	if len(idempotencyKey) > 0 {
+		opts = append(opts, queue.WithIdempotencyKey(idempotencyKey))
+	}
+
+	id, err := c.tm.AddTask(name, key, doAfter, createdBy, taskData, opts...)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(c.out, id)
+
+	return nil
+}
+
+func runList(c *client, args []string) error {
+	var ff filterFlags
+	var limit, offset int
+	var asJSON bool
+
+	fs := c.flagSet("list", "")
+	ff.register(fs)
+	fs.IntVar(&limit, "limit", 50, "The most tasks to show.  No limit if 0")
+	fs.IntVar(&offset, "offset", 0, "How many tasks to skip, for paging")
+	fs.BoolVar(&asJSON, "json", false, "Output each task as a line of JSON, including its data")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	filter, err := ff.filter(time.Now())
+
+	if err != nil {
+		return err
+	}
+
+	filter.Limit = limit
+	filter.Offset = offset
+
+	tasks, err := c.tm.ListTasks(filter)
+
+	if err != nil {
+		return err
+	}
+
+	if !asJSON {
+		c.writeTasks(tasks)
+		return nil
+	}
+
+	for _, t := range tasks {
+		if err = c.writeJSON(newTaskView(t)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func runShow(c *client, args []string) error {
+	var asJSON bool
+
+	fs := c.flagSet("show", "<id>")
+	fs.BoolVar(&asJSON, "json", false, "Output the task as JSON")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("show needs one task ID")
+	}
+
+	task, err := c.tm.GetTask(fs.Arg(0))
+
+	if err == queue.ErrTaskNotFound {
+		// It may have failed and been moved to the dead-letter store:
+		dead, deadErr := c.tm.GetDeadTask(fs.Arg(0))
+
+		if deadErr == nil {
+			return c.showDead(dead, asJSON)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	view := newTaskView(task)
+
+	if asJSON {
+		return c.writeJSON(view)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", view.ID)
+	fmt.Fprintf(w, "Name:\t%s\n", view.Name)
+	fmt.Fprintf(w, "Key:\t%s\n", view.Key)
+	fmt.Fprintf(w, "State:\t%s\n", view.State)
+	fmt.Fprintf(w, "Attempts:\t%d\n", view.Attempts)
+	fmt.Fprintf(w, "Created:\t%s by %s\n", formatTime(view.Created), view.CreatedBy)
+	fmt.Fprintf(w, "Do after:\t%s\n", formatTime(view.DoAfter))
+	fmt.Fprintf(w, "Last attempted:\t%s\n", formatTime(view.LastAttempted))
+	fmt.Fprintf(w, "Message:\t%s\n", view.LastAttemptMessage)
+	w.Flush()
+
+	return c.writeData(view.Data)
+}
+
+func (c *client) showDead(task queue.DeadTask, asJSON bool) error {
+	if asJSON {
+		return c.writeJSON(struct {
+			ID        string                 `json:"id"`
+			Key       string                 `json:"key"`
+			Name      string                 `json:"name"`
+			State     string                 `json:"state"`
+			Attempts  int                    `json:"attempts"`
+			Created   time.Time              `json:"created"`
+			CreatedBy string                 `json:"created_by"`
+			FailedAt  time.Time              `json:"failed_at"`
+			Error     string                 `json:"error"`
+			History   []queue.TaskAttempt    `json:"history"`
+			Data      map[string]interface{} `json:"data"`
+		}{task.ID, task.Key, task.Name, "DEAD", task.Attempts, task.Created, task.CreatedBy, task.FailedAt, task.Error, task.History, task.Data})
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", task.ID)
+	fmt.Fprintf(w, "Name:\t%s\n", task.Name)
+	fmt.Fprintf(w, "Key:\t%s\n", task.Key)
+	fmt.Fprintf(w, "State:\tDEAD (in the dead-letter store)\n")
+	fmt.Fprintf(w, "Attempts:\t%d\n", task.Attempts)
+	fmt.Fprintf(w, "Created:\t%s by %s\n", formatTime(task.Created), task.CreatedBy)
+	fmt.Fprintf(w, "Failed at:\t%s\n", formatTime(task.FailedAt))
+	fmt.Fprintf(w, "Error:\t%s\n", task.Error)
+	for _, attempt := range task.History {
+		fmt.Fprintf(w, "Attempt %d:\t%s %s\n", attempt.Attempt, formatTime(attempt.At), oneLine(attempt.Message))
+	}
+	w.Flush()
+
+	return c.writeData(task.Data)
+}
+
+func (c *client) writeData(data map[string]interface{}) error {
+	b, err := json.MarshalIndent(data, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.out, "Data:\n%s\n", b)
+
+	return nil
+}
+
+func runCounts(c *client, args []string) error {
+	var ff filterFlags
+
+	fs := c.flagSet("counts", "")
+	ff.register(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	filter, err := ff.filter(time.Now())
+
+	if err != nil {
+		return err
+	}
+
+	counts, err := c.tm.CountTasks(filter)
+
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATE\tCOUNT")
+
+	for _, count := range counts {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", count.Name, count.State, count.Count)
+	}
+
+	return w.Flush()
+}
+
+// selection Returns the task ID given as an argument, or else the filter
+// given by flags.  A filter selecting every task is only accepted with all
+func selection(fs *flag.FlagSet, ff *filterFlags, all bool) (string, queue.TaskFilter, error) {
+	switch {
+	case fs.NArg() > 1:
+		return "", queue.TaskFilter{}, fmt.Errorf("give one task ID, or use -id for several")
+	case fs.NArg() == 1 && !ff.empty():
+		return "", queue.TaskFilter{}, fmt.Errorf("give a task ID or filter flags, not both")
+	case fs.NArg() == 1:
+		return fs.Arg(0), queue.TaskFilter{}, nil
+	case ff.empty() && !all:
+		return "", queue.TaskFilter{}, fmt.Errorf("no tasks selected.  Give a task ID or filter flags, or -all for every task")
+	}
+
+	filter, err := ff.filter(time.Now())
+
+	return "", filter, err
+}
+
+// changed Reports how many tasks a command changed
+func (c *client) changed(n int64, err error, verb string) error {
+	if err != nil {
+		return err
+	}
+
+	if n == 1 {
+		fmt.Fprintf(c.out, "%s 1 task\n", verb)
+	} else {
+		fmt.Fprintf(c.out, "%s %d tasks\n", verb, n)
+	}
+
+	return nil
+}
+
+func runCancel(c *client, args []string) error {
+	var ff filterFlags
+	var message string
+	var all bool
+
+	fs := c.flagSet("cancel", "[id]")
+	ff.register(fs)
+	fs.StringVar(&message, "message", "Cancelled by queuectl", "Message recorded against the cancelled tasks")
+	fs.BoolVar(&all, "all", false, "Cancel every pending task, if no filter flags are given")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	id, filter, err := selection(fs, &ff, all)
+
+	if err != nil {
+		return err
+	}
+
+	if len(id) > 0 {
+		return c.changed(1, c.tm.CancelTask(id, message), "Cancelled")
+	}
+
+	n, err := c.tm.CancelTasks(filter, message)
+
+	return c.changed(n, err, "Cancelled")
+}
+
+func runReschedule(c *client, args []string) error {
+	var ff filterFlags
+	var after string
+	var all bool
+
+	fs := c.flagSet("reschedule", "[id]")
+	ff.register(fs)
+	fs.StringVar(&after, "after", "", "When to perform the tasks, as an RFC 3339 time or a duration from now.  Required")
+	fs.BoolVar(&all, "all", false, "Reschedule every pending task, if no filter flags are given")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	doAfter, err := parseTime(after, time.Now())
+
+	if err != nil {
+		return err
+	}
+
+	if doAfter.IsZero() {
+		return fmt.Errorf("reschedule needs -after")
+	}
+
+	id, filter, err := selection(fs, &ff, all)
+
+	if err != nil {
+		return err
+	}
+
+	if len(id) > 0 {
+		return c.changed(1, c.tm.RescheduleTask(id, doAfter), "Rescheduled")
+	}
+
+	n, err := c.tm.RescheduleTasks(filter, doAfter)
+
+	return c.changed(n, err, "Rescheduled")
+}
+
+func runRequeue(c *client, args []string) error {
+	var ff filterFlags
+	var after string
+	var all, dead bool
+
+	fs := c.flagSet("requeue", "[id]")
+	ff.register(fs)
+	fs.StringVar(&after, "after", "", "When to perform the tasks, as an RFC 3339 time or a duration from now.  Now, if empty")
+	fs.BoolVar(&all, "all", false, "Requeue every failed and cancelled task, if no filter flags are given")
+	fs.BoolVar(&dead, "dead", false, "Requeue the task with the given ID from the dead-letter store")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	doAfter, err := parseTime(after, now)
+
+	if err != nil {
+		return err
+	}
+
+	if doAfter.IsZero() {
+		doAfter = now
+	}
+
+	if dead {
+		if fs.NArg() != 1 {
+			return fmt.Errorf("requeue -dead needs one task ID")
+		}
+
+		return c.changed(1, c.tm.RequeueDeadTask(fs.Arg(0), doAfter), "Requeued")
+	}
+
+	id, filter, err := selection(fs, &ff, all)
+
+	if err != nil {
+		return err
+	}
+
+	if len(id) > 0 {
+		return c.changed(1, c.tm.RequeueTask(id, doAfter), "Requeued")
+	}
+
+	n, err := c.tm.RequeueTasks(filter, doAfter)
+
+	return c.changed(n, err, "Requeued")
+}
+
+func runPurge(c *client, args []string) error {
+	var ff filterFlags
+	var all, dead bool
+	var failedBefore string
+
+	fs := c.flagSet("purge", "")
+	ff.register(fs)
+	fs.BoolVar(&all, "all", false, "Purge every finished task, if no filter flags are given")
+	fs.BoolVar(&dead, "dead", false, "Purge from the dead-letter store instead, by ID or with -failed-before")
+	fs.StringVar(&failedBefore, "failed-before", "", "With -dead, purge tasks that failed before this time")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if dead {
+		return c.purgeDead(fs, failedBefore)
+	}
+
+	if fs.NArg() > 0 {
+		return fmt.Errorf("purge selects tasks with filter flags, such as -id")
+	}
+
+	_, filter, err := selection(fs, &ff, all)
+
+	if err != nil {
+		return err
+	}
+
+	n, err := c.tm.PurgeTasks(filter)
+
+	return c.changed(n, err, "Purged")
+}
+
+func (c *client) purgeDead(fs *flag.FlagSet, failedBefore string) error {
+	if fs.NArg() == 1 && len(failedBefore) == 0 {
+		return c.changed(1, c.tm.PurgeDeadTask(fs.Arg(0)), "Purged")
+	}
+
+	if fs.NArg() > 0 || len(failedBefore) == 0 {
+		return fmt.Errorf("purge -dead needs one task ID, or -failed-before")
+	}
+
+	before, err := parseTime(failedBefore, time.Now())
+
+	if err != nil {
+		return err
+	}
+
+	n, err := c.tm.PurgeDeadTasks(before)
+
+	return c.changed(n, err, "Purged")
+}
+
+func runDead(c *client, args []string) error {
+	var limit, offset int
+
+	fs := c.flagSet("dead", "")
+	fs.IntVar(&limit, "limit", 50, "The most tasks to show")
+	fs.IntVar(&offset, "offset", 0, "How many tasks to skip, for paging")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	tasks, err := c.tm.ListDeadTasks(limit, offset)
+
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tKEY\tATTEMPTS\tCREATED\tFAILED AT\tERROR")
+
+	for _, t := range tasks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", t.ID, t.Name, t.Key, t.Attempts, formatTime(t.Created), formatTime(t.FailedAt), oneLine(t.Error))
+	}
+
+	return w.Flush()
+}
+
+func runTail(c *client, args []string) error {
+	var names stringList
+	var interval time.Duration
+
+	fs := c.flagSet("tail", "")
+	fs.Var(&names, "name", "Only show tasks with this `name`.  May be repeated")
+	fs.DurationVar(&interval, "interval", time.Second, "How often to check for new tasks, if the driver can't announce them")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var added <-chan string
+	if n, ok := c.driver.(queue.Notifier); ok {
+		ch, stop, err := n.Subscribe()
+
+		if err != nil {
+			return err
+		}
+		defer stop()
+
+		added = ch
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	// Tasks created at exactly since are listed again next time, so those
+	// already shown are remembered.  Starts from the newest existing task
+	// rather than the local clock, which may differ from the database's:
+	var since time.Time
+	shown := make(map[string]bool)
+
+	newest, err := c.tm.ListTasks(queue.TaskFilter{Names: names, Limit: 1})
+
+	if err != nil {
+		return err
+	}
+
+	if len(newest) > 0 {
+		since = newest[0].Created
+
+		existing, err := c.tm.ListTasks(queue.TaskFilter{Names: names, CreatedAfter: since})
+
+		if err != nil {
+			return err
+		}
+
+		for _, t := range existing {
+			shown[t.ID()] = true
+		}
+	}
+
+	for {
+		tasks, err := c.tm.ListTasks(queue.TaskFilter{Names: names, CreatedAfter: since})
+
+		if err != nil {
+			return err
+		}
+
+		// Oldest first:
+		for i := len(tasks) - 1; i >= 0; i-- {
+			t := tasks[i]
+
+			if shown[t.ID()] {
+				continue
+			}
+
+			if t.Created.After(since) {
+				since = t.Created
+				shown = make(map[string]bool)
+			}
+
+			shown[t.ID()] = true
+			fmt.Fprintf(c.out, "%s\t%s\t%s\t%s\t%s\n", formatTime(t.Created), t.ID(), t.Name, t.Key, t.CreatedBy)
+		}
+
+		select {
+		case <-interrupt:
+			return nil
+		case <-added:
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/episub/queue"
+)
+
+// stringList A flag that may be given more than once, or as a comma
+// separated list
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			*s = append(*s, v)
+		}
+	}
+
+	return nil
+}
+
+// filterFlags Flags selecting tasks, shared by the commands that work on
+// several tasks at once
+type filterFlags struct {
+	ids           stringList
+	names         stringList
+	keys          stringList
+	states        stringList
+	createdBy     string
+	createdAfter  string
+	createdBefore string
+	dueAfter      string
+	dueBefore     string
+}
+
+func (f *filterFlags) register(fs *flag.FlagSet) {
+	fs.Var(&f.ids, "id", "Task `ID`.  May be repeated")
+	fs.Var(&f.names, "name", "Task `name`.  May be repeated")
+	fs.Var(&f.keys, "key", "Task `key`.  May be repeated")
+	fs.Var(&f.states, "state", "Task `state`, such as READY, RETRY, DONE, FAILED or CANCELLED.  May be repeated")
+	fs.StringVar(&f.createdBy, "created-by", "", "Tasks created by this")
+	fs.StringVar(&f.createdAfter, "created-after", "", "Tasks created at or after this `time`")
+	fs.StringVar(&f.createdBefore, "created-before", "", "Tasks created before this `time`")
+	fs.StringVar(&f.dueAfter, "due-after", "", "Tasks due at or after this `time`")
+	fs.StringVar(&f.dueBefore, "due-before", "", "Tasks due before this `time`")
+}
+
+// empty Whether no flags were given, so that every task would be selected
+func (f *filterFlags) empty() bool {
+	return len(f.ids)+len(f.names)+len(f.keys)+len(f.states) == 0 &&
+		len(f.createdBy+f.createdAfter+f.createdBefore+f.dueAfter+f.dueBefore) == 0
+}
+
+// filter Returns the filter selecting the tasks described by the flags
+func (f *filterFlags) filter(now time.Time) (queue.TaskFilter, error) {
+	filter := queue.TaskFilter{
+		IDs:       f.ids,
+		Names:     f.names,
+		Keys:      f.keys,
+		CreatedBy: f.createdBy,
+	}
+
+	for _, state := range f.states {
+		filter.States = append(filter.States, queue.TaskState(strings.ToUpper(state)))
+	}
+
+	times := []struct {
+		value string
+		t     *time.Time
+	}{
+		{f.createdAfter, &filter.CreatedAfter},
+		{f.createdBefore, &filter.CreatedBefore},
+		{f.dueAfter, &filter.DueAfter},
+		{f.dueBefore, &filter.DueBefore},
+	}
+
+	for _, tt := range times {
+		t, err := parseTime(tt.value, now)
+
+		if err != nil {
+			return filter, err
+		}
+
+		*tt.t = t
+	}
+
+	return filter, nil
+}
+
+// parseTime Parses an RFC 3339 time, or a duration from now such as -24h for
+// a day ago.  Returns the zero time if value is empty
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	d, err := time.ParseDuration(value)
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s is neither an RFC 3339 time nor a duration from now", value)
+	}
+
+	return now.Add(d), nil
+}
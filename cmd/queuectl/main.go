@@ -0,0 +1,173 @@
+// Command queuectl Lets operators inspect and manage the tasks in a queue
+// without going to the database directly.  It connects with the same
+// parameters as NewPostgresDriver, or to an existing SQLite file:
+//
+//	queuectl -conn "postgres://..." list -name sendEmail -state RETRY
+//	queuectl -conn "postgres://..." show 2b7c...
+//	queuectl -conn "postgres://..." cancel -key customer42 -message "Customer deleted"
+//	queuectl -sqlite queue.db counts
+//
+// Run queuectl -help for the full list of commands.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/episub/queue"
+)
+
+// config How to connect to the queue
+type config struct {
+	conn       string
+	schema     string
+	table      string
+	uuidSchema string
+	deadTable  string
+	sqlite     string
+}
+
+// command A queuectl command, run against the connected queue with the
+// arguments that follow its name
+type command struct {
+	usage string
+	run   func(c *client, args []string) error
+}
+
+var commands = map[string]command{
+	"add":        {"Adds a task to the queue", runAdd},
+	"list":       {"Lists tasks, most recently created first", runList},
+	"show":       {"Shows a task, including its data and last message", runShow},
+	"counts":     {"Shows how many tasks there are for each name and state", runCounts},
+	"cancel":     {"Cancels pending tasks", runCancel},
+	"reschedule": {"Changes when pending tasks are to be performed", runReschedule},
+	"requeue":    {"Puts failed or cancelled tasks back in the queue", runRequeue},
+	"purge":      {"Deletes finished tasks", runPurge},
+	"dead":       {"Lists tasks in the dead-letter store", runDead},
+	"tail":       {"Shows tasks as they are added", runTail},
+}
+
+func main() {
+	err := run(os.Args[1:], os.Stdout, os.Stderr)
+
+	if err == flag.ErrHelp {
+		return
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "queuectl: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// run Parses the connection flags, connects, and runs the command
+func run(args []string, stdout io.Writer, stderr io.Writer) error {
+	var cfg config
+
+	fs := flag.NewFlagSet("queuectl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&cfg.conn, "conn", os.Getenv("QUEUE_CONN"), "PostgreSQL connection string.  Defaults to $QUEUE_CONN")
+	fs.StringVar(&cfg.schema, "schema", "public", "Schema of the queue table")
+	fs.StringVar(&cfg.table, "table", "message_queue", "Queue table")
+	fs.StringVar(&cfg.uuidSchema, "uuid-schema", "public", "Schema with gen_random_uuid()")
+	fs.StringVar(&cfg.deadTable, "dead-table", "", "Dead-letter table, if failed tasks are moved to one")
+	fs.StringVar(&cfg.sqlite, "sqlite", "", "Existing SQLite database file, to use instead of PostgreSQL")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: queuectl [flags] <command> [command flags]\n\nCommands:\n")
+
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fmt.Fprintf(stderr, "  %-11s %s\n", name, commands[name].usage)
+		}
+
+		fmt.Fprintf(stderr, "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no command given")
+	}
+
+	cmd, ok := commands[fs.Arg(0)]
+
+	if !ok {
+		fs.Usage()
+		return fmt.Errorf("unknown command %s", fs.Arg(0))
+	}
+
+	driver, err := openDriver(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	c := &client{
+		driver: driver,
+		tm:     queue.NewTaskManager(driver),
+		out:    stdout,
+		errOut: stderr,
+	}
+
+	return cmd.run(c, fs.Args()[1:])
+}
+
+// sqlitePath Returns the file named by a go-sqlite3 data source, such as
+// "file:queue.db?cache=shared"
+func sqlitePath(dataSource string) string {
+	path := strings.TrimPrefix(dataSource, "file:")
+
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+
+	return path
+}
+
+// openDriver Connects to the queue described by cfg
+func openDriver(cfg config) (queue.Driver, error) {
+	if len(cfg.sqlite) > 0 {
+		// SQLite would create a missing file, so that a mistyped path would
+		// show an empty queue rather than an error:
+		if _, err := os.Stat(sqlitePath(cfg.sqlite)); err != nil {
+			return nil, fmt.Errorf("cannot open SQLite database: %s", err)
+		}
+
+		d, err := queue.NewSQLiteDriver(cfg.sqlite, cfg.table)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return d, nil
+	}
+
+	if len(strings.TrimSpace(cfg.conn)) == 0 {
+		return nil, fmt.Errorf("no connection string given with -conn or $QUEUE_CONN")
+	}
+
+	d, err := queue.NewPostgresDriver(cfg.conn, cfg.schema, cfg.table, cfg.uuidSchema)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.deadTable) > 0 {
+		d.SetDeadLetterTable(cfg.deadTable)
+	}
+
+	return d, nil
+}
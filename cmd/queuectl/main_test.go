@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/episub/queue"
+)
+
+// queuectl Runs queuectl against the SQLite file, returning its output
+func queuectl(t *testing.T, db string, args ...string) (string, error) {
+	t.Helper()
+
+	var out, errOut bytes.Buffer
+	err := run(append([]string{"-sqlite", db}, args...), &out, &errOut)
+
+	return out.String(), err
+}
+
+// newDatabase Returns a SQLite file with an empty queue table
+func newDatabase(t *testing.T) string {
+	t.Helper()
+
+	db := "file:" + filepath.Join(t.TempDir(), "queue.db")
+
+	d, err := queue.NewSQLiteDriver(db, "message_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = d.CreateTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestQueuectl(t *testing.T) {
+	db := newDatabase(t)
+
+	out, err := queuectl(t, db, "add", "-name", "sendEmail", "-key", "customer1", "-data", `{"to": "a@example.com"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := strings.TrimSpace(out)
+
+	if _, err = queuectl(t, db, "add", "-name", "sendEmail", "-key", "customer2", "-after", "1h"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = queuectl(t, db, "add", "-name", "sendEmail", "-data", "[]"); err == nil {
+		t.Error("Expected error adding a task without a key")
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		contains []string
+		excludes []string
+	}{
+		{"list", []string{"list"}, []string{"customer1", "customer2"}, nil},
+		{"list by key", []string{"list", "-key", "customer2"}, []string{"customer2"}, []string{"customer1"}},
+		{"list due", []string{"list", "-due-before", "1m"}, []string{"customer1"}, []string{"customer2"}},
+		{"counts", []string{"counts"}, []string{"sendEmail  READY  2"}, nil},
+		{"show", []string{"show", id}, []string{"customer1", "a@example.com", "Created"}, nil},
+		{"cancel", []string{"cancel", "-message", "Customer deleted", id}, []string{"Cancelled 1 task"}, nil},
+		{"show cancelled", []string{"show", id}, []string{"CANCELLED", "Customer deleted"}, nil},
+		{"requeue", []string{"requeue", "-state", "cancelled"}, []string{"Requeued 1 task"}, nil},
+		{"reschedule", []string{"reschedule", "-after", "2h", "-name", "sendEmail"}, []string{"Rescheduled 2 tasks"}, nil},
+		{"purge", []string{"purge", "-all"}, []string{"Purged 0 tasks"}, nil},
+	}
+
+	for _, tt := range tests {
+		out, err := queuectl(t, db, tt.args...)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+
+		for _, s := range tt.contains {
+			if !strings.Contains(out, s) {
+				t.Errorf("%s: expected output to contain %q, but was:\n%s", tt.name, s, out)
+			}
+		}
+
+		for _, s := range tt.excludes {
+			if strings.Contains(out, s) {
+				t.Errorf("%s: expected output not to contain %q, but was:\n%s", tt.name, s, out)
+			}
+		}
+	}
+
+	// Commands changing several tasks need something to select them by:
+	if _, err = queuectl(t, db, "cancel"); err == nil {
+		t.Error("Expected error cancelling without selecting tasks")
+	}
+
+	if _, err = queuectl(t, db, "unknown"); err == nil {
+		t.Error("Expected error for an unknown command")
+	}
+}
+
+func TestQueuectlMissingDatabase(t *testing.T) {
+	// A mistyped path is an error, rather than a new, empty database
+	path := filepath.Join(t.TempDir(), "missing.db")
+
+	if _, err := queuectl(t, "file:"+path+"?cache=shared", "counts"); err == nil {
+		t.Error("Expected error opening a missing database")
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the database not to be created, but had %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DeadLetterDriver Implemented by drivers that move permanently failed tasks
+// out of the queue and into a dead-letter store, where they can be inspected
+// and requeued or purged
+type DeadLetterDriver interface {
+	// ListDeadTasks Returns dead-lettered tasks, most recently failed first.
+	// Returns an error if limit or offset is negative
+	ListDeadTasks(limit int, offset int) ([]DeadTask, error)
+	// GetDeadTask Returns the dead-lettered task with the given ID, or
+	// ErrTaskNotFound
+	GetDeadTask(id string) (DeadTask, error)
+	// RequeueDeadTask Moves the task back into the queue, ready to be
+	// performed after doAfter, with its attempts reset.  Everything else
+	// about the task, including its history, is kept
+	RequeueDeadTask(id string, doAfter time.Time) error
+	// PurgeDeadTask Deletes the dead-lettered task with the given ID
+	PurgeDeadTask(id string) error
+	// PurgeDeadTasks Deletes tasks that failed before the given time,
+	// returning how many were deleted
+	PurgeDeadTasks(failedBefore time.Time) (int64, error)
+}
+
+// DeadTask A task that failed permanently, as kept in the dead-letter store
+type DeadTask struct {
+	ID        string // The ID the task had in the queue, which it keeps if requeued
+	Key       string
+	Name      string
+	Created   time.Time
+	CreatedBy string
+	Data      map[string]interface{}
+	RawData   []byte            // The data before it's been unmarshalled
+	Metadata  map[string]string // As given by WithMetadata
+	Attempts  int               // How many times the task was popped before it failed
+	Error     string            // The final last_attempt_message
+	FailedAt  time.Time         // When the task was failed
+	History   []TaskAttempt     // The attempts that were retried, followed by the one that failed
+}
+
+// TaskAttempt An attempt at a task that ended in a retry or failure, as kept
+// in the task's history.  Attempts that never finished, such as when the
+// process running them went away, aren't recorded
+type TaskAttempt struct {
+	Attempt int       `json:"attempt"` // Which attempt this was, from 1.  Starts again if the task is requeued
+	At      time.Time `json:"at"`      // When the attempt finished
+	Message string    `json:"message"` // The last_attempt_message the attempt finished with
+}
+
+// appendAttempt Returns the JSON attempt history with the attempt appended
+func appendAttempt(history []byte, attempt TaskAttempt) ([]byte, error) {
+	attempts, err := unmarshalHistory(history)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(append(attempts, attempt))
+}
+
+// unmarshalHistory Returns the attempts in the JSON history, or nil if there
+// are none
+func unmarshalHistory(history []byte) ([]TaskAttempt, error) {
+	var attempts []TaskAttempt
+
+	if len(history) == 0 {
+		return attempts, nil
+	}
+
+	err := json.Unmarshal(history, &attempts)
+
+	return attempts, err
+}
+
+// checkDeadPage Checks the limit and offset given to ListDeadTasks
+func checkDeadPage(limit int, offset int) error {
+	if limit < 0 || offset < 0 {
+		return fmt.Errorf("limit and offset cannot be negative")
+	}
+
+	return nil
+}
+
+// ErrNotSupported Returned when the driver doesn't support the requested
+// feature, such as a dead-letter store
+var ErrNotSupported = errors.New("not supported by this driver")
+
+// ErrTaskNotFound Returned when there is no task with the requested ID
+var ErrTaskNotFound = errors.New("task not found")
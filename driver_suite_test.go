@@ -0,0 +1,401 @@
+package queue_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/episub/queue"
+	"github.com/episub/queue/queuetest"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+func TestMemoryDriver(t *testing.T) {
+	queuetest.RunDriverSuite(t, func(t *testing.T) queue.Driver {
+		return queue.NewMemoryDriver()
+	})
+}
+
+func TestPostgresDriver(t *testing.T) {
+	dbConn := os.Getenv("PG_CONNSTRING")
+
+	if len(dbConn) == 0 {
+		t.Skip("PG_CONNSTRING not set")
+	}
+
+	d, err := queue.NewPostgresDriver(dbConn, os.Getenv("PG_SCHEMA"), os.Getenv("PG_TABLE"), os.Getenv("PG_UUID_SCHEMA"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.SetDeadLetterTable(os.Getenv("PG_TABLE") + "_dead")
+
+	queuetest.RunDriverSuite(t, func(t *testing.T) queue.Driver {
+		return d
+	})
+}
+
+func TestSQLiteDriver(t *testing.T) {
+	d, err := queue.NewSQLiteDriver("file:"+filepath.Join(t.TempDir(), "queue.db"), "message_queue")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = d.CreateTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	queuetest.RunDriverSuite(t, func(t *testing.T) queue.Driver {
+		return d
+	})
+}
+
+func TestPgxDriver(t *testing.T) {
+	dbConn := os.Getenv("PG_CONNSTRING")
+
+	if len(dbConn) == 0 {
+		t.Skip("PG_CONNSTRING not set")
+	}
+
+	pool, err := pgxpool.Connect(context.Background(), dbConn)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	d, err := queue.NewPgxDriver(pool, os.Getenv("PG_SCHEMA"), os.Getenv("PG_TABLE"), os.Getenv("PG_UUID_SCHEMA"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.SetDeadLetterTable(os.Getenv("PG_TABLE") + "_dead")
+
+	queuetest.RunDriverSuite(t, func(t *testing.T) queue.Driver {
+		return d
+	})
+}
+
+// testAddTaskTx Checks that a task added in a transaction is only added if the
+// transaction is committed
+func testAddTaskTx(t *testing.T, d queue.Driver, addTaskTx func(commit bool) error) {
+	if err := d.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, commit := range []bool{false, true} {
+		if err := addTaskTx(commit); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	length, err := d.GetQueueLength()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if length != 1 {
+		t.Errorf("Expected only the committed task to be added, but queue length was %d", length)
+	}
+}
+
+func TestSQLiteAddTaskTx(t *testing.T) {
+	dataSource := "file:" + filepath.Join(t.TempDir(), "queue.db")
+	d, err := queue.NewSQLiteDriver(dataSource, "message_queue")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = d.CreateTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", dataSource)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tm := queue.NewTaskManager(d)
+
+	testAddTaskTx(t, d, func(commit bool) error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err = tm.AddTaskTx(tx, "testAddTaskTx", "a", time.Now(), "test_runner", map[string]interface{}{}); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if commit {
+			return tx.Commit()
+		}
+
+		return tx.Rollback()
+	})
+}
+
+func TestPostgresAddTaskTx(t *testing.T) {
+	dbConn := os.Getenv("PG_CONNSTRING")
+
+	if len(dbConn) == 0 {
+		t.Skip("PG_CONNSTRING not set")
+	}
+
+	d, err := queue.NewPostgresDriver(dbConn, os.Getenv("PG_SCHEMA"), os.Getenv("PG_TABLE"), os.Getenv("PG_UUID_SCHEMA"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("postgres", dbConn)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tm := queue.NewTaskManager(d)
+
+	testAddTaskTx(t, d, func(commit bool) error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err = tm.AddTaskTx(tx, "testAddTaskTx", "a", time.Now(), "test_runner", map[string]interface{}{}); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if commit {
+			return tx.Commit()
+		}
+
+		return tx.Rollback()
+	})
+}
+
+func TestPgxAddTaskTx(t *testing.T) {
+	dbConn := os.Getenv("PG_CONNSTRING")
+
+	if len(dbConn) == 0 {
+		t.Skip("PG_CONNSTRING not set")
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.Connect(ctx, dbConn)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	d, err := queue.NewPgxDriver(pool, os.Getenv("PG_SCHEMA"), os.Getenv("PG_TABLE"), os.Getenv("PG_UUID_SCHEMA"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tm := queue.NewTaskManager(d)
+
+	testAddTaskTx(t, d, func(commit bool) error {
+		tx, err := pool.Begin(ctx)
+		if err != nil {
+			return err
+		}
+
+		if _, err = tm.AddTaskPgxTx(tx, "testAddTaskTx", "a", time.Now(), "test_runner", map[string]interface{}{}); err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+
+		if commit {
+			return tx.Commit(ctx)
+		}
+
+		return tx.Rollback(ctx)
+	})
+}
+
+// testPopWaitsForLock Checks that Pop waits for another transaction holding
+// the task's row, rather than giving up on a task it has already claimed
+func testPopWaitsForLock(t *testing.T, d queue.Driver, dbConn string) {
+	if err := d.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	tm := queue.NewTaskManager(d)
+
+	if _, err := tm.AddTask("testPopWaitsForLock", "a", time.Now(), "test_runner", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("postgres", dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	table := os.Getenv("PG_TABLE")
+	if schema := os.Getenv("PG_SCHEMA"); len(schema) > 0 {
+		table = schema + "." + table
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = tx.Exec("SELECT 1 FROM " + table + " WHERE task_key = 'a' FOR UPDATE"); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		tx.Commit()
+	}()
+
+	task, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatalf("Expected Pop to wait for the lock, but had %v", err)
+	}
+
+	if task.Attempts != 1 {
+		t.Errorf("Expected 1 attempt, but had %d", task.Attempts)
+	}
+
+	if err = d.Complete(task, "test done"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testLockLost Checks that the lease on a task can't be extended once the
+// lock taken by Pop is gone
+func testLockLost(t *testing.T, d queue.Driver) {
+	if err := d.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	tm := queue.NewTaskManager(d)
+
+	if _, err := tm.AddTask("testLockLost", "a", time.Now(), "test_runner", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extender := d.(queue.LeaseExtender)
+
+	if _, err = extender.ExtendLease(task, time.Minute); err != nil {
+		t.Fatalf("Expected the lease to be extended while the task is locked, but had %v", err)
+	}
+
+	// Releases the lock without finishing the task:
+	d.Cleanup(task)
+
+	if _, err = extender.ExtendLease(task, time.Minute); err == nil {
+		t.Error("Expected an error extending the lease once the lock is gone")
+	}
+}
+
+func TestPostgresRowLocks(t *testing.T) {
+	dbConn := os.Getenv("PG_CONNSTRING")
+
+	if len(dbConn) == 0 {
+		t.Skip("PG_CONNSTRING not set")
+	}
+
+	d, err := queue.NewPostgresDriver(dbConn, os.Getenv("PG_SCHEMA"), os.Getenv("PG_TABLE"), os.Getenv("PG_UUID_SCHEMA"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testPopWaitsForLock(t, d, dbConn)
+	testLockLost(t, d)
+}
+
+func TestPgxRowLocks(t *testing.T) {
+	dbConn := os.Getenv("PG_CONNSTRING")
+
+	if len(dbConn) == 0 {
+		t.Skip("PG_CONNSTRING not set")
+	}
+
+	pool, err := pgxpool.Connect(context.Background(), dbConn)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	d, err := queue.NewPgxDriver(pool, os.Getenv("PG_SCHEMA"), os.Getenv("PG_TABLE"), os.Getenv("PG_UUID_SCHEMA"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testPopWaitsForLock(t, d, dbConn)
+	testLockLost(t, d)
+}
+
+func TestAddTaskTxNotSupported(t *testing.T) {
+	tm := queue.NewTaskManager(queue.NewMemoryDriver())
+
+	if _, err := tm.AddTaskTx(nil, "testAddTaskTx", "a", time.Now(), "test_runner", nil); err != queue.ErrNotSupported {
+		t.Errorf("Expected ErrNotSupported, but had %v", err)
+	}
+}
+
+func TestEditTaskByID(t *testing.T) {
+	tm := queue.NewTaskManager(queue.NewMemoryDriver())
+
+	id, err := tm.AddTask("testEditTaskByID", "a", time.Now().Add(time.Hour), "test_runner", map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tm.RequeueTask(id, time.Now()); err != queue.ErrTaskNotFound {
+		t.Errorf("Expected ErrTaskNotFound requeueing a pending task, but had %v", err)
+	}
+
+	if err = tm.RescheduleTask(id, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tm.CancelTask(id, "No longer wanted"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tm.CancelTask(id, "No longer wanted"); err != queue.ErrTaskNotFound {
+		t.Errorf("Expected ErrTaskNotFound cancelling a cancelled task, but had %v", err)
+	}
+
+	if err = tm.RequeueTask(id, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := tm.GetTask(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if task.State != queue.TaskReady || task.LastAttemptMessage != "Requeued" {
+		t.Errorf("Expected requeued task, but had %+v", task)
+	}
+}
@@ -1,39 +1,115 @@
 package queue
 
 import (
+	"database/sql"
 	"errors"
 	"time"
+
+	"github.com/jackc/pgx/v4"
 )
 
-// Driver Manages the connection to the background queue to keep track of tasks
+// Driver Manages the connection to the background queue to keep track of tasks.
+// Drivers outside this package can keep track of their own state for a task
+// using Task.SetID and Task.SetDriverNote
 type Driver interface {
-	clear() error // Clears the queue.  Obviously, be careful
-	addTask(init TaskInit) error
-	// getTask(taskName string) (Task, error) // Grabs most recent entry for that task name
-	name() string // Returns a name for the driver
+	Clear() error // Clears the queue.  Obviously, be careful
+	// AddTask Adds a task to the queue, returning its ID.  If the task is
+	// dropped because it matches one already in the queue, as per
+	// init.Unique, the ID of the matching task is returned instead
+	AddTask(init TaskInit) (string, error)
+	Name() string // Returns a name for the driver
 
-	// pop Grabs the earliest task that's ready for action
-	pop() (Task, error)
+	// Pop Grabs the earliest task that's ready for action, within the
+	// restrictions of opts.  Returns ErrNoTasks if there is nothing to do.
+	// The same task must not be returned again until it has been completed,
+	// cancelled, failed, retried or cleaned up.  A popped task is leased to
+	// the caller for opts.Lease: it's marked for retry once the lease
+	// expires, so that it is picked up again if the process handling it goes
+	// away.  Task.DoAfter is set to when the lease expires
+	Pop(opts PopOptions) (Task, error)
 
-	// cleanup Gives the driver a chance to clean up the task, such as closing
+	// Cleanup Gives the driver a chance to clean up the task, such as closing
 	// off any transactions
-	cleanup(Task)
-
-	// refreshRetry Refreshes all tasks marked as retry that are older than the specified interval
-	refreshRetry(age time.Duration) error
-	// complete Marks a task as complete
-	complete(task Task, message string) error
-	// cancel Marks a task as cancelled
-	cancel(task Task, message string) error
-	// fail Marks a task as permanently failed
-	fail(task Task, message string) error
-	// retry Marks a task as temporarily failed and in need of a retry later
-	retry(task Task, message string) error
-
-	// getQueueLength returns the number of total tasks currently in the queue
-	getQueueLength() (int64, error)
-	// getTaskCount returns the number of active tasks in the queue that have the given name
-	getTaskCount(taskName string) (int64, error)
+	Cleanup(Task)
+
+	// Complete Marks a task as complete
+	Complete(task Task, message string) error
+	// Cancel Marks a task as cancelled
+	Cancel(task Task, message string) error
+	// Fail Marks a task as permanently failed
+	Fail(task Task, message string) error
+	// Retry Marks a task as temporarily failed, to be retried once doAfter
+	// has passed
+	Retry(task Task, message string, doAfter time.Time) error
+
+	// GetQueueLength returns the number of total tasks currently in the queue
+	GetQueueLength() (int64, error)
+	// GetTaskCount returns the number of active tasks in the queue that have the given name
+	GetTaskCount(taskName string) (int64, error)
+}
+
+// DefaultLease How long a popped task is leased to the caller, unless
+// PopOptions.Lease says otherwise
+const DefaultLease = 10 * time.Minute
+
+// PopOptions Restricts which tasks Pop may return.  The zero value places no
+// restrictions
+type PopOptions struct {
+	Names        []string      // Only tasks with one of these names are returned.  Any name, if empty
+	ExcludeNames []string      // Tasks with any of these names are left in the queue
+	Lease        time.Duration // How long until the task may be reclaimed.  DefaultLease, if zero
+}
+
+// lease Returns how long the popped task is leased for
+func (o PopOptions) lease() time.Duration {
+	if o.Lease <= 0 {
+		return DefaultLease
+	}
+
+	return o.Lease
+}
+
+// LeaseExtender Implemented by drivers that can extend the lease on a popped
+// task, so that a task taking longer than its lease isn't reclaimed while
+// it's still being performed.  SyncManager extends the lease while the
+// task's action runs.  Drivers that don't implement it must keep a popped task
+// from being reclaimed for as long as it's held some other way
+type LeaseExtender interface {
+	// ExtendLease Extends the lease on a task still held by the caller to
+	// lease from now, returning when the lease will now expire.  Returns an
+	// error if the task is no longer held, such as because its lease
+	// expired and it was reclaimed
+	ExtendLease(task Task, lease time.Duration) (time.Time, error)
+}
+
+// Notifier Implemented by drivers that can announce tasks as they are added,
+// so that SyncManager can pick them up straight away rather than waiting to
+// poll
+type Notifier interface {
+	// Subscribe Returns a channel that receives the name of each task added
+	// to the queue, and a function to call once no longer interested.  An
+	// empty name means that notifications may have been missed
+	Subscribe() (<-chan string, func(), error)
+}
+
+// SQLTxDriver Implemented by drivers that can add a task as part of the
+// caller's database/sql transaction, so that the task is only added if the
+// caller's own changes are committed.  The transaction must be on the
+// queue's database
+type SQLTxDriver interface {
+	AddTaskTx(tx *sql.Tx, init TaskInit) (string, error)
+}
+
+// PgxTxDriver Implemented by drivers that can add a task as part of the
+// caller's pgx transaction.  The transaction must be on the queue's database
+type PgxTxDriver interface {
+	AddTaskTx(tx pgx.Tx, init TaskInit) (string, error)
+}
+
+// sqlQuerier The parts of *sql.DB and *sql.Tx used to add tasks
+type sqlQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
 // ErrNoTasks Returned when there are no tasks available in the queue
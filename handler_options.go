@@ -0,0 +1,156 @@
+package queue
+
+import "time"
+
+// defaultRetryDelay How long to wait before retrying a task whose action asked
+// for a retry, unless the handler was registered with WithRetryDelay or
+// WithRetryPolicy
+const defaultRetryDelay = 10 * time.Minute
+
+// TaskHandlerOption Configures how the tasks for a registered handler are run
+type TaskHandlerOption func(*taskHandler)
+
+// taskHandler A registered action, along with how its tasks are to be run
+type taskHandler struct {
+	action       ContextTaskAction
+	pollInterval time.Duration // Non-zero if the handler has a queue runner of its own
+	concurrency  int           // Non-zero if the handler has a queue runner of its own
+	retryPolicy  RetryPolicy
+	maxAttempts  int           // Zero if the handler's tasks may be attempted any number of times
+	timeout      time.Duration // Zero if the action has until the task would be reclaimed
+	panicResult  TaskResult    // Recorded when the action panics
+}
+
+// ownRunner Whether the handler's tasks are taken from the queue by a runner
+// of their own, rather than the runner shared by other handlers
+func (h taskHandler) ownRunner() bool {
+	return h.pollInterval > 0 || h.concurrency > 0
+}
+
+// maxTimeoutGrace The longest an action that has timed out is waited for
+const maxTimeoutGrace = time.Minute
+
+// timeoutGrace Returns how long an action that has timed out is waited for
+// once its context is cancelled: as long again as its timeout, up to
+// maxTimeoutGrace
+func (h taskHandler) timeoutGrace() time.Duration {
+	if h.timeout > maxTimeoutGrace {
+		return maxTimeoutGrace
+	}
+
+	return h.timeout
+}
+
+// lease Returns how long the handler's tasks are leased for, given the
+// SyncManager's lease.  Tasks with a timeout are leased at least until the
+// worker gives up on them, so that they're never reclaimed while the worker
+// may still be running them
+func (h taskHandler) lease(lease time.Duration) time.Duration {
+	if h.timeout > 0 && lease < h.timeout+h.timeoutGrace() {
+		return h.timeout + h.timeoutGrace()
+	}
+
+	return lease
+}
+
+// runner Returns the queue runner for a handler with a runner of its own
+func (h taskHandler) runner(taskName string, defaultPollInterval time.Duration) queueRunner {
+	r := queueRunner{
+		taskName:     taskName,
+		pollInterval: h.pollInterval,
+		workers:      h.concurrency,
+	}
+
+	if r.pollInterval <= 0 {
+		r.pollInterval = defaultPollInterval
+	}
+
+	if r.workers < 1 {
+		r.workers = 1
+	}
+
+	return r
+}
+
+// WithPollInterval Gives the handler's tasks a queue runner of their own,
+// which checks for tasks at this interval when idle.  This way a handler for
+// tasks that need attention quickly isn't kept waiting behind a slow handler
+func WithPollInterval(interval time.Duration) TaskHandlerOption {
+	return func(h *taskHandler) {
+		h.pollInterval = interval
+	}
+}
+
+// WithConcurrency Gives the handler's tasks a queue runner of their own, with
+// n workers so that up to n of its tasks are run at once.  These workers are
+// in addition to those set with SyncManager.SetWorkers
+func WithConcurrency(n int) TaskHandlerOption {
+	return func(h *taskHandler) {
+		if n < 1 {
+			n = 1
+		}
+
+		h.concurrency = n
+	}
+}
+
+// WithRetryDelay Sets how long to wait before trying a task again when the
+// action returns TaskResultRetryFailure.  Defaults to 10 minutes.  Shorthand
+// for WithRetryPolicy(FixedRetryPolicy(delay))
+func WithRetryDelay(delay time.Duration) TaskHandlerOption {
+	return WithRetryPolicy(FixedRetryPolicy(delay))
+}
+
+// WithRetryPolicy Sets how long to wait before trying a task again when the
+// action returns TaskResultRetryFailure, based on how many times the task has
+// been attempted
+func WithRetryPolicy(policy RetryPolicy) TaskHandlerOption {
+	return func(h *taskHandler) {
+		if policy != nil {
+			h.retryPolicy = policy
+		}
+	}
+}
+
+// WithMaxAttempts Fails a task, rather than retrying it, once it has been
+// attempted n times.  Attempts that never finished, such as when the process
+// running them went away, count too.  A limit below 1 means tasks may be
+// attempted any number of times, which is the default
+func WithMaxAttempts(n int) TaskHandlerOption {
+	return func(h *taskHandler) {
+		if n < 0 {
+			n = 0
+		}
+
+		h.maxAttempts = n
+	}
+}
+
+// WithTimeout Sets how long the action has to handle a task.  When the time
+// is up the action's context is cancelled, and the task is retried with the
+// result TaskResultTimeout, as per the retry policy and WithMaxAttempts.  The
+// action is given as long again as the timeout, up to a minute, to return.
+// After that the worker moves on without it, so an action that ignores its
+// context may still be running when its task is retried.  The task's lease
+// lasts at least until the worker moves on
+func WithTimeout(timeout time.Duration) TaskHandlerOption {
+	return func(h *taskHandler) {
+		if timeout < 0 {
+			timeout = 0
+		}
+
+		h.timeout = timeout
+	}
+}
+
+// WithPanicResult Sets the result recorded when the action panics, either
+// TaskResultRetryFailure (the default) or TaskResultPermanentFailure.  Any
+// other result is ignored.  The panic and its stack trace are recorded as the
+// task's last_attempt_message, and passed to the error handler
+func WithPanicResult(result TaskResult) TaskHandlerOption {
+	return func(h *taskHandler) {
+		if result == TaskResultRetryFailure || result == TaskResultPermanentFailure {
+			h.panicResult = result
+		}
+	}
+}
@@ -0,0 +1,808 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// MemoryDriver In-memory driver.  Useful for tests, and for single process
+// deployments where tasks do not need to survive a restart.  Safe for use by
+// multiple SyncManagers in the same process.
+type MemoryDriver struct {
+	mx    *sync.Mutex
+	seq   int64
+	tasks map[string]*memoryTask
+	dead  map[string]*memoryTask // Failed tasks, with lastAttempted as the time they failed
+	hub   *notifyHub
+}
+
+// memoryTask A stored task.  Mirrors a row in the PostgreSQL table
+type memoryTask struct {
+	id                 string
+	seq                int64 // Insertion order, used to break ties on lastAttempted
+	key                string
+	name               string
+	created            time.Time
+	createdBy          string
+	state              TaskState
+	data               []byte
+	metadata           map[string]string // A copy of the caller's, so that it can't be changed after the fact
+	lastAttempted      time.Time
+	lastAttemptMessage string
+	doAfter            time.Time
+	attempts           int
+	idempotencyKey     string
+	history            []TaskAttempt // Attempts that ended in a retry or failure
+	locked             bool          // Stands in for the row lock held by PostgresDriver between Pop() and completion
+	lockID             int64         // Incremented on each pop, so that stale Task values cannot change state
+}
+
+// NewMemoryDriver Returns a new, empty, in-memory driver
+func NewMemoryDriver() *MemoryDriver {
+	return &MemoryDriver{
+		mx:    &sync.Mutex{},
+		tasks: make(map[string]*memoryTask),
+		dead:  make(map[string]*memoryTask),
+		hub:   newNotifyHub(),
+	}
+}
+
+// Name Returns the name of the driver
+func (m *MemoryDriver) Name() string {
+	return "MemoryDriver"
+}
+
+// Clear Removes all entries from the queue and the dead-letter store
+func (m *MemoryDriver) Clear() error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	m.tasks = make(map[string]*memoryTask)
+	m.dead = make(map[string]*memoryTask)
+
+	return nil
+}
+
+// AddTask Adds a task to the queue, returning its ID.  If the task matches
+// one already there as per taskData.Unique, the ID of the match is returned
+func (m *MemoryDriver) AddTask(taskData TaskInit) (string, error) {
+	if err := checkUnique(taskData); err != nil {
+		return "", err
+	}
+
+	// Store data as json, so that handlers see the same types as they would
+	// from other drivers:
+	data, err := json.Marshal(taskData.Data)
+
+	if err != nil {
+		return "", err
+	}
+
+	id, err := uuid.NewV4()
+
+	if err != nil {
+		return "", err
+	}
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	created := time.Now()
+
+	if taskData.Unique != UniqueNone {
+		if match := m.resolveConflict(taskData, data, created); match != nil {
+			return match.id, nil
+		}
+	}
+
+	defer m.hub.publish(taskData.Name)
+
+	m.seq++
+	m.tasks[id.String()] = &memoryTask{
+		id:                 id.String(),
+		seq:                m.seq,
+		key:                taskData.Key,
+		name:               taskData.Name,
+		created:            created,
+		createdBy:          taskData.CreatedBy,
+		state:              TaskReady,
+		data:               data,
+		metadata:           copyMetadata(taskData.Metadata),
+		lastAttempted:      created,
+		lastAttemptMessage: "Created",
+		doAfter:            taskData.DoAfter,
+		idempotencyKey:     taskData.IdempotencyKey,
+	}
+
+	return id.String(), nil
+}
+
+// resolveConflict Applies the conflict policy to tasks that taskData would
+// duplicate, returning the most recently created.  Returns nil if there are
+// none, so the task is to be added.  Must be called with the mutex held
+func (m *MemoryDriver) resolveConflict(taskData TaskInit, data []byte, now time.Time) *memoryTask {
+	var match *memoryTask
+
+	for _, t := range m.tasks {
+		if !t.duplicatedBy(taskData, now) {
+			continue
+		}
+
+		if match == nil || t.created.After(match.created) || (t.created.Equal(match.created) && t.seq > match.seq) {
+			match = t
+		}
+
+		if t.locked || t.state != TaskReady {
+			continue
+		}
+
+		switch taskData.OnConflict {
+		case ConflictReplaceData:
+			t.data = data
+		case ConflictResetDoAfter:
+			t.doAfter = taskData.DoAfter
+		}
+	}
+
+	return match
+}
+
+// duplicatedBy Whether adding taskData would duplicate this task
+func (t *memoryTask) duplicatedBy(taskData TaskInit, now time.Time) bool {
+	switch taskData.Unique {
+	case UniqueByKey:
+		if t.key != taskData.Key {
+			return false
+		}
+	case UniqueByKeyAndName:
+		if t.key != taskData.Key || t.name != taskData.Name {
+			return false
+		}
+	default:
+		if t.idempotencyKey != taskData.IdempotencyKey {
+			return false
+		}
+	}
+
+	if taskData.UniqueWithin > 0 {
+		return t.created.After(now.Add(-taskData.UniqueWithin))
+	}
+
+	switch t.state {
+	case TaskReady, TaskInProgress, TaskRetry:
+		return true
+	}
+
+	return false
+}
+
+// Subscribe Returns a channel receiving the names of tasks as they're added
+func (m *MemoryDriver) Subscribe() (<-chan string, func(), error) {
+	ch, stop := m.hub.subscribe()
+
+	return ch, stop, nil
+}
+
+// Pop Returns the oldest task that is ready, and holds it until it is
+// completed or cleaned up.  Ready tasks sharing its key and name are
+// coalesced, so that only the newest is performed
+func (m *MemoryDriver) Pop(opts PopOptions) (Task, error) {
+	var task Task
+
+	excluded := make(map[string]bool)
+	for _, name := range opts.ExcludeNames {
+		excluded[name] = true
+	}
+
+	var included map[string]bool
+	if len(opts.Names) > 0 {
+		included = make(map[string]bool)
+		for _, name := range opts.Names {
+			included[name] = true
+		}
+	}
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	now := time.Now()
+
+	var candidates []*memoryTask
+	for _, t := range m.tasks {
+		if t.locked || t.doAfter.After(now) || excluded[t.name] {
+			continue
+		}
+
+		if included != nil && !included[t.name] {
+			continue
+		}
+
+		switch t.state {
+		case TaskReady, TaskInProgress, TaskRetry:
+		default:
+			continue
+		}
+
+		candidates = append(candidates, t)
+	}
+
+	if len(candidates) == 0 {
+		return task, ErrNoTasks
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].lastAttempted.Equal(candidates[j].lastAttempted) {
+			return candidates[i].seq < candidates[j].seq
+		}
+		return candidates[i].lastAttempted.Before(candidates[j].lastAttempted)
+	})
+
+	t := m.coalesce(candidates[0], now)
+	// As with PostgresDriver, a popped task defaults to retry, so if there's
+	// an issue then it gets retried later rather than immediately
+	t.lastAttempted = now
+	t.lastAttemptMessage = "Attempting"
+	t.state = TaskRetry
+	t.doAfter = now.Add(opts.lease())
+	t.attempts++
+	t.locked = true
+	t.lockID++
+
+	task = t.toTask()
+	task.DoAfter = t.doAfter
+	task.driverNote = t.lockID
+
+	err := json.Unmarshal(t.data, &task.Data)
+
+	if err != nil {
+		// Release the task, leaving it marked for retry:
+		t.locked = false
+	}
+
+	return task, err
+}
+
+// coalesce Returns the task to perform in place of t.  When there are several
+// ready tasks with the same key and name, only the newest is performed, and
+// the others are cancelled.  Must be called with the mutex held
+func (m *MemoryDriver) coalesce(t *memoryTask, now time.Time) *memoryTask {
+	if t.state != TaskReady {
+		return t
+	}
+
+	var siblings []*memoryTask
+	newest := t
+	for _, s := range m.tasks {
+		if s.locked || s.state != TaskReady || s.key != t.key || s.name != t.name || s.doAfter.After(now) {
+			continue
+		}
+
+		siblings = append(siblings, s)
+
+		if s.created.After(newest.created) || (s.created.Equal(newest.created) && s.seq > newest.seq) {
+			newest = s
+		}
+	}
+
+	for _, s := range siblings {
+		if s != newest {
+			s.state = TaskCancelled
+			s.lastAttempted = now
+			s.lastAttemptMessage = "Superseded by " + newest.id
+		}
+	}
+
+	return newest
+}
+
+// Cleanup Releases the hold on a task obtained from Pop
+func (m *MemoryDriver) Cleanup(task Task) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if t, err := m.heldTask(task); err == nil {
+		t.locked = false
+	}
+}
+
+// GetQueueLength Returns the number of tasks in the queue, in any state
+func (m *MemoryDriver) GetQueueLength() (int64, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	return int64(len(m.tasks)), nil
+}
+
+// GetTaskCount Returns the number of active tasks with the given name
+func (m *MemoryDriver) GetTaskCount(taskName string) (int64, error) {
+	var length int64
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	for _, t := range m.tasks {
+		if t.name != taskName {
+			continue
+		}
+
+		switch t.state {
+		case TaskCancelled, TaskDone, TaskFailed:
+		default:
+			length++
+		}
+	}
+
+	return length, nil
+}
+
+// Complete Marks a task as complete
+func (m *MemoryDriver) Complete(task Task, message string) error {
+	return m.setTaskState(task, TaskDone, message)
+}
+
+// Cancel Marks a task as cancelled
+func (m *MemoryDriver) Cancel(task Task, message string) error {
+	return m.setTaskState(task, TaskCancelled, message)
+}
+
+// Fail Marks a task as permanently failed
+func (m *MemoryDriver) Fail(task Task, message string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	t, err := m.heldTask(task)
+
+	if err != nil {
+		return err
+	}
+
+	// Move the task to the dead-letter store:
+	err = m.finish(t, TaskFailed, message)
+	t.addHistory()
+	delete(m.tasks, t.id)
+	m.dead[t.id] = t
+
+	return err
+}
+
+// Retry Marks a task as in need of a retry once doAfter has passed
+func (m *MemoryDriver) Retry(task Task, message string, doAfter time.Time) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	t, err := m.heldTask(task)
+
+	if err != nil {
+		return err
+	}
+
+	t.doAfter = doAfter
+	err = m.finish(t, TaskRetry, message)
+	t.addHistory()
+
+	return err
+}
+
+// ExtendLease Extends the lease on a task that is still held, as per
+// LeaseExtender
+func (m *MemoryDriver) ExtendLease(task Task, lease time.Duration) (time.Time, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	t, err := m.heldTask(task)
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	t.doAfter = time.Now().Add(lease)
+
+	return t.doAfter, nil
+}
+
+// ListDeadTasks Returns failed tasks, most recently failed first
+func (m *MemoryDriver) ListDeadTasks(limit int, offset int) ([]DeadTask, error) {
+	if err := checkDeadPage(limit, offset); err != nil {
+		return nil, err
+	}
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	var dead []*memoryTask
+	for _, t := range m.dead {
+		dead = append(dead, t)
+	}
+
+	sort.Slice(dead, func(i, j int) bool {
+		if dead[i].lastAttempted.Equal(dead[j].lastAttempted) {
+			return dead[i].seq > dead[j].seq
+		}
+		return dead[i].lastAttempted.After(dead[j].lastAttempted)
+	})
+
+	if offset > len(dead) {
+		offset = len(dead)
+	}
+
+	dead = dead[offset:]
+
+	if limit < len(dead) {
+		dead = dead[:limit]
+	}
+
+	tasks := make([]DeadTask, len(dead))
+	for i, t := range dead {
+		task, err := t.toDeadTask()
+
+		if err != nil {
+			return nil, err
+		}
+
+		tasks[i] = task
+	}
+
+	return tasks, nil
+}
+
+// GetDeadTask Returns the failed task with the given ID
+func (m *MemoryDriver) GetDeadTask(id string) (DeadTask, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	t, ok := m.dead[id]
+
+	if !ok {
+		return DeadTask{}, ErrTaskNotFound
+	}
+
+	return t.toDeadTask()
+}
+
+// RequeueDeadTask Moves a failed task back into the queue
+func (m *MemoryDriver) RequeueDeadTask(id string, doAfter time.Time) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	t, ok := m.dead[id]
+
+	if !ok {
+		return ErrTaskNotFound
+	}
+
+	delete(m.dead, id)
+
+	m.seq++
+	t.seq = m.seq
+	t.state = TaskReady
+	t.lastAttempted = time.Now()
+	t.lastAttemptMessage = "Requeued"
+	t.doAfter = doAfter
+	t.attempts = 0
+	m.tasks[id] = t
+
+	m.hub.publish(t.name)
+
+	return nil
+}
+
+// PurgeDeadTask Deletes a failed task
+func (m *MemoryDriver) PurgeDeadTask(id string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if _, ok := m.dead[id]; !ok {
+		return ErrTaskNotFound
+	}
+
+	delete(m.dead, id)
+
+	return nil
+}
+
+// PurgeDeadTasks Deletes tasks that failed before the given time
+func (m *MemoryDriver) PurgeDeadTasks(failedBefore time.Time) (int64, error) {
+	var count int64
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	for id, t := range m.dead {
+		if t.lastAttempted.Before(failedBefore) {
+			delete(m.dead, id)
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// GetTask Returns the task in the queue with the given ID
+func (m *MemoryDriver) GetTask(id string) (Task, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	t, ok := m.tasks[id]
+
+	if !ok {
+		return Task{}, ErrTaskNotFound
+	}
+
+	return t.toTaskDetail()
+}
+
+// ListTasks Returns the tasks in the queue selected by filter, most recently
+// created first
+func (m *MemoryDriver) ListTasks(filter TaskFilter) ([]Task, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	var selected []*memoryTask
+	for _, t := range m.tasks {
+		if filter.matches(t.id, t.key, t.name, t.state, t.createdBy, t.created, t.doAfter) {
+			selected = append(selected, t)
+		}
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		if selected[i].created.Equal(selected[j].created) {
+			return selected[i].seq > selected[j].seq
+		}
+		return selected[i].created.After(selected[j].created)
+	})
+
+	if filter.Offset > len(selected) {
+		filter.Offset = len(selected)
+	}
+
+	if filter.Offset > 0 {
+		selected = selected[filter.Offset:]
+	}
+
+	if filter.Limit > 0 && filter.Limit < len(selected) {
+		selected = selected[:filter.Limit]
+	}
+
+	tasks := make([]Task, len(selected))
+	for i, t := range selected {
+		task, err := t.toTaskDetail()
+
+		if err != nil {
+			return nil, err
+		}
+
+		tasks[i] = task
+	}
+
+	return tasks, nil
+}
+
+// CountTasks Returns how many of the tasks selected by filter there are for
+// each name and state
+func (m *MemoryDriver) CountTasks(filter TaskFilter) ([]TaskCount, error) {
+	if err := filter.checkUnpaged(); err != nil {
+		return nil, err
+	}
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	counts := make(map[TaskCount]int64)
+	for _, t := range m.tasks {
+		if filter.matches(t.id, t.key, t.name, t.state, t.createdBy, t.created, t.doAfter) {
+			counts[TaskCount{Name: t.name, State: t.state}]++
+		}
+	}
+
+	result := []TaskCount{}
+	for c, n := range counts {
+		c.Count = n
+		result = append(result, c)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name == result[j].Name {
+			return result[i].State < result[j].State
+		}
+		return result[i].Name < result[j].Name
+	})
+
+	return result, nil
+}
+
+// CancelTasks Cancels the pending tasks selected by filter that aren't held
+// by a caller of Pop
+func (m *MemoryDriver) CancelTasks(filter TaskFilter, message string) (int64, error) {
+	return m.editTasks(filter, pendingStates, func(t *memoryTask, now time.Time) {
+		t.state = TaskCancelled
+		t.lastAttempted = now
+		t.lastAttemptMessage = message
+	})
+}
+
+// RescheduleTasks Sets do_after for the pending tasks selected by filter that
+// aren't held by a caller of Pop
+func (m *MemoryDriver) RescheduleTasks(filter TaskFilter, doAfter time.Time) (int64, error) {
+	return m.editTasks(filter, pendingStates, func(t *memoryTask, now time.Time) {
+		t.doAfter = doAfter
+	})
+}
+
+// RequeueTasks Puts the failed and cancelled tasks selected by filter back in
+// the queue
+func (m *MemoryDriver) RequeueTasks(filter TaskFilter, doAfter time.Time) (int64, error) {
+	return m.editTasks(filter, finishedStates, func(t *memoryTask, now time.Time) {
+		m.seq++
+		t.seq = m.seq
+		t.state = TaskReady
+		t.lastAttempted = now
+		t.lastAttemptMessage = "Requeued"
+		t.doAfter = doAfter
+		t.attempts = 0
+	})
+}
+
+// PurgeTasks Deletes the finished tasks selected by filter
+func (m *MemoryDriver) PurgeTasks(filter TaskFilter) (int64, error) {
+	if err := filter.checkUnpaged(); err != nil {
+		return 0, err
+	}
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	var count int64
+	for id, t := range m.tasks {
+		if !t.locked && containsState(purgeableStates, t.state) && filter.matches(t.id, t.key, t.name, t.state, t.createdBy, t.created, t.doAfter) {
+			delete(m.tasks, id)
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// editTasks Applies change to the tasks in one of the given states that are
+// selected by filter and not held, announcing their names
+func (m *MemoryDriver) editTasks(filter TaskFilter, states []TaskState, change func(t *memoryTask, now time.Time)) (int64, error) {
+	if err := filter.checkUnpaged(); err != nil {
+		return 0, err
+	}
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	now := time.Now()
+	names := make(map[string]bool)
+
+	var count int64
+	for _, t := range m.tasks {
+		if t.locked || !containsState(states, t.state) || !filter.matches(t.id, t.key, t.name, t.state, t.createdBy, t.created, t.doAfter) {
+			continue
+		}
+
+		change(t, now)
+		names[t.name] = true
+		count++
+	}
+
+	for name := range names {
+		m.hub.publish(name)
+	}
+
+	return count, nil
+}
+
+func (m *MemoryDriver) setTaskState(task Task, state TaskState, message string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	t, err := m.heldTask(task)
+
+	if err != nil {
+		return err
+	}
+
+	return m.finish(t, state, message)
+}
+
+// finish Records the task's new state and releases it.  Must be called with
+// the mutex held
+func (m *MemoryDriver) finish(t *memoryTask, state TaskState, message string) error {
+	t.state = state
+	t.lastAttempted = time.Now()
+	t.lastAttemptMessage = message
+	t.locked = false
+
+	return nil
+}
+
+// addHistory Records the attempt that has just finished in the task's history
+func (t *memoryTask) addHistory() {
+	t.history = append(t.history, TaskAttempt{
+		Attempt: t.attempts,
+		At:      t.lastAttempted,
+		Message: t.lastAttemptMessage,
+	})
+}
+
+// heldTask Returns the stored task, provided that the given task still holds
+// the lock obtained from Pop().  Must be called with the mutex held
+func (m *MemoryDriver) heldTask(task Task) (*memoryTask, error) {
+	t, ok := m.tasks[task.id]
+
+	if !ok {
+		return nil, fmt.Errorf("task with ID %s not found", task.id)
+	}
+
+	if lockID, ok := task.driverNote.(int64); !ok || !t.locked || t.lockID != lockID {
+		return nil, fmt.Errorf("task with ID %s is not held by this caller", task.id)
+	}
+
+	return t, nil
+}
+
+func (t *memoryTask) toTask() Task {
+	return Task{
+		id:        t.id,
+		Key:       t.key,
+		Name:      t.name,
+		Created:   t.created,
+		CreatedBy: t.createdBy,
+		State:     t.state,
+		Attempts:  t.attempts,
+		RawData:   t.data,
+		Metadata:  copyMetadata(t.metadata),
+	}
+}
+
+// copyMetadata Returns a copy of metadata, or nil if there's none
+func copyMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	c := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		c[k] = v
+	}
+
+	return c
+}
+
+// toTaskDetail Returns the task as seen by TaskReader
+func (t *memoryTask) toTaskDetail() (Task, error) {
+	task := t.toTask()
+	task.DoAfter = t.doAfter
+	task.LastAttempted = t.lastAttempted
+	task.LastAttemptMessage = t.lastAttemptMessage
+
+	err := json.Unmarshal(t.data, &task.Data)
+
+	return task, err
+}
+
+func (t *memoryTask) toDeadTask() (DeadTask, error) {
+	task := DeadTask{
+		ID:        t.id,
+		Key:       t.key,
+		Name:      t.name,
+		Created:   t.created,
+		CreatedBy: t.createdBy,
+		RawData:   t.data,
+		Metadata:  copyMetadata(t.metadata),
+		Attempts:  t.attempts,
+		Error:     t.lastAttemptMessage,
+		FailedAt:  t.lastAttempted,
+		History:   append([]TaskAttempt(nil), t.history...),
+	}
+
+	err := json.Unmarshal(t.data, &task.Data)
+
+	return task, err
+}
@@ -0,0 +1,56 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStaleReclaim(t *testing.T) {
+	// A task popped but never finished is handed out again once stale
+	d := NewMemoryDriver()
+
+	_, err := d.AddTask(TaskInit{
+		Key:       "testStale1",
+		Name:      "testStale",
+		DoAfter:   time.Now(),
+		CreatedBy: "test_runner",
+		Data:      map[string]interface{}{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := d.Pop(PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Release without marking complete, as happens if a process dies:
+	d.Cleanup(task)
+
+	if _, err = d.Pop(PopOptions{}); err != ErrNoTasks {
+		t.Fatalf("expected ErrNoTasks for a recently attempted task, but had %v", err)
+	}
+
+	d.mx.Lock()
+	d.tasks[task.id].doAfter = time.Now().Add(-time.Second)
+	d.mx.Unlock()
+
+	reclaimed, err := d.Pop(PopOptions{})
+	if err != nil {
+		t.Fatalf("expected stale task to be reclaimed: %s", err)
+	}
+
+	if reclaimed.id != task.id {
+		t.Errorf("expected task %s, but had %s", task.id, reclaimed.id)
+	}
+
+	// The original holder can no longer change the task's state:
+	if err = d.Complete(task, "Done"); err == nil {
+		t.Error("expected error completing a task that has been reclaimed")
+	}
+
+	if err = d.Complete(reclaimed, "Done"); err != nil {
+		t.Error(err)
+	}
+}
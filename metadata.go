@@ -0,0 +1,44 @@
+package queue
+
+import "encoding/json"
+
+// WithMetadata Stores the values alongside the task's data, for use by the
+// queue rather than the task's action, such as the trace the task was added
+// in.  Can be given more than once
+func WithMetadata(metadata map[string]string) AddTaskOption {
+	return func(t *TaskInit) {
+		if t.Metadata == nil {
+			t.Metadata = make(map[string]string, len(metadata))
+		}
+
+		for k, v := range metadata {
+			t.Metadata[k] = v
+		}
+	}
+}
+
+// marshalMetadata Returns metadata as stored in the metadata column
+func marshalMetadata(metadata map[string]string) (string, error) {
+	if len(metadata) == 0 {
+		return "{}", nil
+	}
+
+	b, err := json.Marshal(metadata)
+
+	return string(b), err
+}
+
+// unmarshalMetadata Reads the metadata column.  Returns nil if there's none
+func unmarshalMetadata(raw []byte) (map[string]string, error) {
+	var metadata map[string]string
+
+	if err := json.Unmarshal(raw, &metadata); err != nil {
+		return nil, err
+	}
+
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+
+	return metadata, nil
+}
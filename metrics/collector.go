@@ -0,0 +1,231 @@
+// Package metrics records what a SyncManager does as Prometheus metrics.  A
+// Collector is both the SyncManager's observer and a prometheus.Collector:
+//
+//	c := metrics.NewCollector(driver)
+//	prometheus.MustRegister(c)
+//	sm.SetObserver(c)
+//
+// It lives in a module of its own, so that the queue itself doesn't depend on
+// the Prometheus client.
+package metrics
+
+import (
+	"time"
+
+	"github.com/episub/queue"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector Counts tasks and scheduled actions as SyncManager runs them, and
+// reports the depth of the queue when scraped
+type Collector struct {
+	reader      queue.TaskReader // Nil if the driver can't count tasks
+	depthStates []queue.TaskState
+
+	popped    *prometheus.CounterVec
+	completed *prometheus.CounterVec
+	failed    *prometheus.CounterVec
+	retried   *prometheus.CounterVec
+	cancelled *prometheus.CounterVec
+	handler   *prometheus.HistogramVec
+	age       *prometheus.HistogramVec
+	depth     *prometheus.Desc
+
+	scheduledRuns     *prometheus.CounterVec
+	scheduledErrors   *prometheus.CounterVec
+	scheduledPanics   *prometheus.CounterVec
+	scheduledDuration *prometheus.HistogramVec
+}
+
+// config Settings for a new Collector
+type config struct {
+	namespace       string
+	durationBuckets []float64
+	ageBuckets      []float64
+	depthStates     []queue.TaskState
+}
+
+// Option Configures a Collector
+type Option func(*config)
+
+// WithNamespace Sets the prefix of the metric names.  Defaults to "queue"
+func WithNamespace(namespace string) Option {
+	return func(c *config) {
+		c.namespace = namespace
+	}
+}
+
+// WithDurationBuckets Sets the histogram buckets, in seconds, for how long
+// task actions and scheduled actions take
+func WithDurationBuckets(buckets []float64) Option {
+	return func(c *config) {
+		c.durationBuckets = buckets
+	}
+}
+
+// WithAgeBuckets Sets the histogram buckets, in seconds, for how old tasks
+// are when they're popped
+func WithAgeBuckets(buckets []float64) Option {
+	return func(c *config) {
+		c.ageBuckets = buckets
+	}
+}
+
+// WithDepthStates Sets which states the queue depth is reported for.
+// Defaults to READY and RETRY.  Tasks are counted on every scrape, so adding
+// DONE may be slow on a queue that isn't purged
+func WithDepthStates(states ...queue.TaskState) Option {
+	return func(c *config) {
+		c.depthStates = states
+	}
+}
+
+// NewCollector Returns a collector for a SyncManager running tasks from
+// driver.  Queue depth is only reported if the driver implements
+// queue.TaskReader
+func NewCollector(driver queue.Driver, opts ...Option) *Collector {
+	cfg := config{
+		namespace:       "queue",
+		durationBuckets: prometheus.ExponentialBuckets(0.01, 4, 10), // 10ms to about 45 minutes
+		ageBuckets:      prometheus.ExponentialBuckets(0.1, 4, 10),  // 100ms to about 7 hours
+		depthStates:     []queue.TaskState{queue.TaskReady, queue.TaskRetry},
+	}
+
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	counter := func(name string, help string, label string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: cfg.namespace, Name: name, Help: help}, []string{label})
+	}
+
+	c := &Collector{
+		depthStates: cfg.depthStates,
+
+		popped:    counter("tasks_popped_total", "Tasks taken from the queue to be run.", "task_name"),
+		completed: counter("tasks_completed_total", "Tasks whose action succeeded.", "task_name"),
+		failed:    counter("tasks_failed_total", "Tasks failed permanently.", "task_name"),
+		retried:   counter("tasks_retried_total", "Tasks marked to be retried later.", "task_name"),
+		cancelled: counter("tasks_cancelled_total", "Tasks cancelled because no action was registered for them.", "task_name"),
+		handler: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: cfg.namespace,
+			Name:      "task_handler_duration_seconds",
+			Help:      "How long task actions took, by the result they returned.",
+			Buckets:   cfg.durationBuckets,
+		}, []string{"task_name", "result"}),
+		age: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: cfg.namespace,
+			Name:      "task_age_seconds",
+			Help:      "How long since tasks were created when they were taken from the queue.",
+			Buckets:   cfg.ageBuckets,
+		}, []string{"task_name"}),
+		depth: prometheus.NewDesc(
+			prometheus.BuildFQName(cfg.namespace, "", "tasks"),
+			"Tasks in the queue, by name and state.",
+			[]string{"task_name", "state"}, nil,
+		),
+
+		scheduledRuns:   counter("scheduled_action_runs_total", "Scheduled actions run.", "stream"),
+		scheduledErrors: counter("scheduled_action_errors_total", "Scheduled actions that returned an error.", "stream"),
+		scheduledPanics: counter("scheduled_action_panics_total", "Scheduled actions that panicked.", "stream"),
+		scheduledDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: cfg.namespace,
+			Name:      "scheduled_action_duration_seconds",
+			Help:      "How long scheduled actions took.",
+			Buckets:   cfg.durationBuckets,
+		}, []string{"stream"}),
+	}
+
+	if reader, ok := driver.(queue.TaskReader); ok && len(cfg.depthStates) > 0 {
+		c.reader = reader
+	}
+
+	return c
+}
+
+// collectors Returns the metrics kept by the collector, as opposed to those
+// read from the queue
+func (c *Collector) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		c.popped, c.completed, c.failed, c.retried, c.cancelled, c.handler, c.age,
+		c.scheduledRuns, c.scheduledErrors, c.scheduledPanics, c.scheduledDuration,
+	}
+}
+
+// Describe Implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range c.collectors() {
+		m.Describe(ch)
+	}
+
+	ch <- c.depth
+}
+
+// Collect Implements prometheus.Collector.  Counts the tasks in the queue as
+// it goes
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c.collectors() {
+		m.Collect(ch)
+	}
+
+	if c.reader == nil {
+		return
+	}
+
+	counts, err := c.reader.CountTasks(queue.TaskFilter{States: c.depthStates})
+
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.depth, err)
+		return
+	}
+
+	for _, count := range counts {
+		ch <- prometheus.MustNewConstMetric(c.depth, prometheus.GaugeValue, float64(count.Count), count.Name, string(count.State))
+	}
+}
+
+// TaskPopped Implements queue.Observer
+func (c *Collector) TaskPopped(task queue.Task) {
+	c.popped.WithLabelValues(task.Name).Inc()
+
+	if !task.Created.IsZero() {
+		c.age.WithLabelValues(task.Name).Observe(time.Since(task.Created).Seconds())
+	}
+}
+
+// TaskHandled Implements queue.Observer
+func (c *Collector) TaskHandled(task queue.Task, result queue.TaskResult, duration time.Duration) {
+	c.handler.WithLabelValues(task.Name, string(result)).Observe(duration.Seconds())
+}
+
+// TaskFinished Implements queue.Observer.  Outcomes the driver couldn't
+// record aren't counted, since the task will be run again
+func (c *Collector) TaskFinished(task queue.Task, outcome queue.TaskOutcome, err error) {
+	if err != nil {
+		return
+	}
+
+	switch outcome {
+	case queue.TaskOutcomeCompleted:
+		c.completed.WithLabelValues(task.Name).Inc()
+	case queue.TaskOutcomeFailed:
+		c.failed.WithLabelValues(task.Name).Inc()
+	case queue.TaskOutcomeRetried:
+		c.retried.WithLabelValues(task.Name).Inc()
+	case queue.TaskOutcomeCancelled:
+		c.cancelled.WithLabelValues(task.Name).Inc()
+	}
+}
+
+// ScheduledActionRun Implements queue.Observer
+func (c *Collector) ScheduledActionRun(stream string, action queue.ContextScheduledAction, duration time.Duration, err error, panicked bool) {
+	c.scheduledRuns.WithLabelValues(stream).Inc()
+	c.scheduledDuration.WithLabelValues(stream).Observe(duration.Seconds())
+
+	switch {
+	case panicked:
+		c.scheduledPanics.WithLabelValues(stream).Inc()
+	case err != nil:
+		c.scheduledErrors.WithLabelValues(stream).Inc()
+	}
+}
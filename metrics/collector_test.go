@@ -0,0 +1,137 @@
+package metrics
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/episub/queue"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// resultAction Returns the same result for every task, and reports each task
+type resultAction struct {
+	result queue.TaskResult
+	done   chan string
+}
+
+func (a resultAction) Do(task queue.Task) (queue.TaskResult, string) {
+	defer func() { a.done <- task.Key }()
+	return a.result, "Message"
+}
+
+func TestCollectorRegisters(t *testing.T) {
+	c := NewCollector(queue.NewMemoryDriver())
+
+	if err := prometheus.NewPedanticRegistry().Register(c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTaskMetrics(t *testing.T) {
+	driver := queue.NewMemoryDriver()
+	c := NewCollector(driver)
+
+	sm := queue.NewSyncManager(driver)
+	sm.SetErrorHandler(func(error) {})
+	sm.SetPollInterval(10 * time.Millisecond)
+	sm.SetObserver(c)
+
+	done := make(chan string, 10)
+	if err := sm.RegisterTaskHandler(resultAction{result: queue.TaskResultSuccess, done: done}, "sendEmail"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sm.RegisterTaskHandler(resultAction{result: queue.TaskResultPermanentFailure, done: done}, "syncInvoice"); err != nil {
+		t.Fatal(err)
+	}
+
+	tm := queue.NewTaskManager(driver)
+
+	for _, task := range []struct{ name, key string }{{"sendEmail", "a"}, {"sendEmail", "b"}, {"syncInvoice", "c"}} {
+		if _, err := tm.AddTask(task.name, task.key, time.Now(), "test", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Not due yet, so counted in the queue's depth:
+	if _, err := tm.AddTask("sendEmail", "later", time.Now().Add(time.Hour), "test", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	go sm.Run()
+	defer sm.Stop()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timeout waiting for task %d", i+1)
+		}
+	}
+
+	// The outcome is recorded just after the action returns:
+	deadline := time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(c.failed.WithLabelValues("syncInvoice")) < 1 || testutil.ToFloat64(c.completed.WithLabelValues("sendEmail")) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for outcomes to be recorded")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	expected := `
+		# HELP queue_tasks_popped_total Tasks taken from the queue to be run.
+		# TYPE queue_tasks_popped_total counter
+		queue_tasks_popped_total{task_name="sendEmail"} 2
+		queue_tasks_popped_total{task_name="syncInvoice"} 1
+		# HELP queue_tasks_completed_total Tasks whose action succeeded.
+		# TYPE queue_tasks_completed_total counter
+		queue_tasks_completed_total{task_name="sendEmail"} 2
+		# HELP queue_tasks_failed_total Tasks failed permanently.
+		# TYPE queue_tasks_failed_total counter
+		queue_tasks_failed_total{task_name="syncInvoice"} 1
+		# HELP queue_tasks Tasks in the queue, by name and state.
+		# TYPE queue_tasks gauge
+		queue_tasks{state="READY",task_name="sendEmail"} 1
+	`
+
+	names := []string{"queue_tasks_popped_total", "queue_tasks_completed_total", "queue_tasks_failed_total", "queue_tasks"}
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), names...); err != nil {
+		t.Error(err)
+	}
+
+	if n := testutil.CollectAndCount(c, "queue_task_handler_duration_seconds"); n != 2 {
+		t.Errorf("Expected handler durations for 2 names and results, but had %d", n)
+	}
+
+	if n := testutil.CollectAndCount(c, "queue_task_age_seconds"); n != 2 {
+		t.Errorf("Expected task ages for 2 names, but had %d", n)
+	}
+}
+
+func TestScheduledActionMetrics(t *testing.T) {
+	c := NewCollector(queue.NewMemoryDriver())
+
+	c.ScheduledActionRun("netsuite", nil, time.Second, nil, false)
+	c.ScheduledActionRun("netsuite", nil, time.Second, errors.New("timed out"), false)
+	c.ScheduledActionRun("netsuite", nil, time.Second, errors.New("panic"), true)
+
+	expected := map[*prometheus.CounterVec]float64{
+		c.scheduledRuns:   3,
+		c.scheduledErrors: 1,
+		c.scheduledPanics: 1,
+	}
+
+	for counter, n := range expected {
+		if v := testutil.ToFloat64(counter.WithLabelValues("netsuite")); v != n {
+			t.Errorf("Expected %v, but had %v", n, v)
+		}
+	}
+
+	if n := testutil.CollectAndCount(c, "queue_scheduled_action_duration_seconds"); n != 1 {
+		t.Errorf("Expected durations for 1 stream, but had %d", n)
+	}
+}
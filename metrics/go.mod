@@ -0,0 +1,10 @@
+module github.com/episub/queue/metrics
+
+go 1.16
+
+require (
+	github.com/episub/queue v0.0.0
+	github.com/prometheus/client_golang v1.12.2
+)
+
+replace github.com/episub/queue => ../
@@ -0,0 +1,54 @@
+package queue
+
+import "sync"
+
+// notifyHub Fans out the names of newly added tasks to each subscriber.
+// Sends never block: if a subscriber is behind then it will find the task on
+// its next pop anyway
+type notifyHub struct {
+	mx   *sync.Mutex
+	subs map[chan string]struct{}
+}
+
+func newNotifyHub() *notifyHub {
+	return &notifyHub{
+		mx:   &sync.Mutex{},
+		subs: make(map[chan string]struct{}),
+	}
+}
+
+// subscribe Returns a channel receiving task names, and a function to stop
+// receiving
+func (h *notifyHub) subscribe() (<-chan string, func()) {
+	ch := make(chan string, 16)
+
+	h.mx.Lock()
+	h.subs[ch] = struct{}{}
+	h.mx.Unlock()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			h.mx.Lock()
+			delete(h.subs, ch)
+			h.mx.Unlock()
+		})
+	}
+
+	return ch, stop
+}
+
+// publish Lets each subscriber know a task with the given name was added.  An
+// empty name means that tasks may have been missed, and subscribers should
+// check the queue
+func (h *notifyHub) publish(taskName string) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	for ch := range h.subs {
+		select {
+		case ch <- taskName:
+		default:
+		}
+	}
+}
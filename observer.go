@@ -0,0 +1,44 @@
+package queue
+
+import "time"
+
+// TaskOutcome What became of a task that SyncManager took from the queue
+type TaskOutcome string
+
+var (
+	// TaskOutcomeCompleted The task's action succeeded, and it was marked as done
+	TaskOutcomeCompleted TaskOutcome = "completed"
+	// TaskOutcomeFailed The task was failed permanently
+	TaskOutcomeFailed TaskOutcome = "failed"
+	// TaskOutcomeRetried The task was marked to be retried later
+	TaskOutcomeRetried TaskOutcome = "retried"
+	// TaskOutcomeCancelled The task was cancelled, because there was no
+	// action registered to handle it
+	TaskOutcomeCancelled TaskOutcome = "cancelled"
+)
+
+// Observer Is told what SyncManager does with tasks and scheduled actions, so
+// that it can be measured.  Methods are called by the worker doing the work,
+// so must be quick, and safe to call from several workers at once
+type Observer interface {
+	// TaskPopped Called when a task is taken from the queue, before its
+	// action is run
+	TaskPopped(task Task)
+	// TaskHandled Called once the task's action has returned, with how long
+	// it took.  Not called if the action wasn't run
+	TaskHandled(task Task, result TaskResult, duration time.Duration)
+	// TaskFinished Called once the outcome has been recorded with the
+	// driver.  err is the driver's error, if it couldn't record the outcome
+	TaskFinished(task Task, outcome TaskOutcome, err error)
+	// ScheduledActionRun Called when a scheduled action has been run on its
+	// stream.  err is the action's error, or the panic it raised if panicked
+	ScheduledActionRun(stream string, action ContextScheduledAction, duration time.Duration, err error, panicked bool)
+}
+
+// noopObserver The observer used until one is set
+type noopObserver struct{}
+
+func (noopObserver) TaskPopped(Task)                                                               {}
+func (noopObserver) TaskHandled(Task, TaskResult, time.Duration)                                   {}
+func (noopObserver) TaskFinished(Task, TaskOutcome, error)                                         {}
+func (noopObserver) ScheduledActionRun(string, ContextScheduledAction, time.Duration, error, bool) {}
@@ -0,0 +1,653 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// PgxDriver PostgreSQL Driver built on a pgx connection pool.  Uses the same
+// table and queries as PostgresDriver, so the two may be used side by side.
+// Lets one pool be shared between the queue and, e.g., CDCRunnerAction
+type PgxDriver struct {
+	postgresTable
+	pool      *pgxpool.Pool
+	hub       *notifyHub
+	listenMX  *sync.Mutex
+	listening bool
+}
+
+// NewPgxDriver Returns a new pgx driver using the given pool
+func NewPgxDriver(pool *pgxpool.Pool, dbSchema string, dbTable string, uuidGenSchema string) (*PgxDriver, error) {
+	if pool == nil {
+		return nil, fmt.Errorf("pool cannot be nil")
+	}
+
+	p := &PgxDriver{
+		postgresTable: postgresTable{
+			tableName:     dbTable,
+			schemaName:    dbSchema,
+			uuidGenSchema: uuidGenSchema,
+		},
+		pool:     pool,
+		hub:      newNotifyHub(),
+		listenMX: &sync.Mutex{},
+	}
+
+	return p, nil
+}
+
+// SetDeadLetterTable Sets the table, in the same schema as the queue, that
+// failed tasks are moved to.  Until set, failed tasks are left in the queue
+// marked as failed, and the dead-letter methods return ErrNotSupported
+func (p *PgxDriver) SetDeadLetterTable(dbTable string) {
+	p.deadTableName = dbTable
+}
+
+// Clear Removes all entries from the queue, and the dead-letter table if set.  Be careful.  Generally you should cancel entries rather than delete.
+func (p *PgxDriver) Clear() error {
+	_, err := p.pool.Exec(context.Background(), p.clearQuery())
+
+	return err
+}
+
+// Name Returns the name of the driver
+func (p *PgxDriver) Name() string {
+	return "PgxDriver"
+}
+
+// AddTask Adds a task to the queue, returning its ID.  If the task matches
+// one already there as per taskData.Unique, the ID of the match is returned.
+// Data is sent to the jsonb column by pgx directly
+func (p *PgxDriver) AddTask(taskData TaskInit) (string, error) {
+	ctx := context.Background()
+
+	tx, err := p.pool.Begin(ctx)
+
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	id, err := p.addTask(ctx, tx, taskData)
+
+	if err != nil {
+		return "", err
+	}
+
+	return id, tx.Commit(ctx)
+}
+
+// AddTaskTx Adds a task as part of the caller's transaction, so that it is
+// only added, and listeners only notified, if the transaction is committed
+func (p *PgxDriver) AddTaskTx(tx pgx.Tx, taskData TaskInit) (string, error) {
+	if tx == nil {
+		return "", fmt.Errorf("cannot have nil transaction")
+	}
+
+	return p.addTask(context.Background(), tx, taskData)
+}
+
+func (p *PgxDriver) addTask(ctx context.Context, tx pgx.Tx, taskData TaskInit) (string, error) {
+	var id string
+
+	if err := checkUnique(taskData); err != nil {
+		return id, err
+	}
+
+	data := taskData.Data
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+
+	metadata, err := marshalMetadata(taskData.Metadata)
+
+	if err != nil {
+		return id, err
+	}
+
+	if taskData.Unique != UniqueNone {
+		id, err := p.resolveConflict(ctx, tx, taskData, data)
+
+		if err != nil || len(id) > 0 {
+			return id, err
+		}
+	}
+
+	created := time.Now()
+	err = tx.QueryRow(ctx, p.addTaskQuery(),
+		data,
+		string(TaskReady),
+		taskData.Key,
+		taskData.Name,
+		created,
+		created,
+		taskData.DoAfter,
+		taskData.CreatedBy,
+		p.notifyChannel(),
+		sql.NullString{String: taskData.IdempotencyKey, Valid: len(taskData.IdempotencyKey) > 0},
+		metadata,
+	).Scan(&id)
+
+	return id, err
+}
+
+// resolveConflict Applies the conflict policy to tasks that taskData would
+// duplicate, returning the ID of the most recently created.  Returns an empty
+// ID if there are none, so the task is to be added
+func (p *PgxDriver) resolveConflict(ctx context.Context, tx pgx.Tx, taskData TaskInit, data map[string]interface{}) (string, error) {
+	var id string
+
+	if _, err := tx.Exec(ctx, p.uniqueLockQuery(), p.uniqueLockValue(taskData)); err != nil {
+		return id, err
+	}
+
+	cutoff := time.Now().Add(-taskData.UniqueWithin)
+
+	if set, value := conflictUpdate(taskData, data, taskData.DoAfter); len(set) > 0 {
+		condition, args := uniqueCondition(taskData, 2, cutoff)
+
+		if _, err := tx.Exec(ctx, p.conflictUpdateQuery(set, condition), append([]interface{}{value}, args...)...); err != nil {
+			return id, err
+		}
+	}
+
+	condition, args := uniqueCondition(taskData, 1, cutoff)
+	err := tx.QueryRow(ctx, p.duplicateQuery(condition), args...).Scan(&id)
+
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+
+	return id, err
+}
+
+// Subscribe Returns a channel receiving the names of tasks as they're added,
+// by any process.  The first call takes a connection from the pool to listen
+// on, which is held for the life of the driver
+func (p *PgxDriver) Subscribe() (<-chan string, func(), error) {
+	p.listenMX.Lock()
+	defer p.listenMX.Unlock()
+
+	if !p.listening {
+		conn, err := p.listen()
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		p.listening = true
+		go p.forwardNotifications(conn)
+	}
+
+	ch, stop := p.hub.subscribe()
+
+	return ch, stop, nil
+}
+
+func (p *PgxDriver) listen() (*pgxpool.Conn, error) {
+	ctx := context.Background()
+
+	conn, err := p.pool.Acquire(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{p.notifyChannel()}.Sanitize())
+
+	if err != nil {
+		conn.Release()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// forwardNotifications Passes notifications on to subscribers, reconnecting
+// if the connection is lost
+func (p *PgxDriver) forwardNotifications(conn *pgxpool.Conn) {
+	ctx := context.Background()
+
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+
+		if err == nil {
+			p.hub.publish(n.Payload)
+			continue
+		}
+
+		conn.Release()
+
+		for {
+			time.Sleep(time.Second)
+
+			if conn, err = p.listen(); err == nil {
+				break
+			}
+		}
+
+		// We may have missed some while reconnecting:
+		p.hub.publish("")
+	}
+}
+
+// Cleanup Closes off the transaction opened by Pop
+func (p *PgxDriver) Cleanup(task Task) {
+	if tx, ok := task.driverNote.(pgx.Tx); ok {
+		// Possibly already committed/rolled back by this stage
+		tx.Commit(context.Background())
+	}
+}
+
+// Pop Returns the oldest task that is ready, holding a lock on it until the
+// task is completed or cleaned up.  The claim on the task, including the
+// attempt, is committed before the task is locked, as for PostgresDriver
+func (p *PgxDriver) Pop(opts PopOptions) (Task, error) {
+	var task Task
+	var data, metadata []byte
+	var state string
+	var previousDoAfter, previousAttempted *time.Time
+	var previousState, previousMessage *string
+
+	ctx := context.Background()
+
+	err := p.pool.QueryRow(ctx, p.popQuery(), opts.ExcludeNames, opts.Names, opts.lease().Seconds()).Scan(&task.id, &task.Key, &task.Name, &task.Created, &task.CreatedBy, &data, &state, &task.Attempts, &metadata, &task.DoAfter, &previousDoAfter, &previousState, &previousAttempted, &previousMessage)
+	task.State = TaskState(state)
+
+	if err == pgx.ErrNoRows {
+		return task, ErrNoTasks
+	}
+
+	if err != nil {
+		return task, err
+	}
+
+	unclaim := func() {
+		p.pool.Exec(ctx, p.unclaimTaskQuery(), task.id, task.Attempts, previousDoAfter, previousState, previousAttempted, previousMessage)
+	}
+
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		unclaim()
+		return task, err
+	}
+
+	// The claim keeps others from popping the task in the meantime, but it
+	// may have been edited, e.g., cancelled:
+	err = tx.QueryRow(ctx, p.lockTaskQuery(), task.id, task.Attempts).Scan(&data, &metadata)
+
+	if err == pgx.ErrNoRows {
+		tx.Rollback(ctx)
+		return task, ErrNoTasks
+	}
+
+	if err != nil {
+		tx.Rollback(ctx)
+		unclaim()
+		return task, err
+	}
+
+	task.driverNote = tx
+
+	task.Metadata, err = unmarshalMetadata(metadata)
+
+	if err == nil {
+		err = json.Unmarshal(data, &task.Data)
+	}
+
+	if err != nil {
+		// Defaults to retry, as per query above:
+		tx.Commit(ctx)
+	}
+
+	task.RawData = data
+
+	return task, err
+}
+
+// ExtendLease Extends the lease on a task that is still held, as per
+// PostgresDriver
+func (p *PgxDriver) ExtendLease(task Task, lease time.Duration) (time.Time, error) {
+	var until time.Time
+
+	err := p.pool.QueryRow(context.Background(), p.extendLeaseQuery(), task.id, task.Attempts, lease.Seconds()).Scan(&until)
+
+	if err == pgx.ErrNoRows {
+		return until, fmt.Errorf("task with ID %s is no longer held by this caller", task.id)
+	}
+
+	return until, err
+}
+
+// GetQueueLength Returns the number of tasks in the queue, in any state
+func (p *PgxDriver) GetQueueLength() (int64, error) {
+	var length int64
+
+	err := p.pool.QueryRow(context.Background(), p.queueLengthQuery()).Scan(&length)
+
+	return length, err
+}
+
+// GetTaskCount Returns the number of active tasks with the given name
+func (p *PgxDriver) GetTaskCount(taskName string) (int64, error) {
+	var length int64
+
+	err := p.pool.QueryRow(context.Background(), p.taskCountQuery(), taskName).Scan(&length)
+
+	return length, err
+}
+
+// Complete Marks a task as complete
+func (p *PgxDriver) Complete(task Task, message string) error {
+	return p.setTaskState(task, TaskDone, message)
+}
+
+// Cancel Marks a task as cancelled
+func (p *PgxDriver) Cancel(task Task, message string) error {
+	return p.setTaskState(task, TaskCancelled, message)
+}
+
+// Fail Marks a task as permanently failed, moving it to the dead-letter table
+// if one has been set
+func (p *PgxDriver) Fail(task Task, message string) error {
+	if p.hasDeadLetter() {
+		return p.finishTask(task, p.failQuery(), message, time.Now(), task.id)
+	}
+
+	return p.setTaskState(task, TaskFailed, message)
+}
+
+// Retry Marks a task as in need of a retry once doAfter has passed
+func (p *PgxDriver) Retry(task Task, message string, doAfter time.Time) error {
+	return p.finishTask(task, p.retryQuery(), string(TaskRetry), time.Now(), message, task.id, doAfter)
+}
+
+func (p *PgxDriver) setTaskState(task Task, state TaskState, message string) error {
+	return p.finishTask(task, p.setTaskStateQuery(), string(state), time.Now(), message, task.id)
+}
+
+// finishTask Runs the query on the task's transaction, and commits
+func (p *PgxDriver) finishTask(task Task, query string, args ...interface{}) error {
+	ctx := context.Background()
+
+	tx, ok := task.driverNote.(pgx.Tx)
+
+	if !ok {
+		return fmt.Errorf("cannot have nil transaction for task")
+	}
+
+	_, err := tx.Exec(ctx, query, args...)
+
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// GetTask Returns the task in the queue with the given ID
+func (p *PgxDriver) GetTask(id string) (Task, error) {
+	task, err := p.scanTask(p.pool.QueryRow(context.Background(), p.getTaskQuery(), id))
+
+	if err == pgx.ErrNoRows {
+		return task, ErrTaskNotFound
+	}
+
+	return task, err
+}
+
+// ListTasks Returns the tasks in the queue selected by filter, most recently
+// created first
+func (p *PgxDriver) ListTasks(filter TaskFilter) ([]Task, error) {
+	query, args := p.listTasksQuery(filter)
+	rows, err := p.pool.Query(context.Background(), query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []Task
+	for rows.Next() {
+		task, err := p.scanTask(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tasks = append(tasks, task)
+	}
+
+	return tasks, rows.Err()
+}
+
+// scanTask Scans a row of taskDetailColumns
+func (p *PgxDriver) scanTask(row pgx.Row) (Task, error) {
+	var task Task
+	var data, metadata []byte
+	var state string
+
+	err := row.Scan(&task.id, &task.Key, &task.Name, &task.Created, &task.CreatedBy, &data, &state, &task.Attempts, &task.DoAfter, &task.LastAttempted, &task.LastAttemptMessage, &metadata)
+
+	if err != nil {
+		return task, err
+	}
+
+	if task.Metadata, err = unmarshalMetadata(metadata); err != nil {
+		return task, err
+	}
+
+	task.State = TaskState(state)
+	task.RawData = data
+	err = json.Unmarshal(data, &task.Data)
+
+	return task, err
+}
+
+// CountTasks Returns how many of the tasks selected by filter there are for
+// each name and state
+func (p *PgxDriver) CountTasks(filter TaskFilter) ([]TaskCount, error) {
+	if err := filter.checkUnpaged(); err != nil {
+		return nil, err
+	}
+
+	query, args := p.countTasksQuery(filter)
+	rows, err := p.pool.Query(context.Background(), query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []TaskCount{}
+	for rows.Next() {
+		var c TaskCount
+		var state string
+
+		if err = rows.Scan(&c.Name, &state, &c.Count); err != nil {
+			return nil, err
+		}
+
+		c.State = TaskState(state)
+		counts = append(counts, c)
+	}
+
+	return counts, rows.Err()
+}
+
+// CancelTasks Cancels the pending tasks selected by filter, skipping those
+// locked by Pop
+func (p *PgxDriver) CancelTasks(filter TaskFilter, message string) (int64, error) {
+	query, args := p.cancelTasksQuery(filter)
+
+	return p.editTasks(filter, query, append([]interface{}{string(TaskCancelled), time.Now(), message}, args...))
+}
+
+// RescheduleTasks Sets do_after for the pending tasks selected by filter,
+// skipping those locked by Pop
+func (p *PgxDriver) RescheduleTasks(filter TaskFilter, doAfter time.Time) (int64, error) {
+	query, args := p.rescheduleTasksQuery(filter)
+
+	return p.editTasks(filter, query, append([]interface{}{doAfter}, args...))
+}
+
+// RequeueTasks Puts the failed and cancelled tasks selected by filter back in
+// the queue
+func (p *PgxDriver) RequeueTasks(filter TaskFilter, doAfter time.Time) (int64, error) {
+	query, args := p.requeueTasksQuery(filter)
+
+	return p.editTasks(filter, query, append([]interface{}{string(TaskReady), time.Now(), doAfter}, args...))
+}
+
+// PurgeTasks Deletes the finished tasks selected by filter
+func (p *PgxDriver) PurgeTasks(filter TaskFilter) (int64, error) {
+	if err := filter.checkUnpaged(); err != nil {
+		return 0, err
+	}
+
+	query, args := p.purgeTasksQuery(filter)
+	tag, err := p.pool.Exec(context.Background(), query, args...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// editTasks Runs a query from editTasksQuery, returning how many tasks changed
+func (p *PgxDriver) editTasks(filter TaskFilter, query string, args []interface{}) (int64, error) {
+	var count, notified int64
+
+	if err := filter.checkUnpaged(); err != nil {
+		return 0, err
+	}
+
+	err := p.pool.QueryRow(context.Background(), query, args...).Scan(&count, &notified)
+
+	return count, err
+}
+
+// ListDeadTasks Returns failed tasks, most recently failed first
+func (p *PgxDriver) ListDeadTasks(limit int, offset int) ([]DeadTask, error) {
+	if !p.hasDeadLetter() {
+		return nil, ErrNotSupported
+	}
+
+	if err := checkDeadPage(limit, offset); err != nil {
+		return nil, err
+	}
+
+	rows, err := p.pool.Query(context.Background(), p.listDeadQuery(), limit, offset)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []DeadTask
+	for rows.Next() {
+		task, err := p.scanDeadTask(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tasks = append(tasks, task)
+	}
+
+	return tasks, rows.Err()
+}
+
+// GetDeadTask Returns the failed task with the given ID
+func (p *PgxDriver) GetDeadTask(id string) (DeadTask, error) {
+	if !p.hasDeadLetter() {
+		return DeadTask{}, ErrNotSupported
+	}
+
+	task, err := p.scanDeadTask(p.pool.QueryRow(context.Background(), p.getDeadQuery(), id))
+
+	if err == pgx.ErrNoRows {
+		return task, ErrTaskNotFound
+	}
+
+	return task, err
+}
+
+// RequeueDeadTask Moves a failed task back into the queue
+func (p *PgxDriver) RequeueDeadTask(id string, doAfter time.Time) error {
+	if !p.hasDeadLetter() {
+		return ErrNotSupported
+	}
+
+	tag, err := p.pool.Exec(context.Background(), p.requeueDeadQuery(), string(TaskReady), time.Now(), doAfter, id, p.notifyChannel())
+
+	if err == nil && tag.RowsAffected() == 0 {
+		err = ErrTaskNotFound
+	}
+
+	return err
+}
+
+// PurgeDeadTask Deletes a failed task
+func (p *PgxDriver) PurgeDeadTask(id string) error {
+	if !p.hasDeadLetter() {
+		return ErrNotSupported
+	}
+
+	tag, err := p.pool.Exec(context.Background(), p.purgeDeadQuery(), id)
+
+	if err == nil && tag.RowsAffected() == 0 {
+		err = ErrTaskNotFound
+	}
+
+	return err
+}
+
+// PurgeDeadTasks Deletes tasks that failed before the given time
+func (p *PgxDriver) PurgeDeadTasks(failedBefore time.Time) (int64, error) {
+	if !p.hasDeadLetter() {
+		return 0, ErrNotSupported
+	}
+
+	tag, err := p.pool.Exec(context.Background(), p.purgeDeadBeforeQuery(), failedBefore)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+func (p *PgxDriver) scanDeadTask(row pgx.Row) (DeadTask, error) {
+	var task DeadTask
+	var data, metadata, history []byte
+
+	err := row.Scan(&task.ID, &task.Key, &task.Name, &task.Created, &task.CreatedBy, &data, &task.Attempts, &task.Error, &task.FailedAt, &metadata, &history)
+
+	if err != nil {
+		return task, err
+	}
+
+	task.RawData = data
+
+	if task.Metadata, err = unmarshalMetadata(metadata); err != nil {
+		return task, err
+	}
+
+	if task.History, err = unmarshalHistory(history); err != nil {
+		return task, err
+	}
+
+	err = json.Unmarshal(data, &task.Data)
+
+	return task, err
+}
@@ -4,26 +4,20 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // PostgresDriver PostgreSQL Driver
 type PostgresDriver struct {
-	tableName     string
-	schemaName    string
-	uuidGenSchema string
-	db            *sql.DB
-}
-
-// schemaTable returns appropriate table+schema name
-func (p PostgresDriver) schemaTable() string {
-	if len(p.schemaName) > 0 {
-		return p.schemaName + "." + p.tableName
-	}
-
-	return p.tableName
+	postgresTable
+	connString string
+	db         *sql.DB
+	hub        *notifyHub
+	listenMX   *sync.Mutex
+	listener   *pq.Listener
 }
 
 // NewPostgresDriver Returns a new postgres driver, initialised.  readTimeout is in seconds
@@ -31,9 +25,14 @@ func NewPostgresDriver(connString string, dbSchema string, dbTable string, uuidG
 	var err error
 
 	p := &PostgresDriver{
-		tableName:     dbTable,
-		schemaName:    dbSchema,
-		uuidGenSchema: uuidGenSchema,
+		postgresTable: postgresTable{
+			tableName:     dbTable,
+			schemaName:    dbSchema,
+			uuidGenSchema: uuidGenSchema,
+		},
+		connString: connString,
+		hub:        newNotifyHub(),
+		listenMX:   &sync.Mutex{},
 	}
 
 	p.db, err = sql.Open("postgres", connString)
@@ -45,44 +44,90 @@ func NewPostgresDriver(connString string, dbSchema string, dbTable string, uuidG
 	return p, err
 }
 
-func (p *PostgresDriver) taskQueryColumns() string {
-	return "a." + p.primaryKey() + ", a.task_key, a.task_name, a.created_at, a.created_by, a.data, a.state"
+// SetDeadLetterTable Sets the table, in the same schema as the queue, that
+// failed tasks are moved to.  Until set, failed tasks are left in the queue
+// marked as failed, and the dead-letter methods return ErrNotSupported
+func (p *PostgresDriver) SetDeadLetterTable(dbTable string) {
+	p.deadTableName = dbTable
 }
 
-func (p *PostgresDriver) primaryKey() string {
-	return p.tableName + "_id"
-}
-
-// clear Removes all entries from the queue.  Be careful.  Generally you should cancel entries rather than delete.
-func (p *PostgresDriver) clear() error {
-	_, err := p.db.Exec(fmt.Sprintf("DELETE FROM %s", p.schemaTable()))
+// Clear Removes all entries from the queue, and the dead-letter table if set.  Be careful.  Generally you should cancel entries rather than delete.
+func (p *PostgresDriver) Clear() error {
+	_, err := p.db.Exec(p.clearQuery())
 
 	return err
 }
 
-func (p *PostgresDriver) name() string {
+// Name Returns the name of the driver
+func (p *PostgresDriver) Name() string {
 	return "PostgresDriver"
 }
 
-// AddTask Adds a task to the queue
-func (p *PostgresDriver) addTask(taskData TaskInit) error {
+// AddTask Adds a task to the queue, returning its ID.  If the task matches
+// one already there as per taskData.Unique, the ID of the match is returned
+func (p *PostgresDriver) AddTask(taskData TaskInit) (string, error) {
+	if taskData.Unique == UniqueNone {
+		return p.addTask(p.db, taskData)
+	}
+
+	// Duplicates are looked for under a lock held until the end of a
+	// transaction:
+	tx, err := p.db.Begin()
+
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	id, err := p.addTask(tx, taskData)
+
+	if err != nil {
+		return "", err
+	}
+
+	return id, tx.Commit()
+}
+
+// AddTaskTx Adds a task as part of the caller's transaction, so that it is
+// only added, and listeners only notified, if the transaction is committed
+func (p *PostgresDriver) AddTaskTx(tx *sql.Tx, taskData TaskInit) (string, error) {
+	if tx == nil {
+		return "", fmt.Errorf("cannot have nil transaction")
+	}
+
+	return p.addTask(tx, taskData)
+}
+
+func (p *PostgresDriver) addTask(q sqlQuerier, taskData TaskInit) (string, error) {
+	var id string
+
+	if err := checkUnique(taskData); err != nil {
+		return id, err
+	}
+
 	// Store data as json:
 	dataString, err := json.Marshal(taskData.Data)
 
 	if err != nil {
-		return err
+		return id, err
+	}
+
+	metadata, err := marshalMetadata(taskData.Metadata)
+
+	if err != nil {
+		return id, err
+	}
+
+	if taskData.Unique != UniqueNone {
+		id, err = p.resolveConflict(q, taskData, string(dataString))
+
+		if err != nil || len(id) > 0 {
+			return id, err
+		}
 	}
 
 	created := time.Now()
-	var uuidGen = "gen_random_uuid()"
-	if len(p.uuidGenSchema) > 0 {
-		uuidGen = p.uuidGenSchema + "." + uuidGen
-	}
-	// Convert
-	_, err = p.db.Exec(`
-INSERT INTO `+p.schemaTable()+`
-	(`+p.primaryKey()+`, data, state, task_key, task_name, created_at, last_attempted, last_attempt_message, do_after, created_by)
-VALUES (`+uuidGen+`, $1, $2, $3, $4, $5, $6, 'Created', $7, $8)`,
+	err = q.QueryRow(p.addTaskQuery(),
 		dataString,
 		"READY",
 		taskData.Key,
@@ -91,50 +136,126 @@ VALUES (`+uuidGen+`, $1, $2, $3, $4, $5, $6, 'Created', $7, $8)`,
 		created,
 		taskData.DoAfter,
 		taskData.CreatedBy,
-	)
+		p.notifyChannel(),
+		sql.NullString{String: taskData.IdempotencyKey, Valid: len(taskData.IdempotencyKey) > 0},
+		metadata,
+	).Scan(&id)
 
-	return err
+	return id, err
+}
+
+// resolveConflict Applies the conflict policy to tasks that taskData would
+// duplicate, returning the ID of the most recently created.  Returns an empty
+// ID if there are none, so the task is to be added.  Must be called within a
+// transaction
+func (p *PostgresDriver) resolveConflict(tx sqlQuerier, taskData TaskInit, data string) (string, error) {
+	var id string
+
+	if _, err := tx.Exec(p.uniqueLockQuery(), p.uniqueLockValue(taskData)); err != nil {
+		return id, err
+	}
+
+	cutoff := time.Now().Add(-taskData.UniqueWithin)
+
+	if set, value := conflictUpdate(taskData, data, taskData.DoAfter); len(set) > 0 {
+		condition, args := uniqueCondition(taskData, 2, cutoff)
+
+		if _, err := tx.Exec(p.conflictUpdateQuery(set, condition), append([]interface{}{value}, args...)...); err != nil {
+			return id, err
+		}
+	}
+
+	condition, args := uniqueCondition(taskData, 1, cutoff)
+	err := tx.QueryRow(p.duplicateQuery(condition), args...).Scan(&id)
+
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return id, err
+}
+
+// Subscribe Returns a channel receiving the names of tasks as they're added,
+// by any process.  The first call starts listening for notifications on a
+// connection of its own, which stays open for the life of the driver
+func (p *PostgresDriver) Subscribe() (<-chan string, func(), error) {
+	p.listenMX.Lock()
+	defer p.listenMX.Unlock()
+
+	if p.listener == nil {
+		listener := pq.NewListener(p.connString, time.Second, time.Minute, nil)
+
+		if err := listener.Listen(p.notifyChannel()); err != nil {
+			listener.Close()
+			return nil, nil, err
+		}
+
+		p.listener = listener
+
+		go func() {
+			for n := range listener.Notify {
+				if n == nil {
+					// Connection was re-established, so we may have missed some:
+					p.hub.publish("")
+					continue
+				}
+
+				p.hub.publish(n.Extra)
+			}
+		}()
+	}
+
+	ch, stop := p.hub.subscribe()
+
+	return ch, stop, nil
 }
 
-func (p *PostgresDriver) cleanup(task Task) {
+// Cleanup Closes off the transaction opened by Pop
+func (p *PostgresDriver) Cleanup(task Task) {
 	if task.tx != nil {
-		// Possibly already committed/rolled back by this stage.  E.g., if unmarshal in pop() has called commit
+		// Possibly already committed/rolled back by this stage.  E.g., if unmarshal in Pop() has called commit
 		task.tx.Commit()
 	}
 }
 
-func (p *PostgresDriver) pop() (Task, error) {
+// Pop Returns the oldest task that is ready, holding a lock on it until the
+// task is completed or cleaned up.  The claim on the task, including the
+// attempt, is committed before the task is locked, so that it still counts if
+// the process running the task goes away.  Locking the task waits for anyone
+// else editing it, and the claim is undone if the task can't be locked
+// without having changed in the meantime.  The lock keeps the task from being
+// popped again while it's held, however long that takes, so the lease only
+// matters once the lock is gone without the task being finished
+func (p *PostgresDriver) Pop(opts PopOptions) (Task, error) {
 	var task Task
-	var data string
+	var data, metadata string
+	var previousDoAfter, previousAttempted *time.Time
+	var previousState, previousMessage *string
+
+	err := p.db.QueryRow(p.popQuery(), pq.Array(opts.ExcludeNames), pq.Array(opts.Names), opts.lease().Seconds()).Scan(&task.id, &task.Key, &task.Name, &task.Created, &task.CreatedBy, &data, &task.State, &task.Attempts, &metadata, &task.DoAfter, &previousDoAfter, &previousState, &previousAttempted, &previousMessage)
+
+	if err == sql.ErrNoRows {
+		return task, ErrNoTasks
+	}
 
-	tx, err := p.db.Begin()
 	if err != nil {
+		// Error calling query to get next off the ramp
 		return task, err
 	}
 
-	query := `
-WITH u AS (
-	SELECT ` + p.primaryKey() + `
-	FROM ` + p.schemaTable() + `
-	WHERE (
-		state IN ('` + string(TaskReady) + `')
-		OR (
-			last_attempted < Now() - INTERVAL '10 minute'
-			AND state IN ('` + string(TaskInProgress) + `', '` + string(TaskRetry) + `')
-		)
-	)
-	AND do_after < Now()
-	ORDER BY last_attempted ASC
-	FOR UPDATE SKIP LOCKED
-	LIMIT 1
-)
-UPDATE ` + p.schemaTable() + ` a SET last_attempted=Now(), last_attempt_message='Attempting', state='` + string(TaskRetry) + `'
-FROM u
-WHERE a.` + p.primaryKey() + ` = u.` + p.primaryKey() + `
-RETURNING ` + p.taskQueryColumns()
+	unclaim := func() {
+		p.db.Exec(p.unclaimTaskQuery(), task.id, task.Attempts, previousDoAfter, previousState, previousAttempted, previousMessage)
+	}
 
-	err = tx.QueryRow(query).Scan(&task.id, &task.Key, &task.Name, &task.Created, &task.CreatedBy, &data, &task.State)
-	task.tx = tx
+	tx, err := p.db.Begin()
+	if err != nil {
+		unclaim()
+		return task, err
+	}
+
+	// The claim keeps others from popping the task in the meantime, but it
+	// may have been edited, e.g., cancelled:
+	err = tx.QueryRow(p.lockTaskQuery(), task.id, task.Attempts).Scan(&data, &metadata)
 
 	if err == sql.ErrNoRows {
 		tx.Rollback()
@@ -142,12 +263,18 @@ RETURNING ` + p.taskQueryColumns()
 	}
 
 	if err != nil {
-		// Error calling query to get next off the ramp
 		tx.Rollback()
+		unclaim()
 		return task, err
 	}
 
-	err = json.Unmarshal([]byte(data), &task.Data)
+	task.tx = tx
+
+	task.Metadata, err = unmarshalMetadata([]byte(metadata))
+
+	if err == nil {
+		err = json.Unmarshal([]byte(data), &task.Data)
+	}
 
 	if err != nil {
 		// Defaults to retry, as per query above:
@@ -159,50 +286,76 @@ RETURNING ` + p.taskQueryColumns()
 	return task, err
 }
 
-func (p *PostgresDriver) refreshRetry(age time.Duration) error {
-	when := time.Now().Add(-age)
-	_, err := p.db.Exec("UPDATE "+p.schemaTable()+" SET state=$1, last_attempted=$2 WHERE state=$3 AND last_attempted < $4", string(TaskReady), time.Now(), string(TaskRetry), when)
+// ExtendLease Extends the lease on a task that is still held, as per
+// LeaseExtender.  The lock taken by Pop holds the task, rather than its
+// do_after, so the lease is extended as long as the lock is still held.  The
+// lock is checked through a connection of its own, so that an action using
+// the task's transaction isn't interrupted
+func (p *PostgresDriver) ExtendLease(task Task, lease time.Duration) (time.Time, error) {
+	var until time.Time
 
-	return err
+	err := p.db.QueryRow(p.extendLeaseQuery(), task.id, task.Attempts, lease.Seconds()).Scan(&until)
+
+	if err == sql.ErrNoRows {
+		return until, fmt.Errorf("task with ID %s is no longer held by this caller", task.id)
+	}
+
+	return until, err
 }
 
-func (p *PostgresDriver) getQueueLength() (int64, error) {
+// GetQueueLength Returns the number of tasks in the queue, in any state
+func (p *PostgresDriver) GetQueueLength() (int64, error) {
 	var length int64
 
-	err := p.db.QueryRow("SELECT count(*) FROM " + p.schemaTable() + " LIMIT 1").Scan(&length)
+	err := p.db.QueryRow(p.queueLengthQuery()).Scan(&length)
 
 	return length, err
 }
 
-func (p *PostgresDriver) getTaskCount(taskName string) (int64, error) {
+// GetTaskCount Returns the number of active tasks with the given name
+func (p *PostgresDriver) GetTaskCount(taskName string) (int64, error) {
 	var length int64
 
-	err := p.db.QueryRow("SELECT count(*) FROM "+p.schemaTable()+" WHERE task_name = $1 AND state != 'CANCELLED' AND state != 'DONE' AND state != 'FAILED'", taskName).Scan(&length)
+	err := p.db.QueryRow(p.taskCountQuery(), taskName).Scan(&length)
 
 	return length, err
 }
 
-func (p *PostgresDriver) complete(task Task, message string) error {
+// Complete Marks a task as complete
+func (p *PostgresDriver) Complete(task Task, message string) error {
 	return p.setTaskState(task, TaskDone, message)
 }
 
-func (p *PostgresDriver) cancel(task Task, message string) error {
+// Cancel Marks a task as cancelled
+func (p *PostgresDriver) Cancel(task Task, message string) error {
 	return p.setTaskState(task, TaskCancelled, message)
 }
 
-func (p *PostgresDriver) fail(task Task, message string) error {
+// Fail Marks a task as permanently failed, moving it to the dead-letter table
+// if one has been set
+func (p *PostgresDriver) Fail(task Task, message string) error {
+	if p.hasDeadLetter() {
+		return p.finishTask(task, p.failQuery(), message, time.Now(), task.id)
+	}
+
 	return p.setTaskState(task, TaskFailed, message)
 }
 
-func (p *PostgresDriver) retry(task Task, message string) error {
-	return p.setTaskState(task, TaskRetry, message)
+// Retry Marks a task as in need of a retry once doAfter has passed
+func (p *PostgresDriver) Retry(task Task, message string, doAfter time.Time) error {
+	return p.finishTask(task, p.retryQuery(), string(TaskRetry), time.Now(), message, task.id, doAfter)
 }
 
 func (p *PostgresDriver) setTaskState(task Task, state TaskState, message string) error {
+	return p.finishTask(task, p.setTaskStateQuery(), string(state), time.Now(), message, task.id)
+}
+
+// finishTask Runs the query on the task's transaction, and commits
+func (p *PostgresDriver) finishTask(task Task, query string, args ...interface{}) error {
 	if task.tx == nil {
 		return fmt.Errorf("cannot have nil transaction for task")
 	}
-	_, err := task.tx.Exec("UPDATE "+p.schemaTable()+" SET state=$1, last_attempted=$2, last_attempt_message=$3 WHERE "+p.primaryKey()+" = $4", string(state), time.Now(), message, task.id)
+	_, err := task.tx.Exec(query, args...)
 
 	if err != nil {
 		task.tx.Rollback()
@@ -211,17 +364,264 @@ func (p *PostgresDriver) setTaskState(task Task, state TaskState, message string
 	return task.tx.Commit()
 }
 
-func (p *PostgresDriver) scanTask(scanner *sql.Row) (Task, error) {
+// GetTask Returns the task in the queue with the given ID
+func (p *PostgresDriver) GetTask(id string) (Task, error) {
+	task, err := p.scanTask(p.db.QueryRow(p.getTaskQuery(), id))
+
+	if err == sql.ErrNoRows {
+		return task, ErrTaskNotFound
+	}
+
+	return task, err
+}
+
+// ListTasks Returns the tasks in the queue selected by filter, most recently
+// created first
+func (p *PostgresDriver) ListTasks(filter TaskFilter) ([]Task, error) {
+	query, args := p.listTasksQuery(filter)
+	rows, err := p.db.Query(query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []Task
+	for rows.Next() {
+		task, err := p.scanTask(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tasks = append(tasks, task)
+	}
+
+	return tasks, rows.Err()
+}
+
+// scanTask Scans a row of taskDetailColumns
+func (p *PostgresDriver) scanTask(scanner interface{ Scan(...interface{}) error }) (Task, error) {
 	var task Task
-	var data string
+	var data, metadata string
+
+	err := scanner.Scan(&task.id, &task.Key, &task.Name, &task.Created, &task.CreatedBy, &data, &task.State, &task.Attempts, &task.DoAfter, &task.LastAttempted, &task.LastAttemptMessage, &metadata)
+
+	if err != nil {
+		return task, err
+	}
+
+	if task.Metadata, err = unmarshalMetadata([]byte(metadata)); err != nil {
+		return task, err
+	}
+
+	task.RawData = []byte(data)
+	err = json.Unmarshal(task.RawData, &task.Data)
+
+	return task, err
+}
+
+// CountTasks Returns how many of the tasks selected by filter there are for
+// each name and state
+func (p *PostgresDriver) CountTasks(filter TaskFilter) ([]TaskCount, error) {
+	if err := filter.checkUnpaged(); err != nil {
+		return nil, err
+	}
+
+	query, args := p.countTasksQuery(filter)
+	rows, err := p.db.Query(query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []TaskCount{}
+	for rows.Next() {
+		var c TaskCount
+
+		if err = rows.Scan(&c.Name, &c.State, &c.Count); err != nil {
+			return nil, err
+		}
+
+		counts = append(counts, c)
+	}
+
+	return counts, rows.Err()
+}
+
+// CancelTasks Cancels the pending tasks selected by filter, skipping those
+// locked by Pop
+func (p *PostgresDriver) CancelTasks(filter TaskFilter, message string) (int64, error) {
+	query, args := p.cancelTasksQuery(filter)
+
+	return p.editTasks(filter, query, append([]interface{}{string(TaskCancelled), time.Now(), message}, args...))
+}
+
+// RescheduleTasks Sets do_after for the pending tasks selected by filter,
+// skipping those locked by Pop
+func (p *PostgresDriver) RescheduleTasks(filter TaskFilter, doAfter time.Time) (int64, error) {
+	query, args := p.rescheduleTasksQuery(filter)
+
+	return p.editTasks(filter, query, append([]interface{}{doAfter}, args...))
+}
+
+// RequeueTasks Puts the failed and cancelled tasks selected by filter back in
+// the queue
+func (p *PostgresDriver) RequeueTasks(filter TaskFilter, doAfter time.Time) (int64, error) {
+	query, args := p.requeueTasksQuery(filter)
+
+	return p.editTasks(filter, query, append([]interface{}{string(TaskReady), time.Now(), doAfter}, args...))
+}
+
+// PurgeTasks Deletes the finished tasks selected by filter
+func (p *PostgresDriver) PurgeTasks(filter TaskFilter) (int64, error) {
+	if err := filter.checkUnpaged(); err != nil {
+		return 0, err
+	}
+
+	query, args := p.purgeTasksQuery(filter)
+	res, err := p.db.Exec(query, args...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// editTasks Runs a query from editTasksQuery, returning how many tasks changed
+func (p *PostgresDriver) editTasks(filter TaskFilter, query string, args []interface{}) (int64, error) {
+	var count, notified int64
+
+	if err := filter.checkUnpaged(); err != nil {
+		return 0, err
+	}
+
+	err := p.db.QueryRow(query, args...).Scan(&count, &notified)
+
+	return count, err
+}
+
+// ListDeadTasks Returns failed tasks, most recently failed first
+func (p *PostgresDriver) ListDeadTasks(limit int, offset int) ([]DeadTask, error) {
+	if !p.hasDeadLetter() {
+		return nil, ErrNotSupported
+	}
+
+	if err := checkDeadPage(limit, offset); err != nil {
+		return nil, err
+	}
+
+	rows, err := p.db.Query(p.listDeadQuery(), limit, offset)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []DeadTask
+	for rows.Next() {
+		task, err := p.scanDeadTask(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tasks = append(tasks, task)
+	}
+
+	return tasks, rows.Err()
+}
 
-	err := scanner.Scan(&task.id, &task.Key, &task.Name, &task.Created, &task.CreatedBy, &data, &task.State)
+// GetDeadTask Returns the failed task with the given ID
+func (p *PostgresDriver) GetDeadTask(id string) (DeadTask, error) {
+	if !p.hasDeadLetter() {
+		return DeadTask{}, ErrNotSupported
+	}
+
+	task, err := p.scanDeadTask(p.db.QueryRow(p.getDeadQuery(), id))
+
+	if err == sql.ErrNoRows {
+		return task, ErrTaskNotFound
+	}
+
+	return task, err
+}
+
+// RequeueDeadTask Moves a failed task back into the queue
+func (p *PostgresDriver) RequeueDeadTask(id string, doAfter time.Time) error {
+	if !p.hasDeadLetter() {
+		return ErrNotSupported
+	}
+
+	res, err := p.db.Exec(p.requeueDeadQuery(), string(TaskReady), time.Now(), doAfter, id, p.notifyChannel())
+
+	return p.checkFound(res, err)
+}
+
+// PurgeDeadTask Deletes a failed task
+func (p *PostgresDriver) PurgeDeadTask(id string) error {
+	if !p.hasDeadLetter() {
+		return ErrNotSupported
+	}
+
+	res, err := p.db.Exec(p.purgeDeadQuery(), id)
+
+	return p.checkFound(res, err)
+}
+
+// PurgeDeadTasks Deletes tasks that failed before the given time
+func (p *PostgresDriver) PurgeDeadTasks(failedBefore time.Time) (int64, error) {
+	if !p.hasDeadLetter() {
+		return 0, ErrNotSupported
+	}
+
+	res, err := p.db.Exec(p.purgeDeadBeforeQuery(), failedBefore)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// checkFound Returns ErrTaskNotFound if the statement affected no rows
+func (p *PostgresDriver) checkFound(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+
+	if err == nil && n == 0 {
+		err = ErrTaskNotFound
+	}
+
+	return err
+}
+
+func (p *PostgresDriver) scanDeadTask(scanner interface{ Scan(...interface{}) error }) (DeadTask, error) {
+	var task DeadTask
+	var data, metadata, history string
+
+	err := scanner.Scan(&task.ID, &task.Key, &task.Name, &task.Created, &task.CreatedBy, &data, &task.Attempts, &task.Error, &task.FailedAt, &metadata, &history)
 
 	if err != nil {
 		return task, err
 	}
 
-	err = json.Unmarshal([]byte(data), &task.Data)
+	task.RawData = []byte(data)
+
+	if task.Metadata, err = unmarshalMetadata([]byte(metadata)); err != nil {
+		return task, err
+	}
+
+	if task.History, err = unmarshalHistory([]byte(history)); err != nil {
+		return task, err
+	}
+
+	err = json.Unmarshal(task.RawData, &task.Data)
 
 	return task, err
 }
@@ -0,0 +1,366 @@
+package queue
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// postgresTable Builds the queries shared by the PostgreSQL drivers, which
+// differ only in how they talk to the database
+type postgresTable struct {
+	tableName     string
+	schemaName    string
+	uuidGenSchema string
+	deadTableName string // Failed tasks are moved here, if set
+}
+
+// schemaTable returns appropriate table+schema name
+func (p postgresTable) schemaTable() string {
+	if len(p.schemaName) > 0 {
+		return p.schemaName + "." + p.tableName
+	}
+
+	return p.tableName
+}
+
+func (p postgresTable) taskQueryColumns() string {
+	return "a." + p.primaryKey() + ", a.task_key, a.task_name, a.created_at, a.created_by, a.data, a.state, a.attempts, a.metadata, a.do_after"
+}
+
+func (p postgresTable) primaryKey() string {
+	return p.tableName + "_id"
+}
+
+// deadSchemaTable returns the dead-letter table+schema name
+func (p postgresTable) deadSchemaTable() string {
+	if len(p.schemaName) > 0 {
+		return p.schemaName + "." + p.deadTableName
+	}
+
+	return p.deadTableName
+}
+
+// hasDeadLetter Whether failed tasks are moved to a dead-letter table
+func (p postgresTable) hasDeadLetter() bool {
+	return len(p.deadTableName) > 0
+}
+
+func (p postgresTable) clearQuery() string {
+	if p.hasDeadLetter() {
+		return "WITH dead AS (DELETE FROM " + p.deadSchemaTable() + ") DELETE FROM " + p.schemaTable()
+	}
+
+	return "DELETE FROM " + p.schemaTable()
+}
+
+// notifyChannel The channel that new tasks are announced on, with the task's
+// name as payload
+func (p postgresTable) notifyChannel() string {
+	return p.schemaTable()
+}
+
+// addTaskQuery Takes data, state, task_key, task_name, created_at,
+// last_attempted, do_after, created_by, the notification channel,
+// idempotency_key and metadata.  Returns the new task's ID.  Listeners are
+// notified once the insert has been committed
+func (p postgresTable) addTaskQuery() string {
+	var uuidGen = "gen_random_uuid()"
+	if len(p.uuidGenSchema) > 0 {
+		uuidGen = p.uuidGenSchema + "." + uuidGen
+	}
+
+	return `
+WITH task AS (
+	INSERT INTO ` + p.schemaTable() + `
+		(` + p.primaryKey() + `, data, state, task_key, task_name, created_at, last_attempted, last_attempt_message, do_after, created_by, idempotency_key, metadata)
+	VALUES (` + uuidGen + `, $1, $2, $3, $4, $5, $6, 'Created', $7, $8, $10, $11)
+	RETURNING ` + p.primaryKey() + `, task_name
+), notified AS (
+	SELECT pg_notify($9, task_name) FROM task
+)
+SELECT ` + p.primaryKey() + ` FROM task, notified`
+}
+
+// uniqueLockQuery Takes a string identifying the tasks a new task may
+// duplicate.  Holds a lock until the end of the transaction, so that two
+// callers can't both find no duplicate and add the same task
+func (p postgresTable) uniqueLockQuery() string {
+	return "SELECT pg_advisory_xact_lock(hashtext($1))"
+}
+
+// uniqueLockValue The value passed to uniqueLockQuery for the task
+func (p postgresTable) uniqueLockValue(t TaskInit) string {
+	return p.schemaTable() + ":" + uniqueValue(t)
+}
+
+// conflictUpdateQuery Takes the new value for the column being set, then the
+// condition's arguments, numbered from $2
+func (p postgresTable) conflictUpdateQuery(set string, condition string) string {
+	return "UPDATE " + p.schemaTable() + " SET " + set + " = $1 WHERE " + condition + " AND state = '" + string(TaskReady) + "'"
+}
+
+// duplicateQuery Takes the condition's arguments, numbered from $1.  Returns
+// the ID of the most recently created match, if any
+func (p postgresTable) duplicateQuery(condition string) string {
+	return "SELECT " + p.primaryKey() + " FROM " + p.schemaTable() + " WHERE " + condition + " ORDER BY created_at DESC LIMIT 1"
+}
+
+// popQuery Takes an array of task names to exclude, an array of names to
+// restrict to (any name if empty), and the lease in seconds.  If the oldest
+// task is ready, the newest ready task with the same key and name is popped in
+// its place, and the others are cancelled as superseded.  Rows locked by
+// others are skipped throughout, so that concurrent pops never wait on each
+// other.  Returns the task's columns, followed by the do_after, state,
+// last_attempted and last_attempt_message it had before, for unclaimTaskQuery
+func (p postgresTable) popQuery() string {
+	return `
+WITH u AS (
+	SELECT ` + p.primaryKey() + `, task_key, task_name, state
+	FROM ` + p.schemaTable() + `
+	WHERE state IN ('` + string(TaskReady) + `', '` + string(TaskInProgress) + `', '` + string(TaskRetry) + `')
+	AND do_after < Now()
+	AND task_name <> ALL(COALESCE($1::varchar[], '{}'))
+	AND (COALESCE(cardinality($2::varchar[]), 0) = 0 OR task_name = ANY($2::varchar[]))
+	ORDER BY last_attempted ASC
+	FOR UPDATE SKIP LOCKED
+	LIMIT 1
+), newest AS (
+	SELECT COALESCE((
+		SELECT n.` + p.primaryKey() + `
+		FROM ` + p.schemaTable() + ` n, u
+		WHERE u.state = '` + string(TaskReady) + `' AND n.state = '` + string(TaskReady) + `'
+		AND n.task_key = u.task_key AND n.task_name = u.task_name AND n.do_after < Now()
+		ORDER BY n.created_at DESC
+		FOR UPDATE OF n SKIP LOCKED
+		LIMIT 1
+	), u.` + p.primaryKey() + `) AS ` + p.primaryKey() + `
+	FROM u
+), superseded AS (
+	UPDATE ` + p.schemaTable() + ` s SET state='` + string(TaskCancelled) + `', last_attempted=Now(), last_attempt_message='Superseded by ' || newest.` + p.primaryKey() + `
+	FROM newest
+	WHERE s.` + p.primaryKey() + ` IN (
+		SELECT o.` + p.primaryKey() + `
+		FROM ` + p.schemaTable() + ` o, u
+		WHERE u.state = '` + string(TaskReady) + `' AND o.state = '` + string(TaskReady) + `'
+		AND o.task_key = u.task_key AND o.task_name = u.task_name AND o.do_after < Now()
+		FOR UPDATE OF o SKIP LOCKED
+	)
+	AND s.` + p.primaryKey() + ` <> newest.` + p.primaryKey() + `
+), previous AS (
+	SELECT b.` + p.primaryKey() + ` AS previous_id, b.do_after AS previous_do_after, b.state AS previous_state, b.last_attempted AS previous_attempted, b.last_attempt_message AS previous_message
+	FROM ` + p.schemaTable() + ` b, newest
+	WHERE b.` + p.primaryKey() + ` = newest.` + p.primaryKey() + `
+)
+UPDATE ` + p.schemaTable() + ` a SET last_attempted=Now(), last_attempt_message='Attempting', state='` + string(TaskRetry) + `', do_after=Now() + $3::float8 * INTERVAL '1 second', attempts=a.attempts + 1
+FROM newest, previous
+WHERE a.` + p.primaryKey() + ` = newest.` + p.primaryKey() + ` AND previous.previous_id = newest.` + p.primaryKey() + `
+RETURNING ` + p.taskQueryColumns() + `, previous.previous_do_after, previous.previous_state, previous.previous_attempted, previous.previous_message`
+}
+
+// lockTaskQuery Takes the task's ID and the attempts it was claimed with.
+// Locks the task claimed by popQuery, waiting on anyone else holding it, and
+// returns its data and metadata if it hasn't changed since
+func (p postgresTable) lockTaskQuery() string {
+	return "SELECT data, metadata FROM " + p.schemaTable() + " WHERE " + p.primaryKey() + " = $1 AND attempts = $2 AND state = '" + string(TaskRetry) + "' AND last_attempt_message = 'Attempting' FOR UPDATE"
+}
+
+// extendLeaseQuery Takes the task's ID, the attempts it was claimed with, and
+// the lease in seconds.  Returns when the lease now expires if the task
+// hasn't changed and is still locked.  Row locks are skipped rather than
+// waited for, as the task is locked by the caller
+func (p postgresTable) extendLeaseQuery() string {
+	return `
+WITH unlocked AS (
+	SELECT ` + p.primaryKey() + `
+	FROM ` + p.schemaTable() + `
+	WHERE ` + p.primaryKey() + ` = $1
+	FOR UPDATE SKIP LOCKED
+)
+SELECT Now() + $3::float8 * INTERVAL '1 second'
+FROM ` + p.schemaTable() + `
+WHERE ` + p.primaryKey() + ` = $1 AND attempts = $2 AND state = '` + string(TaskRetry) + `' AND last_attempt_message = 'Attempting'
+AND ` + p.primaryKey() + ` NOT IN (SELECT ` + p.primaryKey() + ` FROM unlocked)`
+}
+
+// unclaimTaskQuery Takes the task's ID, the attempts it was claimed with, and
+// the do_after, state, last_attempted and last_attempt_message returned by
+// popQuery.  Undoes the claim, including the attempt, if it hasn't changed
+// since
+func (p postgresTable) unclaimTaskQuery() string {
+	return "UPDATE " + p.schemaTable() + " SET attempts = attempts - 1, do_after = $3, state = $4, last_attempted = $5, last_attempt_message = $6 WHERE " + p.primaryKey() + " = $1 AND attempts = $2 AND state = '" + string(TaskRetry) + "' AND last_attempt_message = 'Attempting'"
+}
+
+func (p postgresTable) queueLengthQuery() string {
+	return "SELECT count(*) FROM " + p.schemaTable() + " LIMIT 1"
+}
+
+// taskCountQuery Takes the task name
+func (p postgresTable) taskCountQuery() string {
+	return "SELECT count(*) FROM " + p.schemaTable() + " WHERE task_name = $1 AND state != 'CANCELLED' AND state != 'DONE' AND state != 'FAILED'"
+}
+
+// setTaskStateQuery Takes state, last_attempted, last_attempt_message and the
+// task's ID
+func (p postgresTable) setTaskStateQuery() string {
+	return "UPDATE " + p.schemaTable() + " SET state=$1, last_attempted=$2, last_attempt_message=$3 WHERE " + p.primaryKey() + " = $4"
+}
+
+// retryQuery Takes state, last_attempted, last_attempt_message, the task's ID
+// and do_after.  Adds the attempt to the task's history
+func (p postgresTable) retryQuery() string {
+	return "UPDATE " + p.schemaTable() + " SET state=$1, last_attempted=$2, last_attempt_message=$3, do_after=$5, history=" + historyAppend("$2", "$3") + " WHERE " + p.primaryKey() + " = $4"
+}
+
+// historyAppend Returns an expression for the history column with the attempt
+// that finished at the given time, with the given message, appended
+func historyAppend(at string, message string) string {
+	return "history || jsonb_build_array(jsonb_build_object('attempt', attempts, 'at', " + at + "::timestamptz, 'message', " + message + "::text))"
+}
+
+// failQuery Takes last_attempt_message, the time of failure and the task's ID.
+// Moves the task to the dead-letter table, adding the attempt to its history
+func (p postgresTable) failQuery() string {
+	return `
+WITH moved AS (
+	DELETE FROM ` + p.schemaTable() + ` WHERE ` + p.primaryKey() + ` = $3
+	RETURNING *
+)
+INSERT INTO ` + p.deadSchemaTable() + `
+	(` + p.primaryKey() + `, data, task_key, task_name, created_at, created_by, attempts, last_attempt_message, failed_at, idempotency_key, metadata, history)
+SELECT ` + p.primaryKey() + `, data, task_key, task_name, created_at, created_by, attempts, $1, $2, idempotency_key, metadata, ` + historyAppend("$2", "$1") + `
+FROM moved`
+}
+
+func (p postgresTable) taskDetailColumns() string {
+	return p.primaryKey() + ", task_key, task_name, created_at, created_by, data, state, attempts, do_after, last_attempted, last_attempt_message, metadata"
+}
+
+// getTaskQuery Takes the task's ID
+func (p postgresTable) getTaskQuery() string {
+	return "SELECT " + p.taskDetailColumns() + " FROM " + p.schemaTable() + " WHERE " + p.primaryKey() + " = $1"
+}
+
+// listTasksQuery Returns the query for the tasks selected by filter, most
+// recently created first, and its arguments
+func (p postgresTable) listTasksQuery(filter TaskFilter) (string, []interface{}) {
+	condition, args := filter.condition(1, p.primaryKey(), func(t time.Time) interface{} { return t })
+	page, pageArgs := filter.page(len(args)+1, "ALL")
+
+	return "SELECT " + p.taskDetailColumns() + " FROM " + p.schemaTable() + " WHERE " + condition + " ORDER BY created_at DESC, " + p.primaryKey() + page, append(args, pageArgs...)
+}
+
+// countTasksQuery Returns the query counting the tasks selected by filter for
+// each name and state, and its arguments
+func (p postgresTable) countTasksQuery(filter TaskFilter) (string, []interface{}) {
+	condition, args := filter.condition(1, p.primaryKey(), func(t time.Time) interface{} { return t })
+
+	return "SELECT task_name, state, count(*) FROM " + p.schemaTable() + " WHERE " + condition + " GROUP BY task_name, state ORDER BY task_name, state", args
+}
+
+// purgeTasksQuery Returns the query deleting the finished tasks selected by
+// filter, and its arguments
+func (p postgresTable) purgeTasksQuery(filter TaskFilter) (string, []interface{}) {
+	var args []interface{}
+	states := make([]string, len(purgeableStates))
+	for i, state := range purgeableStates {
+		args = append(args, string(state))
+		states[i] = fmt.Sprintf("$%d", len(args))
+	}
+
+	condition, conditionArgs := filter.condition(len(args)+1, p.primaryKey(), func(t time.Time) interface{} { return t })
+
+	return "DELETE FROM " + p.schemaTable() + " WHERE state IN (" + strings.Join(states, ", ") + ") AND " + condition, append(args, conditionArgs...)
+}
+
+// editTasksQuery Returns a query applying set, which takes setArgs
+// placeholders from $1, to the tasks in one of the given states that are
+// selected by filter, and announcing their names on the notification channel.
+// Tasks locked by Pop are skipped.  The query returns how many tasks were
+// changed.  The arguments returned follow the set arguments, starting with
+// the notification channel
+func (p postgresTable) editTasksQuery(set string, setArgs int, states []TaskState, filter TaskFilter) (string, []interface{}) {
+	args := []interface{}{p.notifyChannel()}
+	channel := setArgs + 1
+
+	stateList := make([]string, len(states))
+	for i, state := range states {
+		args = append(args, string(state))
+		stateList[i] = fmt.Sprintf("$%d", setArgs+len(args))
+	}
+
+	condition, conditionArgs := filter.condition(setArgs+len(args)+1, p.primaryKey(), func(t time.Time) interface{} { return t })
+
+	return `
+WITH changed AS (
+	UPDATE ` + p.schemaTable() + ` SET ` + set + `
+	WHERE ` + p.primaryKey() + ` IN (
+		SELECT ` + p.primaryKey() + ` FROM ` + p.schemaTable() + `
+		WHERE state IN (` + strings.Join(stateList, ", ") + `) AND ` + condition + `
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING task_name
+), notified AS (
+	SELECT pg_notify($` + strconv.Itoa(channel) + `, task_name) FROM (SELECT DISTINCT task_name FROM changed) n
+)
+SELECT (SELECT count(*) FROM changed), (SELECT count(*) FROM notified)`, append(args, conditionArgs...)
+}
+
+// cancelTasksQuery Takes state, last_attempted and last_attempt_message,
+// followed by the arguments returned
+func (p postgresTable) cancelTasksQuery(filter TaskFilter) (string, []interface{}) {
+	return p.editTasksQuery("state = $1, last_attempted = $2, last_attempt_message = $3", 3, pendingStates, filter)
+}
+
+// rescheduleTasksQuery Takes do_after, followed by the arguments returned
+func (p postgresTable) rescheduleTasksQuery(filter TaskFilter) (string, []interface{}) {
+	return p.editTasksQuery("do_after = $1", 1, pendingStates, filter)
+}
+
+// requeueTasksQuery Takes state, last_attempted and do_after, followed by the
+// arguments returned
+func (p postgresTable) requeueTasksQuery(filter TaskFilter) (string, []interface{}) {
+	return p.editTasksQuery("state = $1, last_attempted = $2, last_attempt_message = 'Requeued', do_after = $3, attempts = 0", 3, finishedStates, filter)
+}
+
+func (p postgresTable) deadQueryColumns() string {
+	return p.primaryKey() + ", task_key, task_name, created_at, created_by, data, attempts, last_attempt_message, failed_at, metadata, history"
+}
+
+// listDeadQuery Takes the limit and offset
+func (p postgresTable) listDeadQuery() string {
+	return "SELECT " + p.deadQueryColumns() + " FROM " + p.deadSchemaTable() + " ORDER BY failed_at DESC, " + p.primaryKey() + " LIMIT $1 OFFSET $2"
+}
+
+// getDeadQuery Takes the task's ID
+func (p postgresTable) getDeadQuery() string {
+	return "SELECT " + p.deadQueryColumns() + " FROM " + p.deadSchemaTable() + " WHERE " + p.primaryKey() + " = $1"
+}
+
+// requeueDeadQuery Takes state, last_attempted, do_after, the task's ID and
+// the notification channel.  Returns a row if the task was requeued
+func (p postgresTable) requeueDeadQuery() string {
+	return `
+WITH moved AS (
+	DELETE FROM ` + p.deadSchemaTable() + ` WHERE ` + p.primaryKey() + ` = $4
+	RETURNING *
+), task AS (
+	INSERT INTO ` + p.schemaTable() + `
+		(` + p.primaryKey() + `, data, state, task_key, task_name, created_at, created_by, last_attempted, last_attempt_message, do_after, attempts, idempotency_key, metadata, history)
+	SELECT ` + p.primaryKey() + `, data, $1, task_key, task_name, created_at, created_by, $2, 'Requeued', $3, 0, idempotency_key, metadata, history
+	FROM moved
+	RETURNING task_name
+)
+SELECT pg_notify($5, task_name) FROM task`
+}
+
+// purgeDeadQuery Takes the task's ID
+func (p postgresTable) purgeDeadQuery() string {
+	return "DELETE FROM " + p.deadSchemaTable() + " WHERE " + p.primaryKey() + " = $1"
+}
+
+// purgeDeadBeforeQuery Takes the time before which failed tasks are deleted
+func (p postgresTable) purgeDeadBeforeQuery() string {
+	return "DELETE FROM " + p.deadSchemaTable() + " WHERE failed_at < $1"
+}
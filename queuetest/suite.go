@@ -0,0 +1,1584 @@
+// Package queuetest provides a conformance suite that any queue.Driver,
+// whether included with the queue package or written elsewhere, can be run
+// against to check that it follows the same rules for ordering, retries,
+// do_after and concurrent use.
+package queuetest
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/episub/queue"
+)
+
+// DriverFactory Returns the driver to be tested.  It may return a new driver
+// each time, or the same one, since each test clears the queue before use
+type DriverFactory func(t *testing.T) queue.Driver
+
+// RunDriverSuite Runs each of the conformance tests against drivers returned
+// by newDriver.  Tests run one after another, so it is safe for the factory to
+// return a driver backed by a shared database
+func RunDriverSuite(t *testing.T, newDriver DriverFactory) {
+	tests := []struct {
+		name string
+		test func(*testing.T, queue.Driver)
+	}{
+		{"ClearQueue", testClearQueue},
+		{"CountTask", testCountTask},
+		{"AddTask", testAddTask},
+		{"Pop", testPop},
+		{"CompleteTask", testCompleteTask},
+		{"PopNotDoneYet", testPopNotDoneYet},
+		{"CancelTask", testCancelTask},
+		{"FailTask", testFailTask},
+		{"TaskOrders", testTaskOrders},
+		{"TaskRetry", testTaskRetry},
+		{"DoAfter", testDoAfter},
+		{"ConcurrentPop", testConcurrentPop},
+		{"ExcludeNames", testExcludeNames},
+		{"Names", testNames},
+		{"RetryDelay", testRetryDelay},
+		{"Attempts", testAttempts},
+		{"AttemptsAbandoned", testAttemptsAbandoned},
+		{"DeadLetter", testDeadLetter},
+		{"Coalesce", testCoalesce},
+		{"Unique", testUnique},
+		{"UniqueConflict", testUniqueConflict},
+		{"AddTaskID", testAddTaskID},
+		{"ListTasks", testListTasks},
+		{"CountTasks", testCountTasks},
+		{"EditTasks", testEditTasks},
+		{"PurgeTasks", testPurgeTasks},
+		{"Metadata", testMetadata},
+		{"Lease", testLease},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDriver(t)
+
+			if err := d.Clear(); err != nil {
+				t.Fatal(err)
+			}
+
+			tt.test(t, d)
+		})
+	}
+}
+
+func checkLength(d queue.Driver, length int64) error {
+	fetchedLength, err := d.GetQueueLength()
+
+	if err != nil {
+		return err
+	}
+
+	if length != fetchedLength {
+		return fmt.Errorf("expected length %d, but had %d", length, fetchedLength)
+	}
+
+	return nil
+}
+
+// checkHistory Checks that the attempts in the history finished with the given
+// messages, in order
+func checkHistory(history []queue.TaskAttempt, messages ...string) error {
+	if len(history) != len(messages) {
+		return fmt.Errorf("expected %d attempts in the history, but had %+v", len(messages), history)
+	}
+
+	for i, attempt := range history {
+		if attempt.Message != messages[i] || attempt.Attempt < 1 || attempt.At.IsZero() {
+			return fmt.Errorf("expected attempt %d in the history to finish with '%s', but had %+v", i+1, messages[i], attempt)
+		}
+	}
+
+	return nil
+}
+
+func addTask(d queue.Driver, key string, name string, data map[string]interface{}) error {
+	_, err := d.AddTask(queue.TaskInit{
+		Key:       key,
+		Name:      name,
+		DoAfter:   time.Now(),
+		CreatedBy: "test_runner",
+		Data:      data,
+	})
+
+	return err
+}
+
+func popAndComplete(d queue.Driver) error {
+	task, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		return err
+	}
+
+	return d.Complete(task, "None")
+}
+
+func expectNoTasks(t *testing.T, d queue.Driver) {
+	t.Helper()
+
+	_, err := d.Pop(queue.PopOptions{})
+
+	if err != queue.ErrNoTasks {
+		if err != nil {
+			t.Errorf("Expected ErrNoTasks but had: %s", err)
+		} else {
+			t.Error("Expected ErrNoTasks, but no error returned")
+		}
+	}
+}
+
+func order(task queue.Task) int {
+	o, _ := task.Data["order"].(float64)
+	return int(o)
+}
+
+func testClearQueue(t *testing.T, d queue.Driver) {
+	// Check queue length:
+	if err := checkLength(d, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := addTask(d, "somekey", "testClear", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkLength(d, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkLength(d, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testCountTask(t *testing.T, d queue.Driver) {
+	if err := addTask(d, "somekey", "testCount", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if err := addTask(d, "somekey", "testCount1", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkLength(d, 2); err != nil {
+		t.Error(err)
+	}
+
+	taskCount, err := d.GetTaskCount("testCount")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if taskCount != 1 {
+		t.Errorf("expected 1 task with the name 'testCount' got %d", taskCount)
+	}
+
+	task, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = d.Complete(task, "test done"); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err = d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = d.Fail(task, "test fail"); err != nil {
+		t.Fatal(err)
+	}
+
+	taskCount, err = d.GetTaskCount("testCount")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if taskCount != 0 {
+		t.Errorf("expected 0 task with the name 'testCount' got %d", taskCount)
+	}
+}
+
+func testAddTask(t *testing.T, d queue.Driver) {
+	data := map[string]interface{}{
+		"exampleString": "val1",
+		"exampleBool":   true,
+	}
+
+	if err := addTask(d, "something", "testMSAddTask", data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkLength(d, 1); err != nil {
+		t.Error(err)
+	}
+}
+
+func testPop(t *testing.T, d queue.Driver) {
+	taskKey := "customer_update:123"
+	taskName := "customer_update"
+	data := map[string]interface{}{
+		"exampleString": "val1",
+		"exampleBool":   true,
+	}
+
+	// First check for ErrNoTasks if we pop with no tasks:
+	expectNoTasks(t, d)
+
+	// Add a task to test with:
+	if err := addTask(d, taskKey, taskName, data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pop task should return that task:
+	task, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(task.ID()) == 0 {
+		t.Errorf("Popped task (%s) has no ID", d.Name())
+	}
+
+	if task.Key != taskKey {
+		t.Errorf("Key mismatch (%s): task.Key %s, taskKey %s", d.Name(), task.Key, taskKey)
+	}
+
+	if task.Name != taskName {
+		t.Errorf("Name mismatch (%s): task.Name %s, taskName %s", d.Name(), task.Name, taskName)
+	}
+
+	if !reflect.DeepEqual(data, task.Data) {
+		t.Errorf("Data mismatch (%s): task.Data: %+v, data: %+v", d.Name(), task.Data, data)
+	}
+
+	// DoAfter is when the task will be reclaimed if it isn't finished:
+	if !task.DoAfter.After(time.Now()) {
+		t.Errorf("Popped task (%s) should have DoAfter in the future, but had %s", d.Name(), task.DoAfter)
+	}
+
+	// While held, the task must not be handed out again:
+	expectNoTasks(t, d)
+
+	// Clean up our pop:
+	d.Cleanup(task)
+}
+
+func testCompleteTask(t *testing.T, d queue.Driver) {
+	// Items A, B, and C are created in order, with different keys.  Each is
+	// popped oldest first, and once all three are completed there is nothing
+	// left to do
+	for i := 1; i <= 3; i++ {
+		if err := addTask(d, fmt.Sprintf("testCompleteTask%d", i), "testCompleteTask", map[string]interface{}{"order": i}); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Pop, contrary to name, should fetch oldest first:
+	task, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if order(task) != 1 {
+		t.Fatalf("Expected task to have 'order' of 1, but was %d", order(task))
+	}
+
+	// Mark task as completed:
+	if err = d.Complete(task, "None"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pop new task, to check that we have none returned after third:
+	for i := 0; i < 2; i++ {
+		if err = popAndComplete(d); err != nil {
+			t.Error(err)
+		}
+	}
+
+	expectNoTasks(t, d)
+}
+
+func testPopNotDoneYet(t *testing.T, d queue.Driver) {
+	// Items A and B are created for the same key, so only B, the newest, is
+	// popped.  In the meantime, item C is added before B's action is
+	// completed.  B now completes.  Completing B must not mark C as done,
+	// since C required an update based on newer data
+	for i := 1; i <= 2; i++ {
+		if err := addTask(d, "testCompleteTask1", "testCompleteTask", map[string]interface{}{"order": i}); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Pop newest:
+	task, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if order(task) != 2 {
+		t.Fatalf("Expected task to have 'order' of 2, but was %d", order(task))
+	}
+
+	// Add the third task:
+	if err = addTask(d, "testCompleteTask1", "testCompleteTask", map[string]interface{}{"order": 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Mark task as completed:
+	if err = d.Complete(task, "None"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pop new task, to check that task with order 3 is returned:
+	task, err = d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if order(task) != 3 {
+		t.Errorf("Expected task to have 'order' of 3, but was %d", order(task))
+	}
+
+	d.Cleanup(task)
+}
+
+func testCancelTask(t *testing.T, d queue.Driver) {
+	// A task is cancelled when no action is found for a task
+	if err := addTask(d, "testCancelTask1", "testCancelTask", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = d.Cancel(task, "Cancelled"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pop new task, to check that we have none returned:
+	expectNoTasks(t, d)
+}
+
+func testFailTask(t *testing.T, d queue.Driver) {
+	// A task is failed if there was an error when it returned
+	if err := addTask(d, "testFailTask1", "testFailTask", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = d.Fail(task, "Failed"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pop new task, to check that we have none returned:
+	expectNoTasks(t, d)
+}
+
+func testTaskOrders(t *testing.T, d queue.Driver) {
+	// If task A is created first, then task B, task A should be popped first
+	keys := []string{"TestTaskOrders1", "TestTaskOrders2", "TestTaskOrders3"}
+
+	for i, key := range keys {
+		if err := addTask(d, key, "FakeTaskType", map[string]interface{}{"order": i + 1}); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Should now be able to fetch each task in the order they were added
+	for _, key := range keys {
+		fetched, err := d.Pop(queue.PopOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fetched.Key != key {
+			t.Errorf("Expected task with key %s, but had key %s", key, fetched.Key)
+		}
+
+		if err = d.Complete(fetched, "Completed"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testTaskRetry(t *testing.T, d queue.Driver) {
+	if err := addTask(d, "testTaskRetry1", "testTaskRetry1", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fetch the task (which is only task in queue):
+	task, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Now we set this task as marked for retry shortly:
+	if err = d.Retry(task, "Retry", time.Now().Add(100*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Now if we pop, should get nothing:
+	expectNoTasks(t, d)
+
+	// Once the retry is due, should get the task back:
+	time.Sleep(150 * time.Millisecond)
+
+	newTask, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatalf("Should have refetched task, but didn't: %s", err)
+	}
+
+	if newTask.ID() != task.ID() {
+		t.Errorf("Expected task with ID %s, but had %s", task.ID(), newTask.ID())
+	}
+
+	// A popped task is marked as retry by default, so if there's an issue
+	// then it gets retried later rather than immediately
+	if newTask.State != queue.TaskRetry {
+		t.Errorf("should have been %s, but was %s", queue.TaskRetry, newTask.State)
+	}
+
+	d.Cleanup(newTask)
+}
+
+func testDoAfter(t *testing.T, d queue.Driver) {
+	// A task must not be popped before its do_after time
+	_, err := d.AddTask(queue.TaskInit{
+		Key:       "testDoAfter1",
+		Name:      "testDoAfter",
+		DoAfter:   time.Now().Add(time.Hour),
+		CreatedBy: "test_runner",
+		Data:      map[string]interface{}{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectNoTasks(t, d)
+
+	if err = addTask(d, "testDoAfter2", "testDoAfter", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if task.Key != "testDoAfter2" {
+		t.Errorf("Expected task with key testDoAfter2, but had key %s", task.Key)
+	}
+
+	if err = d.Complete(task, "Completed"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testConcurrentPop(t *testing.T, d queue.Driver) {
+	// Many goroutines popping at once should never be handed the same task
+	taskCount := 50
+
+	for i := 0; i < taskCount; i++ {
+		if err := addTask(d, fmt.Sprintf("testConcurrentPop%d", i), "testConcurrentPop", map[string]interface{}{"order": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	seen := make(map[string]int)
+	seenMX := sync.Mutex{}
+
+	for w := 0; w < 5; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				task, err := d.Pop(queue.PopOptions{})
+				if err == queue.ErrNoTasks {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				seenMX.Lock()
+				seen[task.ID()]++
+				seenMX.Unlock()
+
+				if err = d.Complete(task, "Done"); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if len(seen) != taskCount {
+		t.Errorf("expected %d tasks to be popped, but had %d", taskCount, len(seen))
+	}
+
+	for id, count := range seen {
+		if count != 1 {
+			t.Errorf("task %s was popped %d times", id, count)
+		}
+	}
+}
+
+func testExcludeNames(t *testing.T, d queue.Driver) {
+	// Tasks with excluded names are left in the queue, even if older
+	for i, name := range []string{"testExcluded", "testIncluded"} {
+		if err := addTask(d, "testExcludeNames", name, map[string]interface{}{"order": i + 1}); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	opts := queue.PopOptions{ExcludeNames: []string{"testExcluded", "testOther"}}
+
+	task, err := d.Pop(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if task.Name != "testIncluded" {
+		t.Errorf("Expected task with name testIncluded, but had %s", task.Name)
+	}
+
+	if err = d.Complete(task, "Completed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = d.Pop(opts); err != queue.ErrNoTasks {
+		t.Errorf("Expected ErrNoTasks with excluded task remaining, but had %v", err)
+	}
+
+	task, err = d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if task.Name != "testExcluded" {
+		t.Errorf("Expected task with name testExcluded, but had %s", task.Name)
+	}
+
+	d.Cleanup(task)
+}
+
+func testNames(t *testing.T, d queue.Driver) {
+	// Only tasks with the given names are returned, even if others are older
+	for i, name := range []string{"testOther", "testNamed"} {
+		if err := addTask(d, "testNames", name, map[string]interface{}{"order": i + 1}); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	opts := queue.PopOptions{Names: []string{"testNamed", "testMissing"}}
+
+	task, err := d.Pop(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if task.Name != "testNamed" {
+		t.Errorf("Expected task with name testNamed, but had %s", task.Name)
+	}
+
+	if err = d.Complete(task, "Completed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = d.Pop(opts); err != queue.ErrNoTasks {
+		t.Errorf("Expected ErrNoTasks with only other tasks remaining, but had %v", err)
+	}
+}
+
+func testRetryDelay(t *testing.T, d queue.Driver) {
+	// A retried task is popped again once its retry time has passed
+	if err := addTask(d, "testRetryDelay1", "testRetryDelay", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = d.Retry(task, "Retry", time.Now().Add(500*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	expectNoTasks(t, d)
+
+	time.Sleep(time.Second)
+
+	retried, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatalf("Should have refetched task once retry time passed, but didn't: %s", err)
+	}
+
+	if retried.ID() != task.ID() {
+		t.Errorf("Expected task with ID %s, but had %s", task.ID(), retried.ID())
+	}
+
+	if err = d.Complete(retried, "Completed"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testAttempts(t *testing.T, d queue.Driver) {
+	// Each pop counts as an attempt, whether the task was retried or cleaned up
+	if err := addTask(d, "testAttempts1", "testAttempts", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		task, err := d.Pop(queue.PopOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if task.Attempts != i {
+			t.Errorf("Expected attempt %d, but had %d", i, task.Attempts)
+		}
+
+		if err = d.Retry(task, "Retry", time.Now().Add(-time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testAttemptsAbandoned(t *testing.T, d queue.Driver) {
+	// An attempt counts even if the task is abandoned without being finished,
+	// such as when the process running it goes away.  It's picked up again
+	// once its lease expires
+	if err := addTask(d, "testAttemptsAbandoned", "testAttemptsAbandoned", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := d.Pop(queue.PopOptions{Lease: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.Cleanup(task)
+
+	expectNoTasks(t, d)
+	time.Sleep(150 * time.Millisecond)
+
+	again, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatalf("Expected the abandoned task (%s) to be picked up again: %s", d.Name(), err)
+	}
+	defer d.Cleanup(again)
+
+	if again.ID() != task.ID() || again.Attempts != 2 {
+		t.Errorf("Expected task %s on attempt 2 (%s), but had task %s on attempt %d", task.ID(), d.Name(), again.ID(), again.Attempts)
+	}
+}
+
+// missingID An ID that no task has, in a form every driver accepts
+const missingID = "00000000-0000-0000-0000-000000000000"
+
+func testDeadLetter(t *testing.T, d queue.Driver) {
+	// Failed tasks are moved out of the queue, where they can be inspected,
+	// requeued or purged
+	dl, ok := d.(queue.DeadLetterDriver)
+	if !ok {
+		t.Skip("driver has no dead-letter store")
+	}
+
+	if _, err := dl.ListDeadTasks(10, 0); err == queue.ErrNotSupported {
+		t.Skip("driver's dead-letter store is not configured")
+	}
+
+	// The first task has metadata, and is retried once before failing:
+	metadata := map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	if _, err := d.AddTask(queue.TaskInit{Key: "testDeadLetter1", Name: "testDeadLetter", Data: map[string]interface{}{"order": 1}, DoAfter: time.Now(), CreatedBy: "test_runner", Metadata: metadata}); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = d.Retry(task, "Retry 1", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	var failed []queue.Task
+	for i := 1; i <= 2; i++ {
+		if i > 1 {
+			if err := addTask(d, fmt.Sprintf("testDeadLetter%d", i), "testDeadLetter", map[string]interface{}{"order": i}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		task, err := d.Pop(queue.PopOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = d.Fail(task, fmt.Sprintf("Failed %d", i)); err != nil {
+			t.Fatal(err)
+		}
+
+		failed = append(failed, task)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := checkLength(d, 0); err != nil {
+		t.Error(err)
+	}
+
+	dead, err := dl.ListDeadTasks(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dead) != 2 {
+		t.Fatalf("Expected 2 dead tasks, but had %d", len(dead))
+	}
+
+	if dead[0].ID != failed[1].ID() || dead[1].ID != failed[0].ID() {
+		t.Errorf("Expected most recently failed task first")
+	}
+
+	if dead, err = dl.ListDeadTasks(1, 1); err != nil || len(dead) != 1 || dead[0].ID != failed[0].ID() {
+		t.Errorf("Expected limit and offset to return the first failed task, but had %v, %v", dead, err)
+	}
+
+	if _, err = dl.ListDeadTasks(-1, 0); err == nil {
+		t.Errorf("Expected an error for a negative limit")
+	}
+
+	deadTask, err := dl.GetDeadTask(failed[0].ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deadTask.Key != "testDeadLetter1" || deadTask.Name != "testDeadLetter" || deadTask.CreatedBy != "test_runner" {
+		t.Errorf("Dead task doesn't match the failed task: %+v", deadTask)
+	}
+
+	if deadTask.Error != "Failed 1" {
+		t.Errorf("Expected error 'Failed 1', but had '%s'", deadTask.Error)
+	}
+
+	if deadTask.Attempts != 2 {
+		t.Errorf("Expected 2 attempts, but had %d", deadTask.Attempts)
+	}
+
+	if !reflect.DeepEqual(deadTask.Data, map[string]interface{}{"order": float64(1)}) {
+		t.Errorf("Dead task data doesn't match: %v", deadTask.Data)
+	}
+
+	if !reflect.DeepEqual(deadTask.Metadata, metadata) {
+		t.Errorf("Expected dead task metadata %v, but had %v", metadata, deadTask.Metadata)
+	}
+
+	if err = checkHistory(deadTask.History, "Retry 1", "Failed 1"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = dl.GetDeadTask(missingID); err != queue.ErrTaskNotFound {
+		t.Errorf("Expected ErrTaskNotFound, but had %v", err)
+	}
+
+	// A requeued task is popped again, with its attempts reset and everything
+	// else kept:
+	if err = dl.RequeueDeadTask(failed[0].ID(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = dl.RequeueDeadTask(failed[0].ID(), time.Now()); err != queue.ErrTaskNotFound {
+		t.Errorf("Expected ErrTaskNotFound requeueing twice, but had %v", err)
+	}
+
+	requeued, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if requeued.ID() != failed[0].ID() || requeued.Attempts != 1 {
+		t.Errorf("Expected requeued task %s on attempt 1, but had %s on attempt %d", failed[0].ID(), requeued.ID(), requeued.Attempts)
+	}
+
+	if !reflect.DeepEqual(requeued.Metadata, metadata) {
+		t.Errorf("Expected requeued task metadata %v, but had %v", metadata, requeued.Metadata)
+	}
+
+	if err = d.Fail(requeued, "Failed again"); err != nil {
+		t.Fatal(err)
+	}
+
+	if deadTask, err = dl.GetDeadTask(failed[0].ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = checkHistory(deadTask.History, "Retry 1", "Failed 1", "Failed again"); err != nil {
+		t.Error(err)
+	}
+
+	if err = dl.PurgeDeadTask(failed[0].ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = dl.PurgeDeadTask(failed[1].ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = dl.PurgeDeadTask(failed[1].ID()); err != queue.ErrTaskNotFound {
+		t.Errorf("Expected ErrTaskNotFound purging twice, but had %v", err)
+	}
+
+	// Purge by age:
+	if err = addTask(d, "testDeadLetter3", "testDeadLetter", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	popped, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = d.Fail(popped, "Failed 3"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := dl.PurgeDeadTasks(time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Errorf("Expected nothing purged, but had %d, %v", n, err)
+	}
+
+	if n, err := dl.PurgeDeadTasks(time.Now().Add(time.Second)); err != nil || n != 1 {
+		t.Errorf("Expected 1 purged, but had %d, %v", n, err)
+	}
+
+	if dead, err = dl.ListDeadTasks(10, 0); err != nil || len(dead) != 0 {
+		t.Errorf("Expected no dead tasks, but had %d, %v", len(dead), err)
+	}
+}
+
+func testCoalesce(t *testing.T, d queue.Driver) {
+	// As in tests/sampledata.sql, several ready tasks share a key and name.
+	// Only the newest is performed, and the rest are cancelled.  Tasks with
+	// another name, or not yet due, are left alone
+	taskKey := "1someKeyshouldbesha256"
+	for i := 1; i <= 3; i++ {
+		if err := addTask(d, taskKey, "updateBooking", map[string]interface{}{"order": i}); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := addTask(d, taskKey, "updateInvoice", map[string]interface{}{"order": 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := d.AddTask(queue.TaskInit{
+		Key:       taskKey,
+		Name:      "updateBooking",
+		DoAfter:   time.Now().Add(time.Hour),
+		CreatedBy: "test_runner",
+		Data:      map[string]interface{}{"order": 5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if order(task) != 3 {
+		t.Errorf("Expected newest task with 'order' of 3, but was %d", order(task))
+	}
+
+	if err = d.Complete(task, "Completed"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The superseded tasks are no longer active, leaving the one not yet due:
+	count, err := d.GetTaskCount("updateBooking")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 {
+		t.Errorf("Expected 1 active updateBooking task, but had %d", count)
+	}
+
+	task, err = d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if order(task) != 4 {
+		t.Errorf("Expected task with another name and 'order' of 4, but was %d", order(task))
+	}
+
+	if err = d.Complete(task, "Completed"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectNoTasks(t, d)
+}
+
+func addUniqueTask(d queue.Driver, key string, name string, order int, opts ...queue.AddTaskOption) error {
+	init := queue.TaskInit{
+		Key:       key,
+		Name:      name,
+		DoAfter:   time.Now(),
+		CreatedBy: "test_runner",
+		Data:      map[string]interface{}{"order": order},
+	}
+
+	for _, opt := range opts {
+		opt(&init)
+	}
+
+	_, err := d.AddTask(init)
+
+	return err
+}
+
+func testUnique(t *testing.T, d queue.Driver) {
+	// A task matching one already in the queue isn't added again
+	byKey := queue.WithUnique(queue.UniqueByKey)
+	byKeyAndName := queue.WithUnique(queue.UniqueByKeyAndName)
+	byRequest := queue.WithIdempotencyKey("request1")
+
+	steps := []struct {
+		name   string
+		add    func() error
+		length int64
+	}{
+		{"first", func() error { return addUniqueTask(d, "testUnique1", "testUnique", 1, byKey) }, 1},
+		{"same key", func() error { return addUniqueTask(d, "testUnique1", "testUniqueOther", 2, byKey) }, 1},
+		{"same key, other name", func() error { return addUniqueTask(d, "testUnique1", "testUniqueOther", 3, byKeyAndName) }, 2},
+		{"same key and name", func() error { return addUniqueTask(d, "testUnique1", "testUniqueOther", 4, byKeyAndName) }, 2},
+		{"not unique", func() error { return addUniqueTask(d, "testUnique1", "testUniqueOther", 5) }, 3},
+		{"idempotency key", func() error { return addUniqueTask(d, "testUnique2", "testUnique", 6, byRequest) }, 4},
+		{"repeated idempotency key", func() error { return addUniqueTask(d, "testUnique3", "testUnique", 7, byRequest) }, 4},
+	}
+
+	for _, step := range steps {
+		if err := step.add(); err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+
+		if err := checkLength(d, step.length); err != nil {
+			t.Errorf("%s: %s", step.name, err)
+		}
+	}
+
+	// Finished tasks only match within a window:
+	for {
+		if err := popAndComplete(d); err == queue.ErrNoTasks {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := addUniqueTask(d, "testUnique3", "testUnique", 8, queue.WithIdempotencyKey("request1"), queue.WithUniqueWithin(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	expectNoTasks(t, d)
+
+	if err := addUniqueTask(d, "testUnique3", "testUnique", 9, queue.WithIdempotencyKey("request1")); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if order(task) != 9 {
+		t.Errorf("Expected task with 'order' of 9, but was %d", order(task))
+	}
+
+	d.Cleanup(task)
+
+	if _, err = d.AddTask(queue.TaskInit{Key: "testUnique4", Name: "testUnique", Unique: queue.UniqueByIdempotencyKey}); err == nil {
+		t.Error("Expected error adding a task unique by idempotency key without one")
+	}
+}
+
+func testUniqueConflict(t *testing.T, d queue.Driver) {
+	// Conflict policies update the matching task instead of adding another
+	byKey := queue.WithUnique(queue.UniqueByKey)
+
+	if err := addUniqueTask(d, "testUniqueConflict1", "testUniqueConflict", 1, byKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := addUniqueTask(d, "testUniqueConflict1", "testUniqueConflict", 2, byKey, queue.WithOnConflict(queue.ConflictReplaceData)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkLength(d, 1); err != nil {
+		t.Error(err)
+	}
+
+	task, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if order(task) != 2 {
+		t.Errorf("Expected replaced data with 'order' of 2, but was %d", order(task))
+	}
+
+	if err = d.Complete(task, "Completed"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A task due later is brought forward:
+	_, err = d.AddTask(queue.TaskInit{
+		Key:       "testUniqueConflict2",
+		Name:      "testUniqueConflict",
+		DoAfter:   time.Now().Add(time.Hour),
+		CreatedBy: "test_runner",
+		Data:      map[string]interface{}{"order": 3},
+		Unique:    queue.UniqueByKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectNoTasks(t, d)
+
+	if err = addUniqueTask(d, "testUniqueConflict2", "testUniqueConflict", 4, byKey, queue.WithOnConflict(queue.ConflictResetDoAfter)); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err = d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if order(task) != 3 {
+		t.Errorf("Expected the original task with 'order' of 3, but was %d", order(task))
+	}
+
+	d.Cleanup(task)
+}
+
+func testAddTaskID(t *testing.T, d queue.Driver) {
+	// AddTask returns the ID the task is popped with, or the ID of the task it
+	// duplicates
+	init := queue.TaskInit{
+		Key:       "testAddTaskID1",
+		Name:      "testAddTaskID",
+		DoAfter:   time.Now(),
+		CreatedBy: "test_runner",
+		Unique:    queue.UniqueByKey,
+	}
+
+	id, err := d.AddTask(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(id) == 0 {
+		t.Fatal("Expected AddTask to return an ID")
+	}
+
+	duplicate, err := d.AddTask(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if duplicate != id {
+		t.Errorf("Expected duplicate to return ID %s, but was %s", id, duplicate)
+	}
+
+	task, err := d.Pop(queue.PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if task.ID() != id {
+		t.Errorf("Expected popped task to have ID %s, but was %s", id, task.ID())
+	}
+
+	d.Cleanup(task)
+}
+
+// taskKeys Returns the keys of the tasks, in order
+func taskKeys(tasks []queue.Task) []string {
+	keys := []string{}
+	for _, task := range tasks {
+		keys = append(keys, task.Key)
+	}
+
+	return keys
+}
+
+func testListTasks(t *testing.T, d queue.Driver) {
+	// Tasks can be looked up and listed without popping them
+	r, ok := d.(queue.TaskReader)
+	if !ok {
+		t.Skip("driver can't look up tasks")
+	}
+
+	inits := []queue.TaskInit{
+		{Key: "testListTasks1", Name: "testListTasks", DoAfter: time.Now(), CreatedBy: "alice", Data: map[string]interface{}{"order": 1}},
+		{Key: "testListTasks2", Name: "testListTasks", DoAfter: time.Now(), CreatedBy: "bob", Data: map[string]interface{}{"order": 2}},
+		{Key: "testListTasks1", Name: "testListTasksLater", DoAfter: time.Now().Add(time.Hour), CreatedBy: "alice", Data: map[string]interface{}{"order": 3}},
+	}
+
+	var ids []string
+	for _, init := range inits {
+		id, err := d.AddTask(init)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, id)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	task, err := r.GetTask(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if task.ID() != ids[0] || task.Key != "testListTasks1" || task.Name != "testListTasks" || task.CreatedBy != "alice" || task.State != queue.TaskReady {
+		t.Errorf("Unexpected task %+v", task)
+	}
+
+	if order(task) != 1 {
+		t.Errorf("Expected task with 'order' of 1, but was %d", order(task))
+	}
+
+	if task.LastAttemptMessage != "Created" || task.LastAttempted.IsZero() || task.DoAfter.IsZero() {
+		t.Errorf("Expected last attempt and do_after to be set, but had %+v", task)
+	}
+
+	if _, err = r.GetTask(missingID); err != queue.ErrTaskNotFound {
+		t.Errorf("Expected ErrTaskNotFound for a missing task, but had %v", err)
+	}
+
+	// Complete the first task, so that there's one in another state:
+	popped, err := d.Pop(queue.PopOptions{Names: []string{"testListTasks"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = d.Complete(popped, "testListTasks done"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter queue.TaskFilter
+		keys   []string
+	}{
+		{"all", queue.TaskFilter{}, []string{"testListTasks1", "testListTasks2", "testListTasks1"}},
+		{"names", queue.TaskFilter{Names: []string{"testListTasks"}}, []string{"testListTasks2", "testListTasks1"}},
+		{"keys", queue.TaskFilter{Keys: []string{"testListTasks2"}}, []string{"testListTasks2"}},
+		{"states", queue.TaskFilter{States: []queue.TaskState{queue.TaskDone}}, []string{"testListTasks1"}},
+		{"created by", queue.TaskFilter{CreatedBy: "bob"}, []string{"testListTasks2"}},
+		{"created after", queue.TaskFilter{CreatedAfter: time.Now().Add(-time.Hour)}, []string{"testListTasks1", "testListTasks2", "testListTasks1"}},
+		{"created before", queue.TaskFilter{CreatedBefore: time.Now().Add(-time.Hour)}, []string{}},
+		{"due after", queue.TaskFilter{DueAfter: time.Now().Add(30 * time.Minute)}, []string{"testListTasks1"}},
+		{"due before", queue.TaskFilter{DueBefore: time.Now().Add(30 * time.Minute), States: []queue.TaskState{queue.TaskReady}}, []string{"testListTasks2"}},
+		{"limit", queue.TaskFilter{Limit: 1}, []string{"testListTasks1"}},
+		{"offset", queue.TaskFilter{Offset: 1}, []string{"testListTasks2", "testListTasks1"}},
+		{"page", queue.TaskFilter{Limit: 1, Offset: 1}, []string{"testListTasks2"}},
+	}
+
+	for _, tt := range tests {
+		tasks, err := r.ListTasks(tt.filter)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+
+		if keys := taskKeys(tasks); !reflect.DeepEqual(keys, tt.keys) {
+			t.Errorf("%s: expected tasks with keys %v, but had %v", tt.name, tt.keys, keys)
+		}
+	}
+
+	tasks, err := r.ListTasks(queue.TaskFilter{States: []queue.TaskState{queue.TaskDone}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tasks) != 1 || tasks[0].ID() != ids[0] || tasks[0].LastAttemptMessage != "testListTasks done" {
+		t.Errorf("Expected the completed task with its message, but had %+v", tasks)
+	}
+}
+
+func testCountTasks(t *testing.T, d queue.Driver) {
+	// Tasks are counted by name and state, without popping them
+	r, ok := d.(queue.TaskReader)
+	if !ok {
+		t.Skip("driver can't look up tasks")
+	}
+
+	for i, name := range []string{"testCountTasks", "testCountTasks", "testCountTasks", "testCountTasksOther"} {
+		if err := addTask(d, fmt.Sprintf("testCountTasks%d", i+1), name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// One task is done, another is waiting for a retry:
+	done, err := d.Pop(queue.PopOptions{Names: []string{"testCountTasks"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = d.Complete(done, "Done"); err != nil {
+		t.Fatal(err)
+	}
+
+	retry, err := d.Pop(queue.PopOptions{Names: []string{"testCountTasks"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = d.Retry(retry, "Try again", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		filter   queue.TaskFilter
+		expected []queue.TaskCount
+	}{
+		{"all", queue.TaskFilter{}, []queue.TaskCount{
+			{Name: "testCountTasks", State: queue.TaskDone, Count: 1},
+			{Name: "testCountTasks", State: queue.TaskReady, Count: 1},
+			{Name: "testCountTasks", State: queue.TaskRetry, Count: 1},
+			{Name: "testCountTasksOther", State: queue.TaskReady, Count: 1},
+		}},
+		{"by state", queue.TaskFilter{States: []queue.TaskState{queue.TaskReady}}, []queue.TaskCount{
+			{Name: "testCountTasks", State: queue.TaskReady, Count: 1},
+			{Name: "testCountTasksOther", State: queue.TaskReady, Count: 1},
+		}},
+		{"by name", queue.TaskFilter{Names: []string{"testCountTasksOther"}}, []queue.TaskCount{
+			{Name: "testCountTasksOther", State: queue.TaskReady, Count: 1},
+		}},
+		{"none", queue.TaskFilter{Names: []string{"testCountTasksMissing"}}, nil},
+	}
+
+	for _, tt := range tests {
+		counts, err := r.CountTasks(tt.filter)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+
+		if len(counts) != len(tt.expected) || (len(counts) > 0 && !reflect.DeepEqual(counts, tt.expected)) {
+			t.Errorf("%s: expected counts %+v, but had %+v", tt.name, tt.expected, counts)
+		}
+	}
+
+	if _, err = r.CountTasks(queue.TaskFilter{Limit: 1}); err == nil {
+		t.Error("Expected error counting tasks with a limit")
+	}
+}
+
+func testEditTasks(t *testing.T, d queue.Driver) {
+	// Pending tasks can be cancelled and rescheduled, and finished tasks
+	// requeued, without popping them.  Tasks being performed are left alone
+	e, ok := d.(queue.TaskEditor)
+	if !ok {
+		t.Skip("driver can't change tasks")
+	}
+
+	var ids []string
+	for i, name := range []string{"testEditTasks", "testEditTasks", "testEditTasksHeld"} {
+		id, err := d.AddTask(queue.TaskInit{
+			Key:       fmt.Sprintf("testEditTasks%d", i+1),
+			Name:      name,
+			DoAfter:   time.Now().Add(-time.Second),
+			CreatedBy: "test_runner",
+			Data:      map[string]interface{}{"order": i + 1},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	held, err := d.Pop(queue.PopOptions{Names: []string{"testEditTasksHeld"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Cleanup(held)
+
+	expectChanged := func(name string, n int64, err error, expected int64) {
+		t.Helper()
+
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if n != expected {
+			t.Errorf("%s: expected %d tasks to change, but had %d", name, expected, n)
+		}
+	}
+
+	n, err := e.CancelTasks(queue.TaskFilter{Keys: []string{"testEditTasks1"}}, "No longer wanted")
+	expectChanged("cancel by key", n, err, 1)
+
+	n, err = e.CancelTasks(queue.TaskFilter{Names: []string{"testEditTasksHeld"}}, "No longer wanted")
+	expectChanged("cancel held task", n, err, 0)
+
+	n, err = e.RescheduleTasks(queue.TaskFilter{IDs: []string{ids[1]}}, time.Now().Add(time.Hour))
+	expectChanged("reschedule by ID", n, err, 1)
+
+	n, err = e.RequeueTasks(queue.TaskFilter{IDs: []string{ids[1]}}, time.Now())
+	expectChanged("requeue pending task", n, err, 0)
+
+	if _, err = d.Pop(queue.PopOptions{Names: []string{"testEditTasks"}}); err != queue.ErrNoTasks {
+		t.Fatalf("Expected ErrNoTasks with one task cancelled and the other rescheduled, but had %v", err)
+	}
+
+	if r, ok := d.(queue.TaskReader); ok {
+		task, err := r.GetTask(ids[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if task.State != queue.TaskCancelled || task.LastAttemptMessage != "No longer wanted" {
+			t.Errorf("Expected cancelled task with its message, but had %+v", task)
+		}
+	}
+
+	n, err = e.RequeueTasks(queue.TaskFilter{Names: []string{"testEditTasks"}}, time.Now().Add(-time.Second))
+	expectChanged("requeue by name", n, err, 1)
+
+	task, err := d.Pop(queue.PopOptions{Names: []string{"testEditTasks"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if task.ID() != ids[0] || task.Attempts != 1 {
+		t.Errorf("Expected requeued task %s with attempts reset, but had %s with %d attempts", ids[0], task.ID(), task.Attempts)
+	}
+
+	if err = d.Complete(task, "Done"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = e.CancelTasks(queue.TaskFilter{Limit: 1}, "No longer wanted"); err == nil {
+		t.Error("Expected error changing tasks with a limit")
+	}
+
+	// The held task can still be finished by its holder:
+	if err = d.Complete(held, "Done"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testPurgeTasks(t *testing.T, d queue.Driver) {
+	// Done and cancelled tasks can be deleted, leaving pending tasks and those
+	// being performed
+	e, ok := d.(queue.TaskEditor)
+	if !ok {
+		t.Skip("driver can't change tasks")
+	}
+
+	// Tasks are added one at a time, so that each pop finds the one just added:
+	add := func(key string, name string) {
+		t.Helper()
+
+		if err := addTask(d, key, name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pop := func(name string) queue.Task {
+		t.Helper()
+
+		task, err := d.Pop(queue.PopOptions{Names: []string{name}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return task
+	}
+
+	expectPurged := func(name string, filter queue.TaskFilter, expected int64, length int64) {
+		t.Helper()
+
+		n, err := e.PurgeTasks(filter)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if n != expected {
+			t.Errorf("%s: expected %d tasks purged, but had %d", name, expected, n)
+		}
+
+		if err = checkLength(d, length); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+
+	add("testPurgeTasks1", "testPurgeTasks")
+	if err := d.Complete(pop("testPurgeTasks"), "Done"); err != nil {
+		t.Fatal(err)
+	}
+
+	add("testPurgeTasks2", "testPurgeTasks")
+	held := pop("testPurgeTasks")
+	defer d.Cleanup(held)
+
+	add("testPurgeTasks3", "testPurgeTasks")
+	if n, err := e.CancelTasks(queue.TaskFilter{Keys: []string{"testPurgeTasks3"}}, "No longer wanted"); err != nil || n != 1 {
+		t.Fatalf("Expected 1 task cancelled, but had %d, %v", n, err)
+	}
+
+	add("testPurgeTasks4", "testPurgeTasks")
+
+	add("testPurgeTasks5", "testPurgeTasksOther")
+	if err := d.Complete(pop("testPurgeTasksOther"), "Done"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.PurgeTasks(queue.TaskFilter{Limit: 1}); err == nil {
+		t.Error("Expected error purging tasks with a limit")
+	}
+
+	expectPurged("purge by name", queue.TaskFilter{Names: []string{"testPurgeTasks"}}, 2, 3)
+	expectPurged("purge the rest", queue.TaskFilter{}, 1, 2)
+
+	// Once finished, the held task can be purged too:
+	if err := d.Complete(held, "Done"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectPurged("purge held task once done", queue.TaskFilter{}, 1, 1)
+}
+
+func testMetadata(t *testing.T, d queue.Driver) {
+	// Metadata is kept alongside the data, and handed back when popped
+	metadata := map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+
+	id, err := d.AddTask(queue.TaskInit{Key: "testMetadata1", Name: "testMetadata", DoAfter: time.Now(), CreatedBy: "test_runner", Metadata: metadata})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = addTask(d, "testMetadata2", "testMetadata", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if reader, ok := d.(queue.TaskReader); ok {
+		task, err := reader.GetTask(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(task.Metadata, metadata) {
+			t.Errorf("Expected GetTask to return metadata %v, but had %v", metadata, task.Metadata)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		task, err := d.Pop(queue.PopOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch task.Key {
+		case "testMetadata1":
+			if !reflect.DeepEqual(task.Metadata, metadata) {
+				t.Errorf("Expected popped task to have metadata %v, but had %v", metadata, task.Metadata)
+			}
+		default:
+			if len(task.Metadata) > 0 {
+				t.Errorf("Expected task added without metadata to have none, but had %v", task.Metadata)
+			}
+		}
+
+		if err = d.Complete(task, "Done"); err != nil {
+			t.Fatal(err)
+		}
+
+		d.Cleanup(task)
+	}
+}
+
+func testLease(t *testing.T, d queue.Driver) {
+	// Popped tasks are leased for as long as asked, and the lease can be
+	// extended until the task is finished
+	if err := addTask(d, "testLease", "testLease", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	popped := time.Now()
+	task, err := d.Pop(queue.PopOptions{Lease: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Cleanup(task)
+
+	if task.DoAfter.Before(popped.Add(50*time.Second)) || task.DoAfter.After(time.Now().Add(70*time.Second)) {
+		t.Errorf("Expected the task (%s) to be leased for a minute, but was leased until %s", d.Name(), task.DoAfter)
+	}
+
+	extender, ok := d.(queue.LeaseExtender)
+	if !ok {
+		return
+	}
+
+	until, err := extender.ExtendLease(task, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if until.Before(time.Now().Add(50 * time.Minute)) {
+		t.Errorf("Expected the lease (%s) to be extended by an hour, but was extended until %s", d.Name(), until)
+	}
+
+	if err = d.Complete(task, "Done"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = extender.ExtendLease(task, time.Hour); err == nil {
+		t.Errorf("Expected an error extending the lease (%s) on a finished task", d.Name())
+	}
+}
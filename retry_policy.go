@@ -0,0 +1,113 @@
+package queue
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicy Decides how long to wait before trying a task again when its
+// action returns TaskResultRetryFailure
+type RetryPolicy interface {
+	// Delay Returns how long to wait after the given attempt failed.  Attempts
+	// are numbered from 1
+	Delay(attempt int) time.Duration
+}
+
+// FixedRetryPolicy Waits the same amount of time after every failure
+func FixedRetryPolicy(delay time.Duration) RetryPolicy {
+	return fixedRetryPolicy{delay: delay}
+}
+
+type fixedRetryPolicy struct {
+	delay time.Duration
+}
+
+func (p fixedRetryPolicy) Delay(attempt int) time.Duration {
+	return p.delay
+}
+
+// LinearRetryPolicy Waits initial after the first failure, adding step for
+// each failure after that, up to max.  A max of 0 means no limit
+func LinearRetryPolicy(initial time.Duration, step time.Duration, max time.Duration) RetryPolicy {
+	return linearRetryPolicy{initial: initial, step: step, max: max}
+}
+
+type linearRetryPolicy struct {
+	initial time.Duration
+	step    time.Duration
+	max     time.Duration
+}
+
+func (p linearRetryPolicy) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	return capDelay(p.initial+time.Duration(attempt-1)*p.step, p.max)
+}
+
+// ExponentialRetryPolicy Waits initial after the first failure, doubling with
+// each failure after that, up to max.  A max of 0 means no limit.  jitter,
+// between 0 and 1, takes up to that fraction off each delay at random, so
+// that tasks which failed together aren't all retried together
+func ExponentialRetryPolicy(initial time.Duration, max time.Duration, jitter float64) RetryPolicy {
+	if jitter < 0 {
+		jitter = 0
+	}
+
+	if jitter > 1 {
+		jitter = 1
+	}
+
+	return exponentialRetryPolicy{initial: initial, max: max, jitter: jitter}
+}
+
+type exponentialRetryPolicy struct {
+	initial time.Duration
+	max     time.Duration
+	jitter  float64
+}
+
+func (p exponentialRetryPolicy) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	// Work in floats so that large attempt counts can't overflow:
+	delay := float64(p.initial) * math.Pow(2, float64(attempt-1))
+
+	d := time.Duration(math.MaxInt64)
+	if delay < math.MaxInt64 {
+		d = time.Duration(delay)
+	}
+
+	d = capDelay(d, p.max)
+
+	if p.jitter > 0 {
+		d -= time.Duration(float64(d) * p.jitter * jitterRand())
+	}
+
+	return d
+}
+
+// capDelay Limits delay to max, unless max is 0
+func capDelay(delay time.Duration, max time.Duration) time.Duration {
+	if max > 0 && delay > max {
+		return max
+	}
+
+	return delay
+}
+
+var jitterMX = sync.Mutex{}
+var jitterSource = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// jitterRand Returns a random number in [0, 1)
+func jitterRand() float64 {
+	jitterMX.Lock()
+	defer jitterMX.Unlock()
+
+	return jitterSource.Float64()
+}
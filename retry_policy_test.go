@@ -0,0 +1,44 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		expected []time.Duration // Delays for attempts 1, 2, 3...
+	}{
+		{"Fixed", FixedRetryPolicy(time.Minute), []time.Duration{time.Minute, time.Minute, time.Minute}},
+		{"Linear", LinearRetryPolicy(time.Minute, 30*time.Second, 2*time.Minute), []time.Duration{time.Minute, 90 * time.Second, 2 * time.Minute, 2 * time.Minute}},
+		{"Exponential", ExponentialRetryPolicy(time.Second, 5*time.Second, 0), []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}},
+		{"ExponentialUncapped", ExponentialRetryPolicy(time.Second, 0, 0), []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}},
+	}
+
+	for _, tt := range tests {
+		for i, expected := range tt.expected {
+			if d := tt.policy.Delay(i + 1); d != expected {
+				t.Errorf("%s: expected %s for attempt %d, but had %s", tt.name, expected, i+1, d)
+			}
+		}
+	}
+
+	// Large attempt counts must not overflow:
+	if d := ExponentialRetryPolicy(time.Second, time.Hour, 0).Delay(1000); d != time.Hour {
+		t.Errorf("expected delay to be capped at 1h, but had %s", d)
+	}
+}
+
+func TestExponentialRetryJitter(t *testing.T) {
+	p := ExponentialRetryPolicy(time.Second, time.Minute, 0.5)
+
+	for i := 0; i < 100; i++ {
+		d := p.Delay(3)
+
+		if d > 4*time.Second || d < 2*time.Second {
+			t.Fatalf("expected delay between 2s and 4s, but had %s", d)
+		}
+	}
+}
@@ -0,0 +1,955 @@
+package queue
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteDriver SQLite Driver, for single box deployments where running
+// PostgreSQL is overkill.  Uses the same table layout and task states as
+// PostgresDriver.  Times are stored as unix nanoseconds.
+//
+// SQLite has no row locks, so Pop() claims a task by marking it for retry in a
+// single statement, and a claim counter stops anyone but the current holder
+// from changing the task's state afterwards
+type SQLiteDriver struct {
+	tableName string
+	db        *sql.DB
+	hub       *notifyHub
+}
+
+// NewSQLiteDriver Returns a new SQLite driver.  dataSource is passed to the
+// go-sqlite3 driver, e.g., "file:queue.db", with a busy timeout of 5 seconds
+// added unless it sets _busy_timeout
+func NewSQLiteDriver(dataSource string, dbTable string) (*SQLiteDriver, error) {
+	var err error
+
+	s := &SQLiteDriver{
+		tableName: dbTable,
+		hub:       newNotifyHub(),
+	}
+
+	s.db, err = sql.Open("sqlite3", withBusyTimeout(dataSource))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows one writer at a time, so we serialise access within this
+	// process, and wait on other processes rather than failing straight away:
+	s.db.SetMaxOpenConns(1)
+
+	return s, nil
+}
+
+// withBusyTimeout Returns the data source with a busy timeout, unless it
+// already has one.  The timeout is set on each connection as it's opened, so
+// it isn't lost if database/sql replaces the connection
+func withBusyTimeout(dataSource string) string {
+	if strings.Contains(dataSource, "_busy_timeout=") || strings.Contains(dataSource, "_timeout=") {
+		return dataSource
+	}
+
+	if strings.Contains(dataSource, "?") {
+		return dataSource + "&_busy_timeout=5000"
+	}
+
+	return dataSource + "?_busy_timeout=5000"
+}
+
+// CreateTable Creates the queue table and the dead-letter table for failed
+// tasks, if they don't already exist, and adds any columns missing from
+// tables created by an earlier version
+func (s *SQLiteDriver) CreateTable() error {
+	_, err := s.db.Exec(`
+CREATE TABLE IF NOT EXISTS ` + s.tableName + ` (
+	` + s.primaryKey() + ` TEXT NOT NULL PRIMARY KEY,
+	data TEXT NOT NULL DEFAULT '{}',
+	task_key TEXT NOT NULL,
+	task_name TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	created_by TEXT NOT NULL,
+	last_attempted INTEGER NOT NULL,
+	state TEXT NOT NULL,
+	last_attempt_message TEXT NOT NULL,
+	do_after INTEGER NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	idempotency_key TEXT,
+	metadata TEXT NOT NULL DEFAULT '{}',
+	history TEXT NOT NULL DEFAULT '[]',
+	claim INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS idx_` + s.tableName + `_state ON ` + s.tableName + ` (state, do_after, last_attempted);
+CREATE TABLE IF NOT EXISTS ` + s.deadTableName() + ` (
+	` + s.primaryKey() + ` TEXT NOT NULL PRIMARY KEY,
+	data TEXT NOT NULL DEFAULT '{}',
+	task_key TEXT NOT NULL,
+	task_name TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	created_by TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_attempt_message TEXT NOT NULL,
+	failed_at INTEGER NOT NULL,
+	idempotency_key TEXT,
+	metadata TEXT NOT NULL DEFAULT '{}',
+	history TEXT NOT NULL DEFAULT '[]',
+	claim INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS idx_` + s.deadTableName() + `_failed_at ON ` + s.deadTableName() + ` (failed_at)`)
+
+	if err != nil {
+		return err
+	}
+
+	err = s.addMissingColumns(s.tableName, map[string]string{
+		"attempts":        "INTEGER NOT NULL DEFAULT 0",
+		"idempotency_key": "TEXT",
+		"metadata":        "TEXT NOT NULL DEFAULT '{}'",
+		"history":         "TEXT NOT NULL DEFAULT '[]'",
+	})
+
+	if err != nil {
+		return err
+	}
+
+	err = s.addMissingColumns(s.deadTableName(), map[string]string{
+		"idempotency_key": "TEXT",
+		"metadata":        "TEXT NOT NULL DEFAULT '{}'",
+		"history":         "TEXT NOT NULL DEFAULT '[]'",
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Indexes on columns that may have just been added:
+	_, err = s.db.Exec(`
+CREATE INDEX IF NOT EXISTS idx_` + s.tableName + `_key ON ` + s.tableName + ` (task_key, task_name);
+CREATE INDEX IF NOT EXISTS idx_` + s.tableName + `_idempotency_key ON ` + s.tableName + ` (idempotency_key) WHERE idempotency_key IS NOT NULL`)
+
+	return err
+}
+
+// addMissingColumns Adds any of the given columns that aren't in the table,
+// for tables created by earlier versions of CreateTable
+func (s *SQLiteDriver) addMissingColumns(table string, columns map[string]string) error {
+	for name, definition := range columns {
+		var count int
+
+		err := s.db.QueryRow("SELECT count(*) FROM pragma_table_info($1) WHERE name = $2", table, name).Scan(&count)
+
+		if err != nil {
+			return err
+		}
+
+		if count > 0 {
+			continue
+		}
+
+		_, err = s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, name, definition))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLiteDriver) primaryKey() string {
+	return s.tableName + "_id"
+}
+
+// deadTableName The table that failed tasks are moved to
+func (s *SQLiteDriver) deadTableName() string {
+	return s.tableName + "_dead"
+}
+
+func (s *SQLiteDriver) taskQueryColumns() string {
+	return s.primaryKey() + ", task_key, task_name, created_at, created_by, data, state, attempts, metadata, claim"
+}
+
+// placeholders Returns n comma separated placeholders, numbered from start
+func (s *SQLiteDriver) placeholders(start int, n int) string {
+	p := make([]string, n)
+	for i := range p {
+		p[i] = fmt.Sprintf("$%d", start+i)
+	}
+
+	return strings.Join(p, ", ")
+}
+
+// Clear Removes all entries from the queue and the dead-letter table.  Be
+// careful.  Generally you should cancel entries rather than delete.
+func (s *SQLiteDriver) Clear() error {
+	_, err := s.db.Exec(fmt.Sprintf("DELETE FROM %s; DELETE FROM %s", s.tableName, s.deadTableName()))
+
+	return err
+}
+
+// Name Returns the name of the driver
+func (s *SQLiteDriver) Name() string {
+	return "SQLiteDriver"
+}
+
+// AddTask Adds a task to the queue, returning its ID.  If the task matches
+// one already there as per taskData.Unique, the ID of the match is returned
+func (s *SQLiteDriver) AddTask(taskData TaskInit) (string, error) {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	id, added, err := s.addTask(tx, taskData)
+
+	if err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+
+	if added {
+		s.hub.publish(taskData.Name)
+	}
+
+	return id, nil
+}
+
+// AddTaskTx Adds a task as part of the caller's transaction, on a connection
+// of the caller's own to the same database file, so that it is only added if
+// the transaction is committed.  Unlike AddTask, waiting handlers aren't
+// notified, as the driver can't tell when the caller commits, so the task
+// waits for the handler's next poll
+func (s *SQLiteDriver) AddTaskTx(tx *sql.Tx, taskData TaskInit) (string, error) {
+	if tx == nil {
+		return "", fmt.Errorf("cannot have nil transaction")
+	}
+
+	id, _, err := s.addTask(tx, taskData)
+
+	return id, err
+}
+
+// addTask Returns the task's ID, and whether the task was added rather than
+// matching one already in the queue, in which case the ID is the match's
+func (s *SQLiteDriver) addTask(q sqlQuerier, taskData TaskInit) (string, bool, error) {
+	if err := checkUnique(taskData); err != nil {
+		return "", false, err
+	}
+
+	// Store data as json:
+	dataString, err := json.Marshal(taskData.Data)
+
+	if err != nil {
+		return "", false, err
+	}
+
+	metadata, err := marshalMetadata(taskData.Metadata)
+
+	if err != nil {
+		return "", false, err
+	}
+
+	id, err := uuid.NewV4()
+
+	if err != nil {
+		return "", false, err
+	}
+
+	created := time.Now().UnixNano()
+	args := []interface{}{
+		id.String(),
+		string(dataString),
+		string(TaskReady),
+		taskData.Key,
+		taskData.Name,
+		created,
+		created,
+		taskData.DoAfter.UnixNano(),
+		taskData.CreatedBy,
+		sql.NullString{String: taskData.IdempotencyKey, Valid: len(taskData.IdempotencyKey) > 0},
+		metadata,
+	}
+
+	var unique string
+	var cutoff int64
+	if taskData.Unique != UniqueNone {
+		cutoff = created - int64(taskData.UniqueWithin)
+
+		if set, value := conflictUpdate(taskData, string(dataString), taskData.DoAfter.UnixNano()); len(set) > 0 {
+			condition, conditionArgs := uniqueCondition(taskData, 2, cutoff)
+			_, err = q.Exec("UPDATE "+s.tableName+" SET "+set+" = $1 WHERE "+condition+" AND state = '"+string(TaskReady)+"'", append([]interface{}{value}, conditionArgs...)...)
+
+			if err != nil {
+				return "", false, err
+			}
+		}
+
+		condition, conditionArgs := uniqueCondition(taskData, len(args)+1, cutoff)
+		unique = "WHERE NOT EXISTS (SELECT 1 FROM " + s.tableName + " WHERE " + condition + ")"
+		args = append(args, conditionArgs...)
+	}
+
+	res, err := q.Exec(`
+INSERT INTO `+s.tableName+`
+	(`+s.primaryKey()+`, data, state, task_key, task_name, created_at, last_attempted, last_attempt_message, do_after, created_by, idempotency_key, metadata)
+SELECT $1, $2, $3, $4, $5, $6, $7, 'Created', $8, $9, $10, $11
+`+unique, args...)
+
+	if err != nil {
+		return "", false, err
+	}
+
+	added, err := res.RowsAffected()
+
+	if err != nil || added > 0 {
+		return id.String(), added > 0, err
+	}
+
+	// Matched a task already in the queue, so return its ID instead:
+	var match string
+	condition, conditionArgs := uniqueCondition(taskData, 1, cutoff)
+	err = q.QueryRow("SELECT "+s.primaryKey()+" FROM "+s.tableName+" WHERE "+condition+" ORDER BY created_at DESC LIMIT 1", conditionArgs...).Scan(&match)
+
+	return match, false, err
+}
+
+// Subscribe Returns a channel receiving the names of tasks as they're added.
+// Only tasks added through this driver are announced, so other processes
+// sharing the database file are only seen when polling
+func (s *SQLiteDriver) Subscribe() (<-chan string, func(), error) {
+	ch, stop := s.hub.subscribe()
+
+	return ch, stop, nil
+}
+
+// Cleanup Nothing to clean up, since Pop() doesn't hold a transaction open.
+// A task that was popped but not otherwise finished will be picked up again
+// once stale
+func (s *SQLiteDriver) Cleanup(task Task) {
+}
+
+// Pop Claims the oldest task that is ready.  The claim is made in a single
+// statement, so two callers can never be handed the same task.  If the task
+// is ready, the newest ready task with the same key and name is claimed in
+// its place, and the others are cancelled in the same transaction
+func (s *SQLiteDriver) Pop(opts PopOptions) (Task, error) {
+	var task Task
+	var data, metadata string
+	var created int64
+	var claim int64
+
+	now := time.Now()
+	reclaim := now.Add(opts.lease())
+	args := []interface{}{now.UnixNano(), reclaim.UnixNano()}
+
+	var names string
+	if len(opts.ExcludeNames) > 0 {
+		names += "AND task_name NOT IN (" + s.placeholders(len(args)+1, len(opts.ExcludeNames)) + ")\n"
+		for _, name := range opts.ExcludeNames {
+			args = append(args, name)
+		}
+	}
+
+	if len(opts.Names) > 0 {
+		names += "AND task_name IN (" + s.placeholders(len(args)+1, len(opts.Names)) + ")\n"
+		for _, name := range opts.Names {
+			args = append(args, name)
+		}
+	}
+
+	query := `
+UPDATE ` + s.tableName + ` SET last_attempted = $1, last_attempt_message = 'Attempting', state = '` + string(TaskRetry) + `', do_after = $2, attempts = attempts + 1, claim = claim + 1
+WHERE ` + s.primaryKey() + ` = (
+	SELECT COALESCE((
+		SELECT n.` + s.primaryKey() + `
+		FROM ` + s.tableName + ` n
+		WHERE o.state = '` + string(TaskReady) + `' AND n.state = '` + string(TaskReady) + `'
+		AND n.task_key = o.task_key AND n.task_name = o.task_name AND n.do_after < $1
+		ORDER BY n.created_at DESC, n.rowid DESC
+		LIMIT 1
+	), o.` + s.primaryKey() + `)
+	FROM ` + s.tableName + ` o
+	WHERE state IN ('` + string(TaskReady) + `', '` + string(TaskInProgress) + `', '` + string(TaskRetry) + `')
+	AND do_after < $1
+	` + names + `
+	ORDER BY last_attempted ASC, rowid ASC
+	LIMIT 1
+)
+RETURNING ` + s.taskQueryColumns()
+
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return task, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(query, args...).Scan(&task.id, &task.Key, &task.Name, &created, &task.CreatedBy, &data, &task.State, &task.Attempts, &metadata, &claim)
+
+	if err == sql.ErrNoRows {
+		return task, ErrNoTasks
+	}
+
+	if err != nil {
+		return task, err
+	}
+
+	// Older ready tasks for the same key and name are superseded by this one:
+	_, err = tx.Exec(`
+UPDATE `+s.tableName+` SET state = $1, last_attempted = $2, last_attempt_message = $3, claim = claim + 1
+WHERE state = $4 AND task_key = $5 AND task_name = $6 AND do_after < $2 AND `+s.primaryKey()+` <> $7`,
+		string(TaskCancelled), now.UnixNano(), "Superseded by "+task.id, string(TaskReady), task.Key, task.Name, task.id)
+
+	if err != nil {
+		return task, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return task, err
+	}
+
+	task.Created = time.Unix(0, created)
+	task.DoAfter = reclaim
+	task.driverNote = claim
+	task.RawData = []byte(data)
+
+	// On failure the task is left marked for retry, as per the query above:
+	if task.Metadata, err = unmarshalMetadata([]byte(metadata)); err != nil {
+		return task, err
+	}
+
+	err = json.Unmarshal([]byte(data), &task.Data)
+
+	return task, err
+}
+
+// GetQueueLength Returns the number of tasks in the queue, in any state
+func (s *SQLiteDriver) GetQueueLength() (int64, error) {
+	var length int64
+
+	err := s.db.QueryRow("SELECT count(*) FROM " + s.tableName).Scan(&length)
+
+	return length, err
+}
+
+// GetTaskCount Returns the number of active tasks with the given name
+func (s *SQLiteDriver) GetTaskCount(taskName string) (int64, error) {
+	var length int64
+
+	err := s.db.QueryRow("SELECT count(*) FROM "+s.tableName+" WHERE task_name = $1 AND state != 'CANCELLED' AND state != 'DONE' AND state != 'FAILED'", taskName).Scan(&length)
+
+	return length, err
+}
+
+// Complete Marks a task as complete
+func (s *SQLiteDriver) Complete(task Task, message string) error {
+	return s.setTaskState(task, TaskDone, message)
+}
+
+// Cancel Marks a task as cancelled
+func (s *SQLiteDriver) Cancel(task Task, message string) error {
+	return s.setTaskState(task, TaskCancelled, message)
+}
+
+// Fail Moves a task to the dead-letter table
+func (s *SQLiteDriver) Fail(task Task, message string) error {
+	claim, err := s.heldClaim(task)
+
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	history, err := s.addHistory(tx, task, claim, now, message)
+
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(`
+INSERT INTO `+s.deadTableName()+`
+	(`+s.primaryKey()+`, data, task_key, task_name, created_at, created_by, attempts, last_attempt_message, failed_at, idempotency_key, metadata, history, claim)
+SELECT `+s.primaryKey()+`, data, task_key, task_name, created_at, created_by, attempts, $1, $2, idempotency_key, metadata, $3, claim
+FROM `+s.tableName+`
+WHERE `+s.primaryKey()+` = $4 AND claim = $5`, message, now.UnixNano(), history, task.id, claim)
+
+	if err = s.checkHeld(task, res, err); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM "+s.tableName+" WHERE "+s.primaryKey()+" = $1", task.id)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Retry Marks a task as in need of a retry once doAfter has passed
+func (s *SQLiteDriver) Retry(task Task, message string, doAfter time.Time) error {
+	claim, err := s.heldClaim(task)
+
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	history, err := s.addHistory(tx, task, claim, now, message)
+
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec("UPDATE "+s.tableName+" SET state=$1, last_attempted=$2, last_attempt_message=$3, do_after=$4, history=$5 WHERE "+s.primaryKey()+" = $6 AND claim = $7",
+		string(TaskRetry), now.UnixNano(), message, doAfter.UnixNano(), history, task.id, claim)
+
+	if err = s.checkHeld(task, res, err); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// addHistory Returns the task's history with the attempt that's finishing
+// appended, provided the task is still held by the caller
+func (s *SQLiteDriver) addHistory(tx *sql.Tx, task Task, claim int64, at time.Time, message string) (string, error) {
+	var history string
+	var attempts int
+
+	err := tx.QueryRow("SELECT history, attempts FROM "+s.tableName+" WHERE "+s.primaryKey()+" = $1 AND claim = $2", task.id, claim).Scan(&history, &attempts)
+
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("task with ID %s is no longer held by this caller", task.id)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	b, err := appendAttempt([]byte(history), TaskAttempt{Attempt: attempts, At: at, Message: message})
+
+	return string(b), err
+}
+
+// ExtendLease Extends the lease on a task that is still held, as per
+// LeaseExtender.  The task is held as long as it's marked as attempting and
+// hasn't been claimed since
+func (s *SQLiteDriver) ExtendLease(task Task, lease time.Duration) (time.Time, error) {
+	claim, err := s.heldClaim(task)
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	until := time.Now().Add(lease)
+	res, err := s.db.Exec("UPDATE "+s.tableName+" SET do_after = $1 WHERE "+s.primaryKey()+" = $2 AND claim = $3 AND state = $4 AND last_attempt_message = 'Attempting'", until.UnixNano(), task.id, claim, string(TaskRetry))
+
+	if err = s.checkHeld(task, res, err); err != nil {
+		return time.Time{}, err
+	}
+
+	return until, nil
+}
+
+func (s *SQLiteDriver) setTaskState(task Task, state TaskState, message string) error {
+	return s.finishTask(task, "state=$1, last_attempted=$2, last_attempt_message=$3", string(state), time.Now().UnixNano(), message)
+}
+
+// finishTask Updates the task with the given SET clause, provided the task is
+// still held by the caller
+func (s *SQLiteDriver) finishTask(task Task, set string, args ...interface{}) error {
+	claim, err := s.heldClaim(task)
+
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s = $%d AND claim = $%d", s.tableName, set, s.primaryKey(), len(args)+1, len(args)+2)
+	res, err := s.db.Exec(query, append(args, task.id, claim)...)
+
+	return s.checkHeld(task, res, err)
+}
+
+// heldClaim Returns the claim that Pop() made on the task
+func (s *SQLiteDriver) heldClaim(task Task) (int64, error) {
+	claim, ok := task.driverNote.(int64)
+
+	if !ok {
+		return 0, fmt.Errorf("task with ID %s was not popped by this driver", task.id)
+	}
+
+	return claim, nil
+}
+
+// checkHeld Checks that a statement restricted to the caller's claim found the
+// task
+func (s *SQLiteDriver) checkHeld(task Task, res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("task with ID %s is no longer held by this caller", task.id)
+	}
+
+	return nil
+}
+
+func (s *SQLiteDriver) taskDetailColumns() string {
+	return s.primaryKey() + ", task_key, task_name, created_at, created_by, data, state, attempts, do_after, last_attempted, last_attempt_message, metadata"
+}
+
+// GetTask Returns the task in the queue with the given ID
+func (s *SQLiteDriver) GetTask(id string) (Task, error) {
+	task, err := s.scanTaskDetail(s.db.QueryRow("SELECT "+s.taskDetailColumns()+" FROM "+s.tableName+" WHERE "+s.primaryKey()+" = $1", id))
+
+	if err == sql.ErrNoRows {
+		return task, ErrTaskNotFound
+	}
+
+	return task, err
+}
+
+// ListTasks Returns the tasks in the queue selected by filter, most recently
+// created first
+func (s *SQLiteDriver) ListTasks(filter TaskFilter) ([]Task, error) {
+	condition, args := filter.condition(1, s.primaryKey(), func(t time.Time) interface{} { return t.UnixNano() })
+	page, pageArgs := filter.page(len(args)+1, "-1")
+
+	rows, err := s.db.Query("SELECT "+s.taskDetailColumns()+" FROM "+s.tableName+" WHERE "+condition+" ORDER BY created_at DESC, rowid DESC"+page, append(args, pageArgs...)...)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []Task
+	for rows.Next() {
+		task, err := s.scanTaskDetail(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tasks = append(tasks, task)
+	}
+
+	return tasks, rows.Err()
+}
+
+func (s *SQLiteDriver) scanTaskDetail(scanner interface{ Scan(...interface{}) error }) (Task, error) {
+	var task Task
+	var data, metadata string
+	var created, doAfter, lastAttempted int64
+
+	err := scanner.Scan(&task.id, &task.Key, &task.Name, &created, &task.CreatedBy, &data, &task.State, &task.Attempts, &doAfter, &lastAttempted, &task.LastAttemptMessage, &metadata)
+
+	if err != nil {
+		return task, err
+	}
+
+	if task.Metadata, err = unmarshalMetadata([]byte(metadata)); err != nil {
+		return task, err
+	}
+
+	task.Created = time.Unix(0, created)
+	task.DoAfter = time.Unix(0, doAfter)
+	task.LastAttempted = time.Unix(0, lastAttempted)
+	task.RawData = []byte(data)
+
+	err = json.Unmarshal(task.RawData, &task.Data)
+
+	return task, err
+}
+
+// CountTasks Returns how many of the tasks selected by filter there are for
+// each name and state
+func (s *SQLiteDriver) CountTasks(filter TaskFilter) ([]TaskCount, error) {
+	if err := filter.checkUnpaged(); err != nil {
+		return nil, err
+	}
+
+	condition, args := filter.condition(1, s.primaryKey(), func(t time.Time) interface{} { return t.UnixNano() })
+	rows, err := s.db.Query("SELECT task_name, state, count(*) FROM "+s.tableName+" WHERE "+condition+" GROUP BY task_name, state ORDER BY task_name, state", args...)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []TaskCount{}
+	for rows.Next() {
+		var c TaskCount
+
+		if err = rows.Scan(&c.Name, &c.State, &c.Count); err != nil {
+			return nil, err
+		}
+
+		counts = append(counts, c)
+	}
+
+	return counts, rows.Err()
+}
+
+// CancelTasks Cancels the pending tasks selected by filter, other than those
+// popped and still being performed
+func (s *SQLiteDriver) CancelTasks(filter TaskFilter, message string) (int64, error) {
+	return s.editTasks(filter, pendingStates, "state = $1, last_attempted = $2, last_attempt_message = $3", string(TaskCancelled), time.Now().UnixNano(), message)
+}
+
+// RescheduleTasks Sets do_after for the pending tasks selected by filter,
+// other than those popped and still being performed
+func (s *SQLiteDriver) RescheduleTasks(filter TaskFilter, doAfter time.Time) (int64, error) {
+	return s.editTasks(filter, pendingStates, "do_after = $1", doAfter.UnixNano())
+}
+
+// RequeueTasks Puts the failed and cancelled tasks selected by filter back in
+// the queue
+func (s *SQLiteDriver) RequeueTasks(filter TaskFilter, doAfter time.Time) (int64, error) {
+	return s.editTasks(filter, finishedStates, "state = $1, last_attempted = $2, last_attempt_message = 'Requeued', do_after = $3, attempts = 0", string(TaskReady), time.Now().UnixNano(), doAfter.UnixNano())
+}
+
+// PurgeTasks Deletes the finished tasks selected by filter
+func (s *SQLiteDriver) PurgeTasks(filter TaskFilter) (int64, error) {
+	if err := filter.checkUnpaged(); err != nil {
+		return 0, err
+	}
+
+	var args []interface{}
+	for _, state := range purgeableStates {
+		args = append(args, string(state))
+	}
+
+	condition, conditionArgs := filter.condition(len(args)+1, s.primaryKey(), func(t time.Time) interface{} { return t.UnixNano() })
+	res, err := s.db.Exec("DELETE FROM "+s.tableName+" WHERE state IN ("+s.placeholders(1, len(args))+") AND "+condition, append(args, conditionArgs...)...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// editTasks Applies set, which takes setArgs from $1, to the tasks in one of
+// the given states that are selected by filter, announcing their names.  There
+// are no row locks to skip tasks being performed, so a task is taken to be
+// held if it's marked as attempting and the claim made by Pop hasn't expired.
+// The claim is moved on, so that a stale holder can no longer finish the task
+func (s *SQLiteDriver) editTasks(filter TaskFilter, states []TaskState, set string, setArgs ...interface{}) (int64, error) {
+	if err := filter.checkUnpaged(); err != nil {
+		return 0, err
+	}
+
+	args := setArgs
+	for _, state := range states {
+		args = append(args, string(state))
+	}
+	stateList := s.placeholders(len(setArgs)+1, len(states))
+
+	args = append(args, time.Now().UnixNano())
+	held := fmt.Sprintf("state = '%s' AND last_attempt_message = 'Attempting' AND do_after > $%d", TaskRetry, len(args))
+
+	condition, conditionArgs := filter.condition(len(args)+1, s.primaryKey(), func(t time.Time) interface{} { return t.UnixNano() })
+	args = append(args, conditionArgs...)
+
+	rows, err := s.db.Query("UPDATE "+s.tableName+" SET "+set+", claim = claim + 1 WHERE state IN ("+stateList+") AND NOT ("+held+") AND "+condition+" RETURNING task_name", args...)
+
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var count int64
+	names := make(map[string]bool)
+	for rows.Next() {
+		var name string
+
+		if err = rows.Scan(&name); err != nil {
+			return count, err
+		}
+
+		names[name] = true
+		count++
+	}
+
+	if err = rows.Err(); err != nil {
+		return count, err
+	}
+
+	for name := range names {
+		s.hub.publish(name)
+	}
+
+	return count, nil
+}
+
+func (s *SQLiteDriver) deadQueryColumns() string {
+	return s.primaryKey() + ", task_key, task_name, created_at, created_by, data, attempts, last_attempt_message, failed_at, metadata, history"
+}
+
+// ListDeadTasks Returns failed tasks, most recently failed first
+func (s *SQLiteDriver) ListDeadTasks(limit int, offset int) ([]DeadTask, error) {
+	if err := checkDeadPage(limit, offset); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query("SELECT "+s.deadQueryColumns()+" FROM "+s.deadTableName()+" ORDER BY failed_at DESC, rowid DESC LIMIT $1 OFFSET $2", limit, offset)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []DeadTask
+	for rows.Next() {
+		task, err := s.scanDeadTask(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tasks = append(tasks, task)
+	}
+
+	return tasks, rows.Err()
+}
+
+// GetDeadTask Returns the failed task with the given ID
+func (s *SQLiteDriver) GetDeadTask(id string) (DeadTask, error) {
+	task, err := s.scanDeadTask(s.db.QueryRow("SELECT "+s.deadQueryColumns()+" FROM "+s.deadTableName()+" WHERE "+s.primaryKey()+" = $1", id))
+
+	if err == sql.ErrNoRows {
+		return task, ErrTaskNotFound
+	}
+
+	return task, err
+}
+
+// RequeueDeadTask Moves a failed task back into the queue
+func (s *SQLiteDriver) RequeueDeadTask(id string, doAfter time.Time) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var name string
+	err = tx.QueryRow(`
+INSERT INTO `+s.tableName+`
+	(`+s.primaryKey()+`, data, state, task_key, task_name, created_at, created_by, last_attempted, last_attempt_message, do_after, attempts, idempotency_key, metadata, history, claim)
+SELECT `+s.primaryKey()+`, data, $1, task_key, task_name, created_at, created_by, $2, 'Requeued', $3, 0, idempotency_key, metadata, history, claim
+FROM `+s.deadTableName()+`
+WHERE `+s.primaryKey()+` = $4
+RETURNING task_name`, string(TaskReady), time.Now().UnixNano(), doAfter.UnixNano(), id).Scan(&name)
+
+	if err == sql.ErrNoRows {
+		return ErrTaskNotFound
+	}
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM "+s.deadTableName()+" WHERE "+s.primaryKey()+" = $1", id)
+
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	s.hub.publish(name)
+
+	return nil
+}
+
+// PurgeDeadTask Deletes a failed task
+func (s *SQLiteDriver) PurgeDeadTask(id string) error {
+	res, err := s.db.Exec("DELETE FROM "+s.deadTableName()+" WHERE "+s.primaryKey()+" = $1", id)
+
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+
+	if err == nil && n == 0 {
+		err = ErrTaskNotFound
+	}
+
+	return err
+}
+
+// PurgeDeadTasks Deletes tasks that failed before the given time
+func (s *SQLiteDriver) PurgeDeadTasks(failedBefore time.Time) (int64, error) {
+	res, err := s.db.Exec("DELETE FROM "+s.deadTableName()+" WHERE failed_at < $1", failedBefore.UnixNano())
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func (s *SQLiteDriver) scanDeadTask(scanner interface{ Scan(...interface{}) error }) (DeadTask, error) {
+	var task DeadTask
+	var data, metadata, history string
+	var created, failed int64
+
+	err := scanner.Scan(&task.ID, &task.Key, &task.Name, &created, &task.CreatedBy, &data, &task.Attempts, &task.Error, &failed, &metadata, &history)
+
+	if err != nil {
+		return task, err
+	}
+
+	task.Created = time.Unix(0, created)
+	task.FailedAt = time.Unix(0, failed)
+	task.RawData = []byte(data)
+
+	if task.Metadata, err = unmarshalMetadata([]byte(metadata)); err != nil {
+		return task, err
+	}
+
+	if task.History, err = unmarshalHistory([]byte(history)); err != nil {
+		return task, err
+	}
+
+	err = json.Unmarshal(task.RawData, &task.Data)
+
+	return task, err
+}
@@ -0,0 +1,44 @@
+package queue
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteBusyTimeout(t *testing.T) {
+	// Each connection waits on other processes holding the database, even
+	// one opened to replace a connection that went bad
+	file := "file:" + filepath.Join(t.TempDir(), "queue.db")
+
+	tests := []struct {
+		dataSource string
+		expected   int
+	}{
+		{file, 5000},
+		{file + "?cache=private", 5000},
+		{file + "?_busy_timeout=100", 100},
+	}
+
+	for _, tt := range tests {
+		s, err := NewSQLiteDriver(tt.dataSource, "message_queue")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Replace the connection, as database/sql does after ErrBadConn:
+		s.db.SetMaxIdleConns(0)
+
+		for i := 0; i < 2; i++ {
+			var timeout int
+			if err = s.db.QueryRow("PRAGMA busy_timeout").Scan(&timeout); err != nil {
+				t.Fatal(err)
+			}
+
+			if timeout != tt.expected {
+				t.Errorf("%s: expected a busy timeout of %d on connection %d, but had %d", tt.dataSource, tt.expected, i+1, timeout)
+			}
+		}
+
+		s.db.Close()
+	}
+}
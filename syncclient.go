@@ -1,6 +1,11 @@
 package queue
 
-import "time"
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
 
 // SyncClient Client for interacting with the queue
 type SyncClient struct {
@@ -12,13 +17,35 @@ func NewSyncClient(driver Driver) SyncClient {
 	return SyncClient{driver: driver}
 }
 
-// AddTask Adds a task to the queue
-func (s *SyncClient) AddTask(taskName string, taskKey string, doAfter time.Time, createdBy string, data map[string]interface{}) error {
-	return s.driver.addTask(TaskInit{
-		Key:       taskKey,
-		Name:      taskName,
-		DoAfter:   doAfter,
-		CreatedBy: createdBy,
-		Data:      data,
-	})
+// AddTask Adds a task to the queue, returning its ID.  Options can make sure
+// the task isn't added twice, in which case the ID of the existing task is
+// returned
+func (s *SyncClient) AddTask(taskName string, taskKey string, doAfter time.Time, createdBy string, data map[string]interface{}, opts ...AddTaskOption) (string, error) {
+	return s.driver.AddTask(newTaskInit(taskName, taskKey, doAfter, createdBy, data, opts))
+}
+
+// AddTaskTx Adds a task as part of the given transaction, so that the task is
+// only added if the transaction is committed.  Returns ErrNotSupported if the
+// driver can't use a database/sql transaction
+func (s *SyncClient) AddTaskTx(tx *sql.Tx, taskName string, taskKey string, doAfter time.Time, createdBy string, data map[string]interface{}, opts ...AddTaskOption) (string, error) {
+	d, ok := s.driver.(SQLTxDriver)
+
+	if !ok {
+		return "", ErrNotSupported
+	}
+
+	return d.AddTaskTx(tx, newTaskInit(taskName, taskKey, doAfter, createdBy, data, opts))
+}
+
+// AddTaskPgxTx Adds a task as part of the given pgx transaction, so that the
+// task is only added if the transaction is committed.  Returns ErrNotSupported
+// if the driver can't use a pgx transaction
+func (s *SyncClient) AddTaskPgxTx(tx pgx.Tx, taskName string, taskKey string, doAfter time.Time, createdBy string, data map[string]interface{}, opts ...AddTaskOption) (string, error) {
+	d, ok := s.driver.(PgxTxDriver)
+
+	if !ok {
+		return "", ErrNotSupported
+	}
+
+	return d.AddTaskTx(tx, newTaskInit(taskName, taskKey, doAfter, createdBy, data, opts))
 }
@@ -1,8 +1,10 @@
 package queue
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"runtime/debug"
 	"sync"
 	"time"
 )
@@ -11,38 +13,61 @@ import (
 func NewSyncManager(driver Driver) SyncManager {
 	var sm SyncManager
 	sm.driver = driver
-	sm.registeredActions = make(map[string]TaskAction)
-	sm.actionStreams = make(map[string]chan ScheduledAction)
-	sm.taskQueue = make(chan taskQueueAction)
+	sm.handlers = make(map[string]taskHandler)
+	sm.actionStreams = make(map[string]chan ContextScheduledAction)
 	sm.cancel = make(chan bool)
 	sm.registerMutex = &sync.Mutex{}
+	sm.workers = 1
+	sm.taskWorkers = make(map[string]int)
+	sm.running = make(map[string]int)
+	sm.popMX = &sync.Mutex{}
 
 	sm.errorHandler = defaultErrorHandler
+	sm.observer = noopObserver{}
+	sm.tracer = noopTracer{}
+	sm.pollInterval = defaultPollInterval
 	mx := sync.Mutex{}
 	sm.getStreamMX = &mx
 
 	return sm
 }
 
-type taskQueueAction struct {
-	Task Task
-	Done chan bool
-}
-
 // SyncManager is the central process for running actions
 type SyncManager struct {
-	actionStreams     map[string]chan ScheduledAction
-	taskQueue         chan taskQueueAction
-	cancel            chan bool
-	driver            Driver
-	registeredActions map[string]TaskAction
-	registerMutex     *sync.Mutex
-	errorHandler      func(error)
-	getStreamMX       *sync.Mutex
-}
-
-func (s *SyncManager) getStreamQueue(name string) chan ScheduledAction {
-	var stream chan ScheduledAction
+	actionStreams map[string]chan ContextScheduledAction
+	cancel        chan bool
+	driver        Driver
+	handlers      map[string]taskHandler
+	registerMutex *sync.Mutex        // Guards handlers and the running state below
+	ctx           context.Context    // Cancelled to stop queue runners, and the actions they're running.  Nil when not running
+	stopRunners   context.CancelFunc // Cancels ctx
+	runners       *sync.WaitGroup
+	errorHandler  func(error)
+	observer      Observer
+	tracer        Tracer
+	getStreamMX   *sync.Mutex
+	pollInterval  time.Duration
+	lease         time.Duration  // How long popped tasks are leased for.  The driver's default, if zero
+	workers       int            // How many tasks the shared queue runner may run at once
+	taskWorkers   map[string]int // Limits on how many tasks of a given name may run at once
+	running       map[string]int // How many tasks of each name are running.  Guarded by popMX
+	popMX         *sync.Mutex
+}
+
+// defaultPollInterval How often to check the queue when idle
+const defaultPollInterval = time.Second
+
+// queueRunner A pool of workers taking tasks from the queue.  Handlers
+// registered with WithPollInterval or WithConcurrency have a runner of their
+// own, while all other handlers share one
+type queueRunner struct {
+	taskName     string // Empty for the shared runner
+	pollInterval time.Duration
+	workers      int
+}
+
+func (s *SyncManager) getStreamQueue(name string) chan ContextScheduledAction {
+	var stream chan ContextScheduledAction
 	var ok bool
 
 	s.getStreamMX.Lock()
@@ -50,7 +75,7 @@ func (s *SyncManager) getStreamQueue(name string) chan ScheduledAction {
 
 	if stream, ok = s.actionStreams[name]; !ok {
 		// No such stream exists, so let's create first
-		stream = make(chan ScheduledAction)
+		stream = make(chan ContextScheduledAction)
 		s.actionStreams[name] = stream
 		// Run a goroutine that handles actions from this stream:
 		s.runStream(stream)
@@ -61,64 +86,264 @@ func (s *SyncManager) getStreamQueue(name string) chan ScheduledAction {
 
 // Run Runs the main loop that keeps the queue running and performs actions at specified intervals
 func (s *SyncManager) Run() {
+	s.registerMutex.Lock()
+	s.ctx, s.stopRunners = context.WithCancel(context.Background())
+	s.runners = &sync.WaitGroup{}
 
-	cancelQueue := make(chan bool)
-	// Start the synchroniser queue handler:
-	go s.runQueue(cancelQueue)
+	// Start the runners that take tasks from the queue:
+	s.startRunner(queueRunner{pollInterval: s.pollInterval, workers: s.workers})
 
-	for {
-		select {
-		case <-s.cancel:
-			cancelQueue <- true
-			return
-		case tqa := <-s.taskQueue:
-			var err error
-			task := tqa.Task
-			action := s.getRegisteredAction(task.Name)
-
-			if action == nil {
-				err = fmt.Errorf("cancelling task with ID %s because there is no action to handle it", task.id)
-				s.errorHandler(err)
-				err = s.driver.cancel(task, err.Error())
-				if err != nil {
-					s.errorHandler(err)
-				}
-			} else {
-				result, message := action.Do(task)
-				switch result {
-				case TaskResultPermanentFailure, TaskResultRetryFailure:
-					// Task failed
-					s.errorHandler(fmt.Errorf("%s", message))
-
-					switch result {
-					case TaskResultPermanentFailure:
-						err = s.driver.fail(task, message)
-					case TaskResultRetryFailure:
-						err = s.driver.retry(task, message)
-					default:
-						err = fmt.Errorf("Undefined task result %s", result)
-					}
+	for taskName, h := range s.handlers {
+		if h.ownRunner() {
+			s.startRunner(h.runner(taskName, s.pollInterval))
+		}
+	}
+	s.registerMutex.Unlock()
+
+	<-s.cancel
+
+	// Let workers finish what they're doing, telling actions that take a
+	// context to wrap up:
+	s.registerMutex.Lock()
+	s.stopRunners()
+	s.ctx = nil
+	runners := s.runners
+	s.registerMutex.Unlock()
 
-					if err != nil {
-						s.errorHandler(err)
+	runners.Wait()
+}
+
+// startRunner Starts the runner's workers.  Must be called with registerMutex
+// held while running
+func (s *SyncManager) startRunner(r queueRunner) {
+	for i := 0; i < r.workers; i++ {
+		s.runners.Add(1)
+		go func(ctx context.Context) {
+			defer s.runners.Done()
+			s.runQueue(ctx, r)
+		}(s.ctx)
+	}
+}
+
+// runTask Performs the registered action for a popped task, and records the
+// result with the driver.  popStarted is when the pop began, for tracing
+func (s *SyncManager) runTask(ctx context.Context, task Task, popStarted time.Time) {
+	var err error
+	var result TaskResult
+	var outcome TaskOutcome
+	var record func() error // Records the outcome with the driver
+	h, ok := s.getHandler(task.Name)
+
+	// Closes off the driver's transaction, even if something below panics:
+	defer s.driver.Cleanup(task)
+
+	ctx, span := s.tracer.StartTask(ctx, task, popStarted)
+	_, pop := s.tracer.StartStep(ctx, TaskStepPop, task, popStarted)
+	pop.End(result, nil)
+
+	s.observer.TaskPopped(task)
+
+	if !ok {
+		err = fmt.Errorf("cancelling task with ID %s because there is no action to handle it", task.id)
+		s.errorHandler(err)
+		message := err.Error()
+		outcome, record = TaskOutcomeCancelled, func() error { return s.driver.Cancel(task, message) }
+	} else if h.maxAttempts > 0 && task.Attempts > h.maxAttempts {
+		// Earlier attempts never finished, e.g., because the process running
+		// them went away, so we give up rather than trying again:
+		outcome, record = TaskOutcomeFailed, func() error {
+			return s.driver.Fail(task, fmt.Sprintf("Gave up after %d attempts, the last of which did not finish", h.maxAttempts))
+		}
+	} else {
+		var message string
+		started := time.Now()
+		doCtx, do := s.tracer.StartStep(ctx, TaskStepDo, task, started)
+		result, message = s.doTask(doCtx, h, task, started)
+		do.End(result, nil)
+		s.observer.TaskHandled(task, result, time.Since(started))
+
+		switch result {
+		case TaskResultPermanentFailure, TaskResultRetryFailure, TaskResultTimeout:
+			// Task failed
+			s.errorHandler(fmt.Errorf("%s", message))
+
+			switch result {
+			case TaskResultPermanentFailure:
+				outcome, record = TaskOutcomeFailed, func() error { return s.driver.Fail(task, message) }
+			case TaskResultRetryFailure, TaskResultTimeout:
+				if h.maxAttempts > 0 && task.Attempts >= h.maxAttempts {
+					outcome, record = TaskOutcomeFailed, func() error {
+						return s.driver.Fail(task, fmt.Sprintf("Gave up after %d attempts: %s", task.Attempts, message))
 					}
-				case TaskResultSuccess:
-					// Complete the task
-					err = s.driver.complete(task, message)
-					if err != nil {
-						s.errorHandler(err)
+				} else {
+					outcome, record = TaskOutcomeRetried, func() error {
+						return s.driver.Retry(task, message, time.Now().Add(h.retryPolicy.Delay(task.Attempts)))
 					}
-				default:
-					s.errorHandler(fmt.Errorf("fell through: undefined task result %s", result))
 				}
 			}
+		case TaskResultSuccess:
+			// Complete the task
+			outcome, record = TaskOutcomeCompleted, func() error { return s.driver.Complete(task, message) }
+		default:
+			// Left to be reclaimed:
+			err = fmt.Errorf("fell through: undefined task result %s", result)
+			s.errorHandler(err)
+		}
+	}
+
+	if record != nil {
+		_, step := s.tracer.StartStep(ctx, outcomeSteps[outcome], task, time.Now())
+		err = record()
+		step.End(result, err)
+
+		if err != nil {
+			s.errorHandler(err)
+		}
+
+		s.observer.TaskFinished(task, outcome, err)
+	}
+
+	span.End(result, err)
+}
+
+// doTask Runs the handler's action for the task.  If the driver can extend
+// the lease on the task, it's extended while the action runs.  Drivers that
+// can't are expected to hold the task some other way, such as with a row lock.
+// If the action hasn't returned by its timeout, or the lease is lost, its
+// context is cancelled and TaskResultTimeout is returned once it does.  An
+// action that has timed out is only waited for until its grace period is up,
+// so that one ignoring its context can't hold the worker forever.  Stopping
+// the SyncManager cancels the context too, and the action's own result is
+// returned
+func (s *SyncManager) doTask(ctx context.Context, h taskHandler, task Task, started time.Time) (TaskResult, string) {
+	extender, extend := s.driver.(LeaseExtender)
+	extend = extend && !task.DoAfter.IsZero()
+
+	if h.timeout <= 0 && !extend {
+		return s.callAction(ctx, h, task)
+	}
+
+	var cancel context.CancelFunc
+	var abandon <-chan time.Time
+	if h.timeout > 0 {
+		ctx, cancel = context.WithDeadline(ctx, started.Add(h.timeout))
+
+		giveUp := time.NewTimer(time.Until(started.Add(h.timeout + h.timeoutGrace())))
+		defer giveUp.Stop()
+		abandon = giveUp.C
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	type doResult struct {
+		result  TaskResult
+		message string
+	}
+
+	// Buffered, so that an abandoned action can still finish:
+	done := make(chan doResult, 1)
+	go func() {
+		result, message := s.callAction(ctx, h, task)
+		done <- doResult{result, message}
+	}()
+
+	// Heartbeats extend the lease well before it expires, with a failed
+	// extension tried again sooner, and the lease is lost if it expires
+	// regardless:
+	lease := h.lease(s.leaseDuration())
+	var heartbeat, retryExtend, lost <-chan time.Time
+	var expiry *time.Timer
+	if extend {
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+
+		expiry = time.NewTimer(time.Until(task.DoAfter))
+		defer expiry.Stop()
+		lost = expiry.C
+	}
+
+	// Once the context is done the action is still waited for, keeping the
+	// worker and the task until it returns or is abandoned:
+	cancelled := ctx.Done()
+	var timedOut string
+
+	for {
+		select {
+		case r := <-done:
+			if len(timedOut) > 0 {
+				return TaskResultTimeout, timedOut
+			}
+
+			return r.result, r.message
+		case <-heartbeat:
+			retryExtend = s.extendLease(extender, task, lease, expiry)
+		case <-retryExtend:
+			retryExtend = s.extendLease(extender, task, lease, expiry)
+		case <-lost:
+			heartbeat, retryExtend, lost = nil, nil, nil
+			timedOut = fmt.Sprintf("Lease expired after %s", time.Since(started).Round(time.Millisecond))
+			cancel()
+		case <-cancelled:
+			cancelled = nil
+
+			if ctx.Err() == context.DeadlineExceeded {
+				// The lease already lasts until the action is abandoned:
+				heartbeat, retryExtend = nil, nil
+
+				if len(timedOut) == 0 {
+					timedOut = fmt.Sprintf("Timed out after %s", h.timeout.Round(time.Millisecond))
+				}
+			}
+		case <-abandon:
+			if len(timedOut) == 0 {
+				timedOut = fmt.Sprintf("Timed out after %s", h.timeout.Round(time.Millisecond))
+			}
+
+			s.errorHandler(fmt.Errorf("gave up waiting for the action on task with ID %s to return after it timed out", task.id))
 
-			s.driver.cleanup(task)
-			tqa.Done <- true
+			return TaskResultTimeout, timedOut
 		}
 	}
 }
 
+// callAction Calls the handler's action for the task.  A panic in the action
+// is recovered, and turned into the handler's panic result, with the stack
+// trace in the message
+func (s *SyncManager) callAction(ctx context.Context, h taskHandler, task Task) (result TaskResult, message string) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = h.panicResult
+			message = fmt.Sprintf("panic occurred in action.Do() (type: %s): %v\n%s", actionType(h.action), r, debug.Stack())
+		}
+	}()
+
+	return h.action.DoContext(ctx, task)
+}
+
+// extendLease Extends the lease on a task whose action is running, moving
+// expiry on to when the lease now expires.  If the lease can't be extended,
+// returns a channel that fires when it's time to try again, well before the
+// next heartbeat.  Only called by doTask, which is the only receiver from
+// expiry
+func (s *SyncManager) extendLease(extender LeaseExtender, task Task, lease time.Duration, expiry *time.Timer) <-chan time.Time {
+	until, err := extender.ExtendLease(task, lease)
+
+	if err != nil {
+		s.errorHandler(fmt.Errorf("could not extend the lease on task with ID %s: %s", task.id, err))
+		return time.After(lease / 12)
+	}
+
+	if !expiry.Stop() {
+		<-expiry.C
+	}
+
+	expiry.Reset(time.Until(until))
+
+	return nil
+}
+
 // runStream By separating tasks into separate streams, we can have some
 // scheduled actions run side by side, and others that run separately.  For
 // example, Netsuite doesn't like multiple connections, so all such scheduled
@@ -126,71 +351,178 @@ func (s *SyncManager) Run() {
 // a Postgres database may be able to run simultaneously.  runStream receives
 // actions on its stream, and blocks on that stream until the action is
 // complete.
-func (s *SyncManager) runStream(stream chan ScheduledAction) {
+func (s *SyncManager) runStream(stream chan ContextScheduledAction) {
 	n := time.Now()
 	go func() {
 		fmt.Printf("Starting a new stream at %s\n", n)
 		for {
 			select {
 			case action := <-stream:
-				func() {
-					defer func() {
-						if r := recover(); r != nil {
-							err := fmt.Errorf("panic occurred in action.Do() (type: %T): %v", action, r)
-							s.errorHandler(err)
-						}
-					}()
-					err := action.Do()
-					if err != nil {
-						s.errorHandler(err)
-					}
-				}()
+				s.runScheduledAction(action)
 			}
 		}
 	}()
 }
 
-func (s *SyncManager) runQueue(cancel chan bool) {
+// runScheduledAction Performs a scheduled action, recovering from any panic
+func (s *SyncManager) runScheduledAction(action ContextScheduledAction) {
+	started := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("panic occurred in action.Do() (type: %s): %v", actionType(action), r)
+			s.errorHandler(err)
+			s.observer.ScheduledActionRun(action.Stream(), action, time.Since(started), err, true)
+		}
+	}()
+	err := action.DoContext(s.runContext())
+	if err != nil {
+		s.errorHandler(err)
+	}
+	s.observer.ScheduledActionRun(action.Stream(), action, time.Since(started), err, false)
+}
 
-	refreshDelay := time.Second * 4 // refreshDelay defines how soon before refreshing tasks that need to be retried
-	refreshed := time.Now()
+// runQueue Run by each of a runner's workers.  Takes tasks from the queue and
+// runs them one at a time until ctx is cancelled
+func (s *SyncManager) runQueue(ctx context.Context, r queueRunner) {
+	// Drivers that announce new tasks let us pick them up straight away,
+	// rather than waiting for the next poll:
+	var added <-chan string
+	if notifier, ok := s.driver.(Notifier); ok {
+		ch, stop, err := notifier.Subscribe()
+
+		if err != nil {
+			s.errorHandler(err)
+		} else {
+			defer stop()
+			added = ch
+		}
+	}
 
 	for {
 
 		select {
-		case <-cancel:
+		case <-ctx.Done():
 			return
 
 		default:
-			// Refresh tasks marked for retry:
-			if time.Now().Sub(refreshed) >= refreshDelay {
-				err := s.driver.refreshRetry(time.Hour)
+			names := s.runnerTaskNames(r)
 
-				if err != nil {
-					s.errorHandler(err)
+			if len(names) > 0 {
+				// Check for new tasks in queue:
+				started := time.Now()
+				task, err := s.pop(names)
+
+				if err == nil {
+					s.runTask(ctx, task, started)
+					s.release(task)
+
+					// There may be more waiting, so check again straight away:
+					continue
 				}
 
-				refreshed = time.Now()
+				if err != ErrNoTasks {
+					s.driver.Cleanup(task)
+					s.errorHandler(err)
+				}
 			}
 
-			// Check for new tasks in queue:
-			task, err := s.driver.pop()
+			// Nothing to do, so wait until a task is added or it's time to poll:
+			if !s.wait(ctx, r, added) {
+				return
+			}
+		}
+	}
+}
 
-			if err != nil && err != ErrNoTasks {
-				s.driver.cleanup(task)
-				s.errorHandler(err)
-			} else if err != ErrNoTasks {
-				// We want to wait until this is executed before we begin the task again.
-				// Otherwise "pop" might return the same value, since it's not truly pop'ing
+// wait Waits until a task the runner handles may have been added, or it's
+// time to poll.  Returns false if ctx was cancelled
+func (s *SyncManager) wait(ctx context.Context, r queueRunner, added <-chan string) bool {
+	timer := time.NewTimer(r.pollInterval)
+	defer timer.Stop()
 
-				reply := make(chan bool)
-				s.taskQueue <- taskQueueAction{Task: task, Done: reply}
-				<-reply
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return true
+		case taskName := <-added:
+			if len(taskName) == 0 || s.runnerHandles(r, taskName) {
+				return true
 			}
+		}
+	}
+}
 
-			time.Sleep(1 * time.Second)
+// runnerTaskNames Returns the names of the tasks the runner takes from the
+// queue.  For the shared runner this is every registered handler without a
+// runner of its own.  Tasks with no registered handler are left alone
+func (s *SyncManager) runnerTaskNames(r queueRunner) []string {
+	if len(r.taskName) > 0 {
+		return []string{r.taskName}
+	}
+
+	var names []string
+
+	s.registerMutex.Lock()
+	for taskName, h := range s.handlers {
+		if !h.ownRunner() {
+			names = append(names, taskName)
 		}
 	}
+	s.registerMutex.Unlock()
+
+	return names
+}
+
+func (s *SyncManager) runnerHandles(r queueRunner, taskName string) bool {
+	if len(r.taskName) > 0 {
+		return taskName == r.taskName
+	}
+
+	h, ok := s.getHandler(taskName)
+
+	return ok && !h.ownRunner()
+}
+
+// pop Pops the next task with one of the given names, skipping any whose
+// name has reached its limit of concurrent tasks.  Workers pop one at a time
+// so that the limits hold
+func (s *SyncManager) pop(names []string) (Task, error) {
+	s.popMX.Lock()
+	defer s.popMX.Unlock()
+
+	opts := PopOptions{Names: names, Lease: s.leaseDuration()}
+	for _, name := range names {
+		if h, ok := s.getHandler(name); ok {
+			opts.Lease = h.lease(opts.Lease)
+		}
+	}
+
+	for name, limit := range s.taskWorkers {
+		if s.running[name] >= limit {
+			opts.ExcludeNames = append(opts.ExcludeNames, name)
+		}
+	}
+
+	task, err := s.driver.Pop(opts)
+
+	if err == nil {
+		s.running[task.Name]++
+	}
+
+	return task, err
+}
+
+// release Frees up the task's slot once it has been run
+func (s *SyncManager) release(task Task) {
+	s.popMX.Lock()
+	defer s.popMX.Unlock()
+
+	s.running[task.Name]--
+	if s.running[task.Name] <= 0 {
+		delete(s.running, task.Name)
+	}
 }
 
 // Stop Stops the sync manager main loop
@@ -200,13 +532,20 @@ func (s *SyncManager) Stop() {
 
 // Schedule Schedule an action to be performed at particular intervals
 func (s *SyncManager) Schedule(act ScheduledAction, period time.Duration) {
+	s.ScheduleContext(AdaptScheduledAction(act), period)
+}
+
+// ScheduleContext Schedules an action that takes a context to be performed at
+// particular intervals.  The context is cancelled when Stop is called, if the
+// SyncManager is running
+func (s *SyncManager) ScheduleContext(act ContextScheduledAction, period time.Duration) {
 	ticker := time.NewTicker(period)
 
 	// We fetch a reference to the stream's channel so that we can schedule
 	// our task
 	stream := s.getStreamQueue(act.Stream())
 
-	go func(act ScheduledAction, ticker *time.Ticker) {
+	go func(act ContextScheduledAction, ticker *time.Ticker) {
 		for {
 			<-ticker.C
 
@@ -215,23 +554,117 @@ func (s *SyncManager) Schedule(act ScheduledAction, period time.Duration) {
 	}(act, ticker)
 }
 
-// RegisterTaskHandler Specifies which action to be used to handle a task of name taskName
-func (s *SyncManager) RegisterTaskHandler(act TaskAction, taskName string) error {
+// RegisterTaskHandler Specifies which action to be used to handle a task of
+// name taskName.  Options set how the handler's tasks are taken from the
+// queue and retried
+func (s *SyncManager) RegisterTaskHandler(act TaskAction, taskName string, opts ...TaskHandlerOption) error {
+	return s.RegisterContextTaskHandler(AdaptTaskAction(act), taskName, opts...)
+}
+
+// RegisterContextTaskHandler Specifies an action that takes a context to
+// handle tasks of name taskName, as for RegisterTaskHandler
+func (s *SyncManager) RegisterContextTaskHandler(act ContextTaskAction, taskName string, opts ...TaskHandlerOption) error {
+	h := taskHandler{
+		action:      act,
+		retryPolicy: FixedRetryPolicy(defaultRetryDelay),
+		panicResult: TaskResultRetryFailure,
+	}
+
+	for _, opt := range opts {
+		opt(&h)
+	}
+
 	s.registerMutex.Lock()
-	s.registeredActions[taskName] = act
-	s.registerMutex.Unlock()
+	defer s.registerMutex.Unlock()
+
+	previous, registered := s.handlers[taskName]
+	s.handlers[taskName] = h
+
+	// Handlers registered while running need their runner started now:
+	if s.ctx != nil && h.ownRunner() && !(registered && previous.ownRunner()) {
+		s.startRunner(h.runner(taskName, s.pollInterval))
+	}
 
 	return nil
 }
 
-func (s *SyncManager) getRegisteredAction(taskName string) TaskAction {
-	var taskAction TaskAction
-
+func (s *SyncManager) getHandler(taskName string) (taskHandler, bool) {
 	s.registerMutex.Lock()
-	taskAction = s.registeredActions[taskName]
+	h, ok := s.handlers[taskName]
 	s.registerMutex.Unlock()
 
-	return taskAction
+	return h, ok
+}
+
+// runContext Returns the context that is cancelled when the SyncManager is
+// stopped, or a context that is never cancelled if it isn't running
+func (s *SyncManager) runContext() context.Context {
+	s.registerMutex.Lock()
+	defer s.registerMutex.Unlock()
+
+	if s.ctx == nil {
+		return context.Background()
+	}
+
+	return s.ctx
+}
+
+func (s *SyncManager) getRegisteredAction(taskName string) ContextTaskAction {
+	h, _ := s.getHandler(taskName)
+
+	return h.action
+}
+
+// SetWorkers Sets how many tasks may be run at the same time by the queue
+// runner shared by handlers without a runner of their own.  Each task is
+// popped and run in its own driver transaction.  Defaults to 1, so that tasks
+// run one after another.  Must be called before Run
+func (s *SyncManager) SetWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+
+	s.workers = n
+}
+
+// SetTaskWorkers Limits how many tasks with the given name may be run at the
+// same time, within the limit set by SetWorkers.  Tasks over the limit are
+// left in the queue until a worker is free to take them.  A limit below 1
+// removes the limit.  Must be called before Run
+func (s *SyncManager) SetTaskWorkers(taskName string, n int) {
+	s.popMX.Lock()
+	defer s.popMX.Unlock()
+
+	if n < 1 {
+		delete(s.taskWorkers, taskName)
+		return
+	}
+
+	s.taskWorkers[taskName] = n
+}
+
+// SetPollInterval Sets how often to check for tasks when the queue is idle.
+// Drivers that implement Notifier wake the queue as soon as a task is added,
+// so polling only matters for tasks that become due later, or for drivers
+// that can't announce new tasks.  Must be called before Run
+func (s *SyncManager) SetPollInterval(interval time.Duration) {
+	s.pollInterval = interval
+}
+
+// SetLease Sets how long popped tasks are leased for, after which they may be
+// reclaimed and run again.  Defaults to DefaultLease.  Drivers that implement
+// LeaseExtender have the lease extended while the task's action runs, so the
+// lease need only cover how long it would take to notice that a process
+// running tasks has gone away.  Tasks whose handler has a timeout are leased
+// for at least as long as their action may be waited for.  Must be called
+// before Run
+func (s *SyncManager) SetLease(lease time.Duration) {
+	s.lease = lease
+}
+
+// leaseDuration Returns how long popped tasks are leased for
+func (s *SyncManager) leaseDuration() time.Duration {
+	return PopOptions{Lease: s.lease}.lease()
 }
 
 // SetErrorHandler Sets a function to handle errors from the run function
@@ -239,6 +672,26 @@ func (s *SyncManager) SetErrorHandler(handler func(err error)) {
 	s.errorHandler = handler
 }
 
+// SetObserver Sets an observer to be told what happens to tasks and scheduled
+// actions, such as to record metrics.  Must be called before Run
+func (s *SyncManager) SetObserver(observer Observer) {
+	if observer == nil {
+		observer = noopObserver{}
+	}
+
+	s.observer = observer
+}
+
+// SetTracer Sets a tracer to trace the work done for each task.  Must be
+// called before Run
+func (s *SyncManager) SetTracer(tracer Tracer) {
+	if tracer == nil {
+		tracer = noopTracer{}
+	}
+
+	s.tracer = tracer
+}
+
 func defaultErrorHandler(err error) {
 	log.Print(err)
 }
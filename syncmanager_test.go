@@ -1,6 +1,12 @@
 package queue
 
 import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -127,7 +133,7 @@ func TestRunTaskAction(t *testing.T) {
 	for _, driver := range drivers {
 		taskName := "TestRunTaskAction"
 		sm := NewSyncManager(driver)
-		sm.driver.clear()
+		sm.driver.Clear()
 		tm := NewTaskManager(driver)
 
 		go func() {
@@ -149,7 +155,7 @@ func TestRunTaskAction(t *testing.T) {
 		taskKey := hashKey(taskName + "1")
 		data := map[string]interface{}{}
 
-		err = tm.AddTask(taskName, taskKey, time.Now(), "test_created_by", data)
+		_, err = tm.AddTask(taskName, taskKey, time.Now(), "test_created_by", data)
 
 		if err != nil {
 			t.Error(err)
@@ -172,7 +178,7 @@ func TestRunTaskAction(t *testing.T) {
 
 		// Now, if we run 'pop', there should be no waiting tasks, waiting a moment for the thread to write the state:
 		time.Sleep(time.Millisecond * 250)
-		task, err := sm.driver.pop()
+		task, err := sm.driver.Pop(PopOptions{})
 
 		if err != ErrNoTasks {
 			t.Errorf("Should have had ErrNoTasks, but had %+v: %+v", err, task)
@@ -180,3 +186,1009 @@ func TestRunTaskAction(t *testing.T) {
 
 	}
 }
+
+func TestRunTaskActionNotified(t *testing.T) {
+	// Drivers that announce new tasks should wake the queue straight away,
+	// without waiting for the next poll, and one task shouldn't hold up the
+	// next
+	taskName := "TestRunTaskActionNotified"
+	driver := NewMemoryDriver()
+	sm := NewSyncManager(driver)
+	sm.SetPollInterval(time.Hour)
+	tm := NewTaskManager(driver)
+
+	result := make(chan bool)
+	ea := NewExampleTaskAction(result)
+
+	err := sm.RegisterTaskHandler(&ea, taskName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		sm.Run()
+	}()
+	defer sm.Stop()
+
+	for i := 0; i < 3; i++ {
+		_, err = tm.AddTask(taskName, hashKey(taskName+strconv.Itoa(i)), time.Now(), "test_created_by", map[string]interface{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	timeout := time.After(time.Second)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-result:
+		case <-timeout:
+			t.Fatalf("Timeout before task action was run for task %d", i+1)
+		}
+	}
+}
+
+func TestConcurrentWorkers(t *testing.T) {
+	// With three workers, three slow tasks should all be running at once
+	taskName := "TestConcurrentWorkers"
+	driver := NewMemoryDriver()
+	sm := NewSyncManager(driver)
+	sm.SetWorkers(3)
+	tm := NewTaskManager(driver)
+
+	ba := newBlockingTaskAction()
+	defer close(ba.release)
+
+	if err := sm.RegisterTaskHandler(ba, taskName); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		sm.Run()
+	}()
+	defer sm.Stop()
+
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := tm.AddTask(taskName, key, time.Now(), "test_created_by", map[string]interface{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	timeout := time.After(2 * time.Second)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-ba.started:
+		case <-timeout:
+			t.Fatalf("Only %d of 3 tasks were running at the same time", i)
+		}
+	}
+}
+
+func TestTaskWorkersLimit(t *testing.T) {
+	// A task name limited to one worker runs one at a time, leaving the other
+	// workers free for other tasks
+	limitedName := "TestTaskWorkersLimit"
+	otherName := "TestTaskWorkersOther"
+	driver := NewMemoryDriver()
+	sm := NewSyncManager(driver)
+	sm.SetWorkers(3)
+	sm.SetTaskWorkers(limitedName, 1)
+	tm := NewTaskManager(driver)
+
+	ba := newBlockingTaskAction()
+	defer close(ba.release)
+
+	result := make(chan bool, 1)
+	ea := NewExampleTaskAction(result)
+
+	if err := sm.RegisterTaskHandler(ba, limitedName); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sm.RegisterTaskHandler(&ea, otherName); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		sm.Run()
+	}()
+	defer sm.Stop()
+
+	for _, key := range []string{"a", "b"} {
+		if _, err := tm.AddTask(limitedName, key, time.Now(), "test_created_by", map[string]interface{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-ba.started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout before first limited task was run")
+	}
+
+	if _, err := tm.AddTask(otherName, "c", time.Now(), "test_created_by", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-result:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout before other task was run")
+	}
+
+	select {
+	case key := <-ba.started:
+		t.Errorf("Task %s started while another task with the same name was running", key)
+	case <-time.After(250 * time.Millisecond):
+	}
+
+	// Once the first finishes, the second may run:
+	ba.release <- true
+
+	select {
+	case <-ba.started:
+	case <-time.After(2 * time.Second):
+		t.Error("Timeout before second limited task was run")
+	}
+}
+
+func TestUnregisteredTaskLeftAlone(t *testing.T) {
+	// Tasks without a handler stay in the queue for another process to handle
+	driver := NewMemoryDriver()
+	sm := NewSyncManager(driver)
+	tm := NewTaskManager(driver)
+
+	_, err := tm.AddTask("TestUnregistered", "a", time.Now(), "test_created_by", map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		sm.Run()
+	}()
+
+	time.Sleep(250 * time.Millisecond)
+	sm.Stop()
+
+	count, err := driver.GetTaskCount("TestUnregistered")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 {
+		t.Errorf("Expected unregistered task to remain in the queue, but count was %d", count)
+	}
+
+	task, err := driver.Pop(PopOptions{})
+	if err != nil {
+		t.Fatalf("Expected unregistered task to still be ready: %s", err)
+	}
+
+	if task.State != TaskRetry || task.Name != "TestUnregistered" {
+		t.Errorf("Unexpected task popped: %+v", task)
+	}
+
+	driver.Cleanup(task)
+}
+
+func TestOwnRunner(t *testing.T) {
+	// A slow handler with a runner of its own doesn't hold up other tasks
+	slowName := "TestOwnRunnerSlow"
+	fastName := "TestOwnRunnerFast"
+	driver := NewMemoryDriver()
+	sm := NewSyncManager(driver)
+	tm := NewTaskManager(driver)
+
+	ba := newBlockingTaskAction()
+	defer close(ba.release)
+
+	result := make(chan bool, 1)
+	ea := NewExampleTaskAction(result)
+
+	if err := sm.RegisterTaskHandler(ba, slowName, WithConcurrency(1), WithPollInterval(100*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		sm.Run()
+	}()
+	defer sm.Stop()
+
+	// Registered while running:
+	if err := sm.RegisterTaskHandler(&ea, fastName); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tm.AddTask(slowName, "a", time.Now(), "test_created_by", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-ba.started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout before slow task was run")
+	}
+
+	if _, err := tm.AddTask(fastName, "b", time.Now(), "test_created_by", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-result:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Fast task was held up behind slow task")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	// A task asking to be retried is run again once the handler's retry delay
+	// has passed
+	taskName := "TestRetryDelay"
+	driver := NewMemoryDriver()
+	sm := NewSyncManager(driver)
+	sm.SetPollInterval(50 * time.Millisecond)
+	tm := NewTaskManager(driver)
+
+	ra := newRetryTaskAction()
+
+	if err := sm.RegisterTaskHandler(ra, taskName, WithRetryDelay(200*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		sm.Run()
+	}()
+	defer sm.Stop()
+
+	if _, err := tm.AddTask(taskName, "a", time.Now(), "test_created_by", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	started := time.Now()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-ra.attempts:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timeout waiting for attempt %d", i+1)
+		}
+	}
+
+	if diff := time.Since(started); diff < 200*time.Millisecond {
+		t.Errorf("Task was retried after %s, before its retry delay", diff)
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	// A task that keeps asking to be retried is failed once it reaches the
+	// handler's maximum attempts
+	taskName := "TestMaxAttempts"
+	driver := NewMemoryDriver()
+	sm := NewSyncManager(driver)
+	sm.SetPollInterval(50 * time.Millisecond)
+	tm := NewTaskManager(driver)
+
+	attempts := make(chan string, 10)
+	act := resultTaskAction{result: TaskResultRetryFailure, message: "Still broken", attempts: attempts}
+
+	if err := sm.RegisterTaskHandler(act, taskName, WithRetryDelay(10*time.Millisecond), WithMaxAttempts(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		sm.Run()
+	}()
+	defer sm.Stop()
+
+	if _, err := tm.AddTask(taskName, "a", time.Now(), "test_created_by", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-attempts:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timeout waiting for attempt %d", i+1)
+		}
+	}
+
+	select {
+	case <-attempts:
+		t.Fatal("Task was attempted more than 3 times")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	dead, err := driver.ListDeadTasks(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dead) != 1 {
+		t.Fatalf("Expected the task to have failed, but had %d failed tasks", len(dead))
+	}
+
+	if expected := "Gave up after 3 attempts: Still broken"; dead[0].Error != expected {
+		t.Errorf("Expected message %q, but had %q", expected, dead[0].Error)
+	}
+}
+
+func TestMaxAttemptsReclaimed(t *testing.T) {
+	// A task whose attempts never finished is failed without being run again
+	taskName := "TestMaxAttemptsReclaimed"
+	driver := NewMemoryDriver()
+	sm := NewSyncManager(driver)
+
+	attempts := make(chan string, 10)
+	act := resultTaskAction{result: TaskResultSuccess, message: "Done", attempts: attempts}
+
+	if err := sm.RegisterTaskHandler(act, taskName, WithMaxAttempts(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := driver.AddTask(TaskInit{Key: "a", Name: taskName}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pop and abandon the task, as a process that went away would:
+	task, err := driver.Pop(PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	driver.Cleanup(task)
+
+	driver.mx.Lock()
+	driver.tasks[task.id].doAfter = time.Now().Add(-time.Second)
+	driver.mx.Unlock()
+
+	task, err = sm.pop([]string{taskName})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sm.runTask(context.Background(), task, time.Now())
+
+	select {
+	case <-attempts:
+		t.Error("Task was run after reaching its maximum attempts")
+	default:
+	}
+
+	if _, err = driver.GetDeadTask(task.id); err != nil {
+		t.Errorf("Expected task to have failed: %s", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	// An action that doesn't return in time has its context cancelled, and
+	// its task is retried once it returns or its grace period is up
+	taskName := "TestTimeout"
+	driver := NewMemoryDriver()
+	sm := NewSyncManager(driver)
+	sm.SetErrorHandler(func(error) {})
+
+	ba := newBlockingTaskAction()
+
+	if err := sm.RegisterTaskHandler(ba, taskName, WithTimeout(50*time.Millisecond), WithRetryDelay(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := driver.AddTask(TaskInit{Key: "a", Name: taskName}); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := driver.Pop(PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finished := make(chan bool)
+	go func() {
+		sm.runTask(context.Background(), task, time.Now())
+		close(finished)
+	}()
+
+	// The action ignores its context, so the worker waits for it until the
+	// grace period is up:
+	start := time.Now()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("Worker still waiting for the action that timed out after its grace period")
+	}
+	close(ba.release)
+
+	if waited := time.Since(start); waited < 80*time.Millisecond {
+		t.Errorf("Expected the worker to wait out the grace period, but it moved on after %s", waited)
+	}
+
+	retried, err := driver.GetTask(task.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if retried.State != TaskRetry || retried.LastAttemptMessage != "Timed out after 50ms" {
+		t.Errorf("Expected task to be retried after timing out, but was %s: %s", retried.State, retried.LastAttemptMessage)
+	}
+
+	if !retried.DoAfter.After(time.Now().Add(50 * time.Minute)) {
+		t.Errorf("Expected the retry delay to be used, but task is due at %s", retried.DoAfter)
+	}
+}
+
+// overlapTaskAction Sleeps for each task regardless of its context, tracking
+// the most tasks it has run at once
+type overlapTaskAction struct {
+	sleep   time.Duration
+	mx      *sync.Mutex
+	running *int
+	most    *int
+	runs    *int
+}
+
+func (oa overlapTaskAction) Do(task Task) (TaskResult, string) {
+	oa.mx.Lock()
+	*oa.running++
+	*oa.runs++
+	if *oa.running > *oa.most {
+		*oa.most = *oa.running
+	}
+	oa.mx.Unlock()
+
+	time.Sleep(oa.sleep)
+
+	oa.mx.Lock()
+	*oa.running--
+	oa.mx.Unlock()
+
+	return TaskResultSuccess, "Done"
+}
+
+func TestTimeoutNoOverlap(t *testing.T) {
+	// A task that times out isn't retried until its action has returned, if
+	// it returns within its grace period, so it never runs twice at once
+	taskName := "TestTimeoutNoOverlap"
+	driver := NewMemoryDriver()
+	sm := NewSyncManager(driver)
+	sm.SetErrorHandler(func(error) {})
+
+	var running, most, runs int
+	oa := overlapTaskAction{sleep: 70 * time.Millisecond, mx: &sync.Mutex{}, running: &running, most: &most, runs: &runs}
+
+	if err := sm.RegisterTaskHandler(oa, taskName, WithConcurrency(1), WithPollInterval(10*time.Millisecond), WithTimeout(50*time.Millisecond), WithRetryDelay(10*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := driver.AddTask(TaskInit{Key: "a", Name: taskName}); err != nil {
+		t.Fatal(err)
+	}
+
+	go sm.Run()
+	time.Sleep(time.Second)
+	sm.Stop()
+
+	oa.mx.Lock()
+	defer oa.mx.Unlock()
+
+	if runs < 2 {
+		t.Errorf("Expected the task to be retried after timing out, but it ran %d times", runs)
+	}
+
+	if most != 1 {
+		t.Errorf("Expected the task to run once at a time, but it ran %d times at once", most)
+	}
+}
+
+func TestTimeoutAbandoned(t *testing.T) {
+	// An action that ignores its context is abandoned once its grace period
+	// is up, so that the worker goes on to other tasks
+	taskName := "TestTimeoutAbandoned"
+	driver := NewMemoryDriver()
+	sm := NewSyncManager(driver)
+	sm.SetErrorHandler(func(error) {})
+
+	ba := newBlockingTaskAction()
+	defer close(ba.release)
+
+	if err := sm.RegisterTaskHandler(ba, taskName, WithConcurrency(1), WithPollInterval(10*time.Millisecond), WithTimeout(50*time.Millisecond), WithRetryDelay(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if _, err := driver.AddTask(TaskInit{Key: key, Name: taskName}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	go sm.Run()
+	defer sm.Stop()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-ba.started:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected both tasks to be started by the one worker, but only %d were", i)
+		}
+	}
+}
+
+func TestTimeoutLease(t *testing.T) {
+	// Tasks with a timeout are leased until the worker would give up on them
+	driver := NewMemoryDriver()
+	sm := NewSyncManager(driver)
+	sm.SetLease(time.Millisecond)
+
+	if err := sm.RegisterTaskHandler(newBlockingTaskAction(), "TestTimeoutLease", WithTimeout(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := driver.AddTask(TaskInit{Key: "a", Name: "TestTimeoutLease"}); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := sm.pop([]string{"TestTimeoutLease"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if until := time.Until(task.DoAfter); until < time.Hour {
+		t.Errorf("Expected the lease to cover the timeout and its grace period, but it expires in %s", until)
+	}
+}
+
+func TestTimeoutHeldTask(t *testing.T) {
+	// Where the driver can't extend the lease, it holds the task some other
+	// way, so the action has until its timeout even once the lease is up
+	taskName := "TestTimeoutHeldTask"
+	driver := NewMemoryDriver()
+	sm := NewSyncManager(fixedLeaseDriver{driver})
+	sm.SetErrorHandler(func(error) {})
+
+	ca := newContextTaskAction()
+
+	if err := sm.RegisterContextTaskHandler(ca, taskName, WithTimeout(100*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := driver.AddTask(TaskInit{Key: "a", Name: taskName}); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := driver.Pop(PopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task.DoAfter = time.Now().Add(10 * time.Millisecond)
+	earliest := time.Now().Add(100 * time.Millisecond)
+	sm.runTask(context.Background(), task, time.Now())
+
+	if deadline := <-ca.started; deadline.Before(earliest) || deadline.After(earliest.Add(50*time.Millisecond)) {
+		t.Errorf("Expected the action to have until its timeout, about %s, but had until %s", earliest, deadline)
+	}
+
+	if err := <-ca.done; err != context.DeadlineExceeded {
+		t.Errorf("Expected the action's context to expire, but had %v", err)
+	}
+
+	retried, err := driver.GetTask(task.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if retried.State != TaskRetry || retried.LastAttemptMessage != "Timed out after 100ms" {
+		t.Errorf("Expected task to be retried after timing out, but was %s: %s", retried.State, retried.LastAttemptMessage)
+	}
+}
+
+// cleanupDriver Counts the tasks cleaned up
+type cleanupDriver struct {
+	Driver
+	cleaned *int
+}
+
+func (d cleanupDriver) Cleanup(task Task) {
+	*d.cleaned++
+	d.Driver.Cleanup(task)
+}
+
+func TestTaskPanic(t *testing.T) {
+	// A panicking action is recovered, and its task retried or failed with
+	// the stack trace
+	driver := NewMemoryDriver()
+	var cleaned int
+	sm := NewSyncManager(cleanupDriver{driver, &cleaned})
+
+	var errs []error
+	sm.SetErrorHandler(func(err error) { errs = append(errs, err) })
+
+	if err := sm.RegisterTaskHandler(panicTaskAction{}, "retries", WithRetryDelay(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sm.RegisterTaskHandler(panicTaskAction{}, "fails", WithPanicResult(TaskResultPermanentFailure)); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[string]string)
+	for _, name := range []string{"retries", "fails"} {
+		id, err := driver.AddTask(TaskInit{Key: name, Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids[name] = id
+
+		task, err := sm.pop([]string{name})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sm.runTask(context.Background(), task, time.Now())
+	}
+
+	if cleaned != 2 {
+		t.Errorf("Expected both tasks to be cleaned up, but %d were", cleaned)
+	}
+
+	retried, err := driver.GetTask(ids["retries"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if retried.State != TaskRetry {
+		t.Errorf("Expected task to be retried, but was %s", retried.State)
+	}
+
+	for _, expected := range []string{"panic occurred in action.Do() (type: queue.panicTaskAction): failing here", "runtime/debug.Stack"} {
+		if !strings.Contains(retried.LastAttemptMessage, expected) {
+			t.Errorf("Expected last attempt message to contain %q, but had %q", expected, retried.LastAttemptMessage)
+		}
+	}
+
+	if _, err = driver.GetDeadTask(ids["fails"]); err != nil {
+		t.Errorf("Expected task to have failed: %s", err)
+	}
+
+	if len(errs) != 2 || !strings.Contains(errs[0].Error(), "failing here") {
+		t.Errorf("Expected the panics to be passed to the error handler, but had %v", errs)
+	}
+}
+
+// fixedLeaseDriver Hides the driver's LeaseExtender
+type fixedLeaseDriver struct {
+	Driver
+}
+
+// lostLeaseDriver Fails to extend leases, as if tasks had been reclaimed
+type lostLeaseDriver struct {
+	Driver
+}
+
+func (d lostLeaseDriver) ExtendLease(task Task, lease time.Duration) (time.Time, error) {
+	return time.Time{}, fmt.Errorf("task with ID %s is not held by this caller", task.id)
+}
+
+// flakyLeaseDriver Fails to extend leases the first few times it's asked, as
+// if the database were briefly unavailable
+type flakyLeaseDriver struct {
+	*MemoryDriver
+	failures *int // How many more times to fail
+}
+
+func (d flakyLeaseDriver) ExtendLease(task Task, lease time.Duration) (time.Time, error) {
+	if *d.failures > 0 {
+		*d.failures--
+		return time.Time{}, fmt.Errorf("connection refused")
+	}
+
+	return d.MemoryDriver.ExtendLease(task, lease)
+}
+
+func TestLeaseExtended(t *testing.T) {
+	// The lease is kept up while the action runs, however long it takes
+	taskName := "TestLeaseExtended"
+	driver := NewMemoryDriver()
+	sm := NewSyncManager(driver)
+	sm.SetLease(60 * time.Millisecond)
+
+	ba := newBlockingTaskAction()
+
+	if err := sm.RegisterTaskHandler(ba, taskName); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := driver.AddTask(TaskInit{Key: "a", Name: taskName}); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := sm.pop([]string{taskName})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if task.DoAfter.After(time.Now().Add(60 * time.Millisecond)) {
+		t.Errorf("Expected the task to be leased for 60ms, but it was leased until %s", task.DoAfter)
+	}
+
+	finished := make(chan bool)
+	go func() {
+		sm.runTask(context.Background(), task, time.Now())
+		close(finished)
+	}()
+
+	<-ba.started
+	time.Sleep(200 * time.Millisecond)
+
+	running, err := driver.GetTask(task.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !running.DoAfter.After(time.Now()) {
+		t.Errorf("Expected the lease to have been extended, but it expired at %s", running.DoAfter)
+	}
+
+	close(ba.release)
+	<-finished
+
+	done, err := driver.GetTask(task.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if done.State != TaskDone {
+		t.Errorf("Expected task to be done, but was %s: %s", done.State, done.LastAttemptMessage)
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	// If the lease can't be extended, the action's context is cancelled once
+	// the lease expires, and the task retried once the action returns
+	taskName := "TestLeaseLost"
+	driver := NewMemoryDriver()
+	sm := NewSyncManager(lostLeaseDriver{driver})
+	sm.SetLease(60 * time.Millisecond)
+
+	var errs []error
+	sm.SetErrorHandler(func(err error) { errs = append(errs, err) })
+
+	ba := newBlockingTaskAction()
+
+	if err := sm.RegisterTaskHandler(ba, taskName, WithRetryDelay(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := driver.AddTask(TaskInit{Key: "a", Name: taskName}); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := sm.pop([]string{taskName})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finished := make(chan bool)
+	go func() {
+		sm.runTask(context.Background(), task, time.Now())
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		t.Fatal("Worker moved on while the action that lost its lease was still running")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(ba.release)
+	<-finished
+
+	retried, err := driver.GetTask(task.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if retried.State != TaskRetry || !strings.HasPrefix(retried.LastAttemptMessage, "Lease expired after") {
+		t.Errorf("Expected task to be retried after losing its lease, but was %s: %s", retried.State, retried.LastAttemptMessage)
+	}
+
+	if len(errs) < 2 {
+		t.Errorf("Expected the failed extensions to be reported, but had %v", errs)
+	}
+}
+
+func TestLeaseExtendRetried(t *testing.T) {
+	// A failed extension is tried again well before the next heartbeat, so a
+	// brief failure doesn't lose the lease
+	taskName := "TestLeaseExtendRetried"
+	driver := NewMemoryDriver()
+	failures := 2
+	sm := NewSyncManager(flakyLeaseDriver{driver, &failures})
+	sm.SetLease(60 * time.Millisecond)
+	sm.SetErrorHandler(func(error) {})
+
+	ba := newBlockingTaskAction()
+	time.AfterFunc(200*time.Millisecond, func() { close(ba.release) })
+
+	if err := sm.RegisterTaskHandler(ba, taskName); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := driver.AddTask(TaskInit{Key: "a", Name: taskName}); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := sm.pop([]string{taskName})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sm.runTask(context.Background(), task, time.Now())
+
+	if failures != 0 {
+		t.Fatalf("Expected extensions to have failed, but %d failures were left", failures)
+	}
+
+	done, err := driver.GetTask(task.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if done.State != TaskDone {
+		t.Errorf("Expected task to be done despite the failed extension, but was %s: %s", done.State, done.LastAttemptMessage)
+	}
+}
+
+func TestContextTaskAction(t *testing.T) {
+	// Where the driver can't extend the lease it holds the task, so the
+	// action's context has no deadline without a timeout.  It's cancelled
+	// when the SyncManager is stopped
+	taskName := "TestContextTaskAction"
+	driver := NewMemoryDriver()
+	sm := NewSyncManager(fixedLeaseDriver{driver})
+	sm.SetPollInterval(10 * time.Millisecond)
+	tm := NewTaskManager(driver)
+
+	ca := newContextTaskAction()
+
+	if err := sm.RegisterContextTaskHandler(ca, taskName); err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan bool)
+	go func() {
+		sm.Run()
+		close(stopped)
+	}()
+
+	if _, err := tm.AddTask(taskName, "a", time.Now(), "test_created_by", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case deadline := <-ca.started:
+		if !deadline.IsZero() {
+			t.Errorf("Expected no deadline, but had %s", deadline)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout before task was run")
+	}
+
+	sm.Stop()
+
+	select {
+	case err := <-ca.done:
+		if err != context.Canceled {
+			t.Errorf("Expected the context to be cancelled, but had %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Context not cancelled by Stop")
+	}
+
+	<-stopped
+}
+
+func TestAdaptActions(t *testing.T) {
+	adapted := AdaptTaskAction(resultTaskAction{result: TaskResultSuccess, message: "Done", attempts: make(chan string, 1)})
+	if result, message := adapted.DoContext(context.Background(), Task{Key: "a"}); result != TaskResultSuccess || message != "Done" {
+		t.Errorf("Expected the adapted action's result, but had %s %s", result, message)
+	}
+
+	if name := actionType(adapted); name != "queue.resultTaskAction" {
+		t.Errorf("Expected the adapted action's type, but had %s", name)
+	}
+
+	ea := NewExampleScheduledAction(make(chan bool, 1), 0)
+	if name := actionType(AdaptScheduledAction(&ea)); name != "*queue.ExampleScheduledAction" {
+		t.Errorf("Expected the adapted action's type, but had %s", name)
+	}
+}
+
+// recordingObserver Records what it's told, as "<event> <task key> <detail>"
+type recordingObserver struct {
+	mx     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(event string) {
+	o.mx.Lock()
+	o.events = append(o.events, event)
+	o.mx.Unlock()
+}
+
+func (o *recordingObserver) TaskPopped(task Task) {
+	o.record("popped " + task.Key)
+}
+
+func (o *recordingObserver) TaskHandled(task Task, result TaskResult, duration time.Duration) {
+	o.record("handled " + task.Key + " " + string(result))
+}
+
+func (o *recordingObserver) TaskFinished(task Task, outcome TaskOutcome, err error) {
+	o.record("finished " + task.Key + " " + string(outcome))
+}
+
+func (o *recordingObserver) ScheduledActionRun(stream string, action ContextScheduledAction, duration time.Duration, err error, panicked bool) {
+	o.record(fmt.Sprintf("scheduled %s %t %t", stream, err != nil, panicked))
+}
+
+func TestObserver(t *testing.T) {
+	driver := NewMemoryDriver()
+	sm := NewSyncManager(driver)
+	sm.SetErrorHandler(func(error) {})
+
+	observer := &recordingObserver{}
+	sm.SetObserver(observer)
+
+	attempts := make(chan string, 10)
+	handlers := map[string]TaskResult{
+		"succeeds": TaskResultSuccess,
+		"retries":  TaskResultRetryFailure,
+		"fails":    TaskResultPermanentFailure,
+	}
+
+	for name, result := range handlers {
+		if err := sm.RegisterTaskHandler(resultTaskAction{result: result, message: "Message", attempts: attempts}, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"succeeds", "retries", "fails", "unhandled"} {
+		if _, err := driver.AddTask(TaskInit{Key: name, Name: name}); err != nil {
+			t.Fatal(err)
+		}
+
+		task, err := driver.Pop(PopOptions{Names: []string{name}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sm.runTask(context.Background(), task, time.Now())
+	}
+
+	expected := []string{
+		"popped succeeds", "handled succeeds SUCCESS", "finished succeeds completed",
+		"popped retries", "handled retries RETRY", "finished retries retried",
+		"popped fails", "handled fails ERROR", "finished fails failed",
+		"popped unhandled", "finished unhandled cancelled",
+	}
+
+	if !reflect.DeepEqual(observer.events, expected) {
+		t.Errorf("Expected events %v, but had %v", expected, observer.events)
+	}
+
+	// Scheduled actions, including those that panic, run here rather than on
+	// a schedule that would keep going after the test:
+	observer.events = nil
+	results := make(chan bool, 1)
+	ea := NewExampleScheduledAction(results, 1)
+	action := AdaptScheduledAction(&ea)
+
+	sm.runScheduledAction(action)
+	sm.runScheduledAction(action)
+
+	if expected = []string{"scheduled test true true", "scheduled test false false"}; !reflect.DeepEqual(observer.events, expected) {
+		t.Errorf("Expected events %v, but had %v", expected, observer.events)
+	}
+}
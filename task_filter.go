@@ -0,0 +1,211 @@
+package queue
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TaskReader Implemented by drivers that can look up tasks in the queue
+// without popping them, such as to find out what happened to a task
+type TaskReader interface {
+	// GetTask Returns the task with the given ID, or ErrTaskNotFound
+	GetTask(id string) (Task, error)
+	// ListTasks Returns the tasks selected by filter, most recently created
+	// first
+	ListTasks(filter TaskFilter) ([]Task, error)
+	// CountTasks Returns how many of the tasks selected by filter there are
+	// for each name and state, ordered by name and state
+	CountTasks(filter TaskFilter) ([]TaskCount, error)
+}
+
+// TaskCount The number of tasks in the queue with a name and state
+type TaskCount struct {
+	Name  string
+	State TaskState
+	Count int64
+}
+
+// TaskEditor Implemented by drivers that can change tasks in the queue other
+// than by popping them, such as to cancel a task that's no longer wanted.
+// Each method returns how many tasks were changed
+type TaskEditor interface {
+	// CancelTasks Cancels the pending tasks selected by filter.  Tasks being
+	// performed are left alone
+	CancelTasks(filter TaskFilter, message string) (int64, error)
+	// RescheduleTasks Sets when the pending tasks selected by filter are to
+	// be performed.  Tasks being performed are left alone
+	RescheduleTasks(filter TaskFilter, doAfter time.Time) (int64, error)
+	// RequeueTasks Puts the failed and cancelled tasks selected by filter back
+	// in the queue, ready to be performed after doAfter, with attempts reset
+	RequeueTasks(filter TaskFilter, doAfter time.Time) (int64, error)
+	// PurgeTasks Deletes the finished (done, failed or cancelled) tasks
+	// selected by filter
+	PurgeTasks(filter TaskFilter) (int64, error)
+}
+
+// pendingStates States of tasks waiting to be performed, which may be
+// cancelled or rescheduled
+var pendingStates = []TaskState{TaskReady, TaskRetry}
+
+// finishedStates States of tasks that may be requeued
+var finishedStates = []TaskState{TaskFailed, TaskCancelled}
+
+// purgeableStates States of tasks that may be deleted
+var purgeableStates = []TaskState{TaskDone, TaskFailed, TaskCancelled}
+
+// TaskFilter Selects tasks in the queue.  Each field that is set narrows the
+// selection, so the zero value selects every task.  Limit and Offset are only
+// for listing tasks
+type TaskFilter struct {
+	IDs           []string    // Tasks with one of these IDs
+	Names         []string    // Tasks with one of these names
+	Keys          []string    // Tasks with one of these keys
+	States        []TaskState // Tasks in one of these states
+	CreatedBy     string      // Tasks created by this
+	CreatedAfter  time.Time   // Tasks created at or after this time
+	CreatedBefore time.Time   // Tasks created before this time
+	DueAfter      time.Time   // Tasks with a do_after at or after this time
+	DueBefore     time.Time   // Tasks with a do_after before this time
+
+	Limit  int // The most tasks to return.  No limit if zero
+	Offset int // How many of the selected tasks to skip, for paging
+}
+
+// matches Whether the task is selected by f, ignoring Limit and Offset
+func (f TaskFilter) matches(id string, key string, name string, state TaskState, createdBy string, created time.Time, doAfter time.Time) bool {
+	if len(f.IDs) > 0 && !containsString(f.IDs, id) {
+		return false
+	}
+
+	if len(f.Names) > 0 && !containsString(f.Names, name) {
+		return false
+	}
+
+	if len(f.Keys) > 0 && !containsString(f.Keys, key) {
+		return false
+	}
+
+	if len(f.States) > 0 && !containsState(f.States, state) {
+		return false
+	}
+
+	if len(f.CreatedBy) > 0 && createdBy != f.CreatedBy {
+		return false
+	}
+
+	return inRange(created, f.CreatedAfter, f.CreatedBefore) && inRange(doAfter, f.DueAfter, f.DueBefore)
+}
+
+// condition Returns a SQL condition selecting the tasks matched by f, with
+// placeholders numbered from first.  primaryKey is the ID column, and
+// timeValue converts times to the driver's representation
+func (f TaskFilter) condition(first int, primaryKey string, timeValue func(time.Time) interface{}) (string, []interface{}) {
+	conditions := []string{"1 = 1"}
+	var args []interface{}
+
+	placeholder := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", first+len(args)-1)
+	}
+
+	in := func(column string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+
+		p := make([]string, len(values))
+		for i, v := range values {
+			p[i] = placeholder(v)
+		}
+
+		conditions = append(conditions, column+" IN ("+strings.Join(p, ", ")+")")
+	}
+
+	compare := func(column string, op string, t time.Time) {
+		if !t.IsZero() {
+			conditions = append(conditions, column+" "+op+" "+placeholder(timeValue(t)))
+		}
+	}
+
+	states := make([]string, len(f.States))
+	for i, s := range f.States {
+		states[i] = string(s)
+	}
+
+	in(primaryKey, f.IDs)
+	in("task_name", f.Names)
+	in("task_key", f.Keys)
+	in("state", states)
+
+	if len(f.CreatedBy) > 0 {
+		conditions = append(conditions, "created_by = "+placeholder(f.CreatedBy))
+	}
+
+	compare("created_at", ">=", f.CreatedAfter)
+	compare("created_at", "<", f.CreatedBefore)
+	compare("do_after", ">=", f.DueAfter)
+	compare("do_after", "<", f.DueBefore)
+
+	return strings.Join(conditions, " AND "), args
+}
+
+// page Returns the LIMIT and OFFSET clauses for f, with placeholders numbered
+// from first.  unlimited is the driver's LIMIT for no limit, since SQLite
+// needs one before an OFFSET
+func (f TaskFilter) page(first int, unlimited string) (string, []interface{}) {
+	var clause string
+	var args []interface{}
+
+	if f.Limit > 0 {
+		args = append(args, f.Limit)
+		clause += fmt.Sprintf(" LIMIT $%d", first+len(args)-1)
+	}
+
+	if f.Offset > 0 {
+		if f.Limit <= 0 {
+			clause += " LIMIT " + unlimited
+		}
+
+		args = append(args, f.Offset)
+		clause += fmt.Sprintf(" OFFSET $%d", first+len(args)-1)
+	}
+
+	return clause, args
+}
+
+// inRange Whether t is at or after from, and before to.  Zero times are no
+// limit
+func inRange(t time.Time, from time.Time, to time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkUnpaged Returns an error if f pages through tasks, which is only for
+// listing them
+func (f TaskFilter) checkUnpaged() error {
+	if f.Limit != 0 || f.Offset != 0 {
+		return fmt.Errorf("limit and offset can only be used when listing tasks")
+	}
+
+	return nil
+}
+
+func containsState(states []TaskState, state TaskState) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+
+	return false
+}
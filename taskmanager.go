@@ -1,6 +1,11 @@
 package queue
 
-import "time"
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
 
 // NewTaskManager Returns a task manager
 func NewTaskManager(driver Driver) TaskManager {
@@ -15,17 +20,262 @@ type TaskManager struct {
 	driver Driver
 }
 
-// AddTask Add a task to the queue
-func (tm *TaskManager) AddTask(taskName string, taskKey string, doAfter time.Time, createdBy string, data map[string]interface{}) error {
-	return tm.driver.addTask(TaskInit{
-		Key:       taskKey,
-		Name:      taskName,
-		DoAfter:   doAfter,
-		CreatedBy: createdBy,
-		Data:      data,
-	})
+// AddTask Add a task to the queue, returning its ID.  Options can make sure
+// the task isn't added twice, in which case the ID of the existing task is
+// returned
+func (tm *TaskManager) AddTask(taskName string, taskKey string, doAfter time.Time, createdBy string, data map[string]interface{}, opts ...AddTaskOption) (string, error) {
+	return tm.driver.AddTask(newTaskInit(taskName, taskKey, doAfter, createdBy, data, opts))
+}
+
+// AddTaskTx Adds a task as part of the given transaction, so that the task is
+// only added if the transaction is committed.  Returns ErrNotSupported if the
+// driver can't use a database/sql transaction
+func (tm *TaskManager) AddTaskTx(tx *sql.Tx, taskName string, taskKey string, doAfter time.Time, createdBy string, data map[string]interface{}, opts ...AddTaskOption) (string, error) {
+	d, ok := tm.driver.(SQLTxDriver)
+
+	if !ok {
+		return "", ErrNotSupported
+	}
+
+	return d.AddTaskTx(tx, newTaskInit(taskName, taskKey, doAfter, createdBy, data, opts))
+}
+
+// AddTaskPgxTx Adds a task as part of the given pgx transaction, so that the
+// task is only added if the transaction is committed.  Returns ErrNotSupported
+// if the driver can't use a pgx transaction
+func (tm *TaskManager) AddTaskPgxTx(tx pgx.Tx, taskName string, taskKey string, doAfter time.Time, createdBy string, data map[string]interface{}, opts ...AddTaskOption) (string, error) {
+	d, ok := tm.driver.(PgxTxDriver)
+
+	if !ok {
+		return "", ErrNotSupported
+	}
+
+	return d.AddTaskTx(tx, newTaskInit(taskName, taskKey, doAfter, createdBy, data, opts))
 }
 
 func (tm *TaskManager) GetTaskCount(taskName string) (int64, error) {
-	return tm.driver.getTaskCount(taskName)
+	return tm.driver.GetTaskCount(taskName)
+}
+
+// reader Returns the driver's TaskReader, or ErrNotSupported
+func (tm *TaskManager) reader() (TaskReader, error) {
+	r, ok := tm.driver.(TaskReader)
+
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	return r, nil
+}
+
+// GetTask Returns the task in the queue with the given ID, including when it
+// was last attempted and with what message.  Tasks that have been moved to
+// the dead-letter store are found with GetDeadTask instead
+func (tm *TaskManager) GetTask(id string) (Task, error) {
+	r, err := tm.reader()
+
+	if err != nil {
+		return Task{}, err
+	}
+
+	return r.GetTask(id)
+}
+
+// ListTasks Returns the tasks in the queue selected by filter, most recently
+// created first.  Returns ErrNotSupported if the driver can't look up tasks
+func (tm *TaskManager) ListTasks(filter TaskFilter) ([]Task, error) {
+	r, err := tm.reader()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return r.ListTasks(filter)
+}
+
+// CountTasks Returns how many of the tasks selected by filter there are for
+// each name and state
+func (tm *TaskManager) CountTasks(filter TaskFilter) ([]TaskCount, error) {
+	r, err := tm.reader()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return r.CountTasks(filter)
+}
+
+// editor Returns the driver's TaskEditor, or ErrNotSupported
+func (tm *TaskManager) editor() (TaskEditor, error) {
+	e, ok := tm.driver.(TaskEditor)
+
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	return e, nil
+}
+
+// editTask Applies edit to the task with the given ID, returning
+// ErrTaskNotFound if it wasn't changed
+func (tm *TaskManager) editTask(id string, edit func(TaskEditor, TaskFilter) (int64, error)) error {
+	e, err := tm.editor()
+
+	if err != nil {
+		return err
+	}
+
+	n, err := edit(e, TaskFilter{IDs: []string{id}})
+
+	if err == nil && n == 0 {
+		err = ErrTaskNotFound
+	}
+
+	return err
+}
+
+// CancelTask Cancels the pending task with the given ID, so that it won't be
+// performed.  Returns ErrTaskNotFound if there's no such task waiting to be
+// performed, such as when it's being performed right now
+func (tm *TaskManager) CancelTask(id string, message string) error {
+	return tm.editTask(id, func(e TaskEditor, filter TaskFilter) (int64, error) {
+		return e.CancelTasks(filter, message)
+	})
+}
+
+// CancelTasks Cancels the pending tasks selected by filter, such as all tasks
+// for a key, returning how many were cancelled.  Tasks being performed are
+// left alone
+func (tm *TaskManager) CancelTasks(filter TaskFilter, message string) (int64, error) {
+	e, err := tm.editor()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return e.CancelTasks(filter, message)
+}
+
+// RescheduleTask Changes when the pending task with the given ID is to be
+// performed.  Returns ErrTaskNotFound if there's no such task waiting to be
+// performed
+func (tm *TaskManager) RescheduleTask(id string, doAfter time.Time) error {
+	return tm.editTask(id, func(e TaskEditor, filter TaskFilter) (int64, error) {
+		return e.RescheduleTasks(filter, doAfter)
+	})
+}
+
+// RescheduleTasks Changes when the pending tasks selected by filter are to be
+// performed, returning how many were changed
+func (tm *TaskManager) RescheduleTasks(filter TaskFilter, doAfter time.Time) (int64, error) {
+	e, err := tm.editor()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return e.RescheduleTasks(filter, doAfter)
+}
+
+// RequeueTask Puts the failed or cancelled task with the given ID back in the
+// queue, to be performed after doAfter with its attempts reset.  Returns
+// ErrTaskNotFound if there's no such task.  Tasks in the dead-letter store are
+// requeued with RequeueDeadTask instead
+func (tm *TaskManager) RequeueTask(id string, doAfter time.Time) error {
+	return tm.editTask(id, func(e TaskEditor, filter TaskFilter) (int64, error) {
+		return e.RequeueTasks(filter, doAfter)
+	})
+}
+
+// RequeueTasks Puts the failed and cancelled tasks selected by filter back in
+// the queue, returning how many were requeued
+func (tm *TaskManager) RequeueTasks(filter TaskFilter, doAfter time.Time) (int64, error) {
+	e, err := tm.editor()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return e.RequeueTasks(filter, doAfter)
+}
+
+// PurgeTasks Deletes the done, failed and cancelled tasks selected by filter,
+// such as those created more than a month ago, returning how many were deleted
+func (tm *TaskManager) PurgeTasks(filter TaskFilter) (int64, error) {
+	e, err := tm.editor()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return e.PurgeTasks(filter)
+}
+
+// deadLetter Returns the driver's dead-letter store, or ErrNotSupported
+func (tm *TaskManager) deadLetter() (DeadLetterDriver, error) {
+	dl, ok := tm.driver.(DeadLetterDriver)
+
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	return dl, nil
+}
+
+// ListDeadTasks Returns permanently failed tasks, most recently failed first.
+// Returns ErrNotSupported if the driver has no dead-letter store
+func (tm *TaskManager) ListDeadTasks(limit int, offset int) ([]DeadTask, error) {
+	dl, err := tm.deadLetter()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return dl.ListDeadTasks(limit, offset)
+}
+
+// GetDeadTask Returns the permanently failed task with the given ID
+func (tm *TaskManager) GetDeadTask(id string) (DeadTask, error) {
+	dl, err := tm.deadLetter()
+
+	if err != nil {
+		return DeadTask{}, err
+	}
+
+	return dl.GetDeadTask(id)
+}
+
+// RequeueDeadTask Puts a permanently failed task back in the queue, to be
+// performed after doAfter
+func (tm *TaskManager) RequeueDeadTask(id string, doAfter time.Time) error {
+	dl, err := tm.deadLetter()
+
+	if err != nil {
+		return err
+	}
+
+	return dl.RequeueDeadTask(id, doAfter)
+}
+
+// PurgeDeadTask Deletes a permanently failed task
+func (tm *TaskManager) PurgeDeadTask(id string) error {
+	dl, err := tm.deadLetter()
+
+	if err != nil {
+		return err
+	}
+
+	return dl.PurgeDeadTask(id)
+}
+
+// PurgeDeadTasks Deletes permanently failed tasks that failed before the given
+// time, returning how many were deleted
+func (tm *TaskManager) PurgeDeadTasks(failedBefore time.Time) (int64, error) {
+	dl, err := tm.deadLetter()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return dl.PurgeDeadTasks(failedBefore)
 }
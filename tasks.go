@@ -18,14 +18,42 @@ var (
 	TaskResultPermanentFailure TaskResult = "ERROR"
 	// TaskResultRetryFailure Task resulted in an error, but can be retried later
 	TaskResultRetryFailure TaskResult = "RETRY"
+	// TaskResultTimeout Task's action didn't return before its timeout, and is
+	// retried as for TaskResultRetryFailure.  Set by SyncManager rather than
+	// returned by actions
+	TaskResultTimeout TaskResult = "TIMEOUT"
 )
 
+// TaskInit Details for a new task to be added to the queue
 type TaskInit struct {
 	Key       string
 	Name      string
 	DoAfter   time.Time
 	CreatedBy string
 	Data      map[string]interface{} // Storage of information that the action handler can use
+	Metadata  map[string]string      // Stored alongside the data, for use by the queue rather than the action
+
+	IdempotencyKey string         // Identifies repeated requests to add the same task.  Optional
+	Unique         Uniqueness     // How to match tasks in the queue that this would duplicate.  Always added if empty
+	UniqueWithin   time.Duration  // Matches tasks created within this long, in any state.  Only unfinished tasks if zero
+	OnConflict     ConflictPolicy // What to do with matching tasks
+}
+
+// newTaskInit Returns the details for a new task, with options applied
+func newTaskInit(taskName string, taskKey string, doAfter time.Time, createdBy string, data map[string]interface{}, opts []AddTaskOption) TaskInit {
+	init := TaskInit{
+		Key:       taskKey,
+		Name:      taskName,
+		DoAfter:   doAfter,
+		CreatedBy: createdBy,
+		Data:      data,
+	}
+
+	for _, opt := range opts {
+		opt(&init)
+	}
+
+	return init
 }
 
 // Task A task to be performed
@@ -36,10 +64,43 @@ type Task struct {
 	Created    time.Time
 	CreatedBy  string
 	State      TaskState
+	Attempts   int                    // How many times the task has been popped, including this time
 	Data       map[string]interface{} // Storage of information that the action handler can use
 	RawData    []byte                 // The data before it's been unmarshalled
+	Metadata   map[string]string      // Stored by the queue alongside the data, as given by WithMetadata
 	tx         *sql.Tx                // Can be used by drivers to store an open transaction.  Useful when using, e.g., skip locked
 	driverNote interface{}            // General storage for a driver to put a note or anything in
+
+	// When the task is next due to be performed.  Pop sets it to when the
+	// task will be reclaimed for another attempt if it hasn't been finished
+	DoAfter time.Time
+
+	// Filled in by TaskReader, for looking into what happened to a task:
+	LastAttempted      time.Time // When the task was last popped or changed state
+	LastAttemptMessage string    // The message recorded with the task's last change of state
+}
+
+// ID Returns the driver's reference for this task
+func (t Task) ID() string {
+	return t.id
+}
+
+// SetID Sets the driver's reference for this task.  For use by drivers
+func (t *Task) SetID(id string) {
+	t.id = id
+}
+
+// DriverNote Returns whatever the driver stored against this task when it was
+// popped, such as an open transaction
+func (t Task) DriverNote() interface{} {
+	return t.driverNote
+}
+
+// SetDriverNote Stores driver specific state against the task, which is
+// handed back to the driver when the task is completed or cleaned up.  For use
+// by drivers
+func (t *Task) SetDriverNote(note interface{}) {
+	t.driverNote = note
 }
 
 // TaskState Allowable states for a task
@@ -0,0 +1,3 @@
+-- Counts how many times each task has been popped, so that retry delays can
+-- grow with each failure.  Safe to run against an existing queue table
+ALTER TABLE public.message_queue ADD COLUMN IF NOT EXISTS attempts integer NOT NULL DEFAULT 0;
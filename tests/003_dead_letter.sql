@@ -0,0 +1,17 @@
+-- Failed tasks are moved here when the driver is given the table with
+-- SetDeadLetterTable
+CREATE TABLE IF NOT EXISTS public.message_queue_dead
+(
+    message_queue_id     uuid        NOT NULL,
+    data                 jsonb       NOT NULL DEFAULT '{}',
+    task_key             varchar(64) NOT NULL,
+    task_name            varchar(64) NOT NULL,
+    created_at           timestamptz,
+    created_by           varchar(64) NOT NULL,
+    attempts             integer     NOT NULL DEFAULT 0,
+    last_attempt_message varchar     NOT NULL,
+    failed_at            timestamptz NOT NULL DEFAULT Now(),
+    CONSTRAINT message_queue_dead_pk PRIMARY KEY (message_queue_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_queue_dead_failed_at ON public.message_queue_dead (failed_at);
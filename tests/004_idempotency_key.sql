@@ -0,0 +1,6 @@
+-- Lets callers add a task with an idempotency key, so that repeated requests
+-- don't add it twice.  Safe to run against an existing queue table
+ALTER TABLE public.message_queue ADD COLUMN IF NOT EXISTS idempotency_key varchar(128);
+
+CREATE INDEX IF NOT EXISTS idx_message_queue_key ON public.message_queue (task_key, task_name);
+CREATE INDEX IF NOT EXISTS idx_message_queue_idempotency_key ON public.message_queue (idempotency_key) WHERE idempotency_key IS NOT NULL;
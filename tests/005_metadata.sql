@@ -0,0 +1,3 @@
+-- Stores metadata alongside each task's data, such as the trace it was added
+-- in.  Safe to run against an existing queue table
+ALTER TABLE public.message_queue ADD COLUMN IF NOT EXISTS metadata jsonb NOT NULL DEFAULT '{}';
@@ -0,0 +1,7 @@
+-- Keeps the history of each task's attempts, and carries everything about a
+-- task into the dead-letter table so that it survives being requeued.  Safe
+-- to run against existing tables
+ALTER TABLE public.message_queue ADD COLUMN IF NOT EXISTS history jsonb NOT NULL DEFAULT '[]';
+ALTER TABLE public.message_queue_dead ADD COLUMN IF NOT EXISTS idempotency_key varchar(128);
+ALTER TABLE public.message_queue_dead ADD COLUMN IF NOT EXISTS metadata jsonb NOT NULL DEFAULT '{}';
+ALTER TABLE public.message_queue_dead ADD COLUMN IF NOT EXISTS history jsonb NOT NULL DEFAULT '[]';
@@ -0,0 +1,67 @@
+package queue
+
+import (
+	"context"
+	"time"
+)
+
+// TaskStep A step SyncManager takes for a task, traced by a Tracer
+type TaskStep string
+
+var (
+	// TaskStepPop Taking the task from the queue
+	TaskStepPop TaskStep = "pop"
+	// TaskStepDo Running the task's action
+	TaskStepDo TaskStep = "do"
+	// TaskStepComplete Marking the task as done
+	TaskStepComplete TaskStep = "complete"
+	// TaskStepFail Failing the task permanently
+	TaskStepFail TaskStep = "fail"
+	// TaskStepRetry Marking the task to be retried
+	TaskStepRetry TaskStep = "retry"
+	// TaskStepCancel Cancelling the task
+	TaskStepCancel TaskStep = "cancel"
+)
+
+// outcomeSteps The step that records each outcome with the driver
+var outcomeSteps = map[TaskOutcome]TaskStep{
+	TaskOutcomeCompleted: TaskStepComplete,
+	TaskOutcomeFailed:    TaskStepFail,
+	TaskOutcomeRetried:   TaskStepRetry,
+	TaskOutcomeCancelled: TaskStepCancel,
+}
+
+// Tracer Traces the work SyncManager does for each task, so that it can be
+// followed back to where the task was added.  The tracing module implements
+// this with OpenTelemetry
+type Tracer interface {
+	// StartTask Starts the span covering everything done for a popped task,
+	// from started, when the pop began.  The span can be linked to the trace
+	// the task was added in, using the task's Metadata
+	StartTask(ctx context.Context, task Task, started time.Time) (context.Context, Span)
+	// StartStep Starts a span for one step taken for the task, within the
+	// task's span in ctx
+	StartStep(ctx context.Context, step TaskStep, task Task, started time.Time) (context.Context, Span)
+}
+
+// Span A span started by a Tracer
+type Span interface {
+	// End Ends the span.  result is the result of the task's action, if it
+	// has been run, and err the error from the step, if any
+	End(result TaskResult, err error)
+}
+
+// noopTracer The tracer used until one is set
+type noopTracer struct{}
+
+func (noopTracer) StartTask(ctx context.Context, task Task, started time.Time) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func (noopTracer) StartStep(ctx context.Context, step TaskStep, task Task, started time.Time) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) End(TaskResult, error) {}
@@ -0,0 +1,12 @@
+module github.com/episub/queue/tracing
+
+go 1.16
+
+require (
+	github.com/episub/queue v0.0.0
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/sdk v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
+)
+
+replace github.com/episub/queue => ../
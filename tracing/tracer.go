@@ -0,0 +1,143 @@
+// Package tracing follows tasks with OpenTelemetry, from the request that
+// added a task to the run that performs it, possibly minutes later.  The
+// span context is stored with the task as a W3C traceparent when it's added:
+//
+//	tm.AddTask("sendEmail", key, time.Now(), "api", data, tracing.WithTraceContext(r.Context()))
+//
+// and SyncManager traces each task it runs in a span linked to that one:
+//
+//	sm.SetTracer(tracing.NewTracer())
+//
+// It lives in a module of its own, so that the queue itself doesn't depend on
+// OpenTelemetry.
+package tracing
+
+import (
+	"context"
+	"time"
+
+	"github.com/episub/queue"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/episub/queue/tracing"
+
+// Attributes set on each span
+const (
+	TaskIDKey       = attribute.Key("queue.task.id")
+	TaskNameKey     = attribute.Key("queue.task.name")
+	TaskKeyKey      = attribute.Key("queue.task.key")
+	TaskAttemptsKey = attribute.Key("queue.task.attempts")
+	TaskResultKey   = attribute.Key("queue.task.result")
+)
+
+// propagator Stores the span context with tasks.  Always W3C trace context,
+// whatever the global propagator, so that tasks added by one service can be
+// traced by another
+var propagator = propagation.TraceContext{}
+
+// WithTraceContext Stores the span context in ctx with the task being added,
+// so that the spans for running the task are linked to it
+func WithTraceContext(ctx context.Context) queue.AddTaskOption {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+
+	return queue.WithMetadata(carrier)
+}
+
+// Tracer Implements queue.Tracer with OpenTelemetry
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// config Settings for a new Tracer
+type config struct {
+	provider trace.TracerProvider
+}
+
+// Option Configures a Tracer
+type Option func(*config)
+
+// WithTracerProvider Sets the provider to create spans with.  Defaults to
+// the global provider
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(c *config) {
+		c.provider = provider
+	}
+}
+
+// NewTracer Returns a tracer for SyncManager.SetTracer
+func NewTracer(opts ...Option) *Tracer {
+	cfg := config{provider: otel.GetTracerProvider()}
+
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return &Tracer{tracer: cfg.provider.Tracer(instrumentationName)}
+}
+
+// StartTask Implements queue.Tracer.  The span is linked to the one the task
+// was added in, if it was added with WithTraceContext
+func (t *Tracer) StartTask(ctx context.Context, task queue.Task, started time.Time) (context.Context, queue.Span) {
+	opts := []trace.SpanStartOption{
+		trace.WithTimestamp(started),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(taskAttributes(task)...),
+	}
+
+	added := trace.SpanContextFromContext(propagator.Extract(context.Background(), propagation.MapCarrier(task.Metadata)))
+	if added.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: added}))
+	}
+
+	ctx, span := t.tracer.Start(ctx, "queue.task", opts...)
+
+	return ctx, taskSpan{span}
+}
+
+// StartStep Implements queue.Tracer
+func (t *Tracer) StartStep(ctx context.Context, step queue.TaskStep, task queue.Task, started time.Time) (context.Context, queue.Span) {
+	ctx, span := t.tracer.Start(ctx, "queue."+string(step),
+		trace.WithTimestamp(started),
+		trace.WithAttributes(taskAttributes(task)...),
+	)
+
+	return ctx, taskSpan{span}
+}
+
+func taskAttributes(task queue.Task) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		TaskIDKey.String(task.ID()),
+		TaskNameKey.String(task.Name),
+		TaskKeyKey.String(task.Key),
+		TaskAttemptsKey.Int(task.Attempts),
+	}
+}
+
+// taskSpan Implements queue.Span
+type taskSpan struct {
+	span trace.Span
+}
+
+// End Records the result and error, marking the span as failed if either is
+// a failure
+func (s taskSpan) End(result queue.TaskResult, err error) {
+	if len(result) > 0 {
+		s.span.SetAttributes(TaskResultKey.String(string(result)))
+	}
+
+	switch {
+	case err != nil:
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	case result == queue.TaskResultPermanentFailure || result == queue.TaskResultRetryFailure || result == queue.TaskResultTimeout:
+		s.span.SetStatus(codes.Error, string(result))
+	}
+
+	s.span.End()
+}
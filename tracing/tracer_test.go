@@ -0,0 +1,143 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/episub/queue"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// resultAction Returns the same result for every task
+type resultAction struct {
+	result queue.TaskResult
+}
+
+func (a resultAction) Do(task queue.Task) (queue.TaskResult, string) {
+	return a.result, "Message"
+}
+
+// attributeValue Returns the span's value for the attribute, if set
+func attributeValue(span sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+
+	return attribute.Value{}, false
+}
+
+// runTasks Runs tasks until the recorder has seen the given number of task
+// spans end
+func runTasks(t *testing.T, driver queue.Driver, recorder *tracetest.SpanRecorder, provider *sdktrace.TracerProvider, tasks int) map[string][]sdktrace.ReadOnlySpan {
+	t.Helper()
+
+	sm := queue.NewSyncManager(driver)
+	sm.SetErrorHandler(func(error) {})
+	sm.SetPollInterval(10 * time.Millisecond)
+	sm.SetTracer(NewTracer(WithTracerProvider(provider)))
+
+	for name, result := range map[string]queue.TaskResult{"sendEmail": queue.TaskResultSuccess, "syncInvoice": queue.TaskResultRetryFailure} {
+		if err := sm.RegisterTaskHandler(resultAction{result: result}, name, queue.WithRetryDelay(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	go sm.Run()
+	defer sm.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		spans := make(map[string][]sdktrace.ReadOnlySpan)
+		for _, span := range recorder.Ended() {
+			spans[span.Name()] = append(spans[span.Name()], span)
+		}
+
+		if len(spans["queue.task"]) >= tasks {
+			return spans
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %d task spans, had %d", tasks, len(spans["queue.task"]))
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	driver := queue.NewMemoryDriver()
+	tm := queue.NewTaskManager(driver)
+
+	// The task is added while handling a request:
+	ctx, request := provider.Tracer("test").Start(context.Background(), "request")
+
+	id, err := tm.AddTask("sendEmail", "customer1", time.Now(), "test", nil, WithTraceContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request.End()
+
+	spans := runTasks(t, driver, recorder, provider, 1)
+	task := spans["queue.task"][0]
+
+	if links := task.Links(); len(links) != 1 || links[0].SpanContext.SpanID() != request.SpanContext().SpanID() {
+		t.Errorf("Expected task span to be linked to the request span, but had links %v", links)
+	}
+
+	if v, _ := attributeValue(task, TaskIDKey); v.AsString() != id {
+		t.Errorf("Expected task ID %s, but had %q", id, v.AsString())
+	}
+
+	if v, _ := attributeValue(task, TaskResultKey); v.AsString() != string(queue.TaskResultSuccess) {
+		t.Errorf("Expected result %s, but had %q", queue.TaskResultSuccess, v.AsString())
+	}
+
+	for _, step := range []string{"queue.pop", "queue.do", "queue.complete"} {
+		if len(spans[step]) != 1 {
+			t.Errorf("Expected one %s span, but had %d", step, len(spans[step]))
+			continue
+		}
+
+		if parent := spans[step][0].Parent().SpanID(); parent != task.SpanContext().SpanID() {
+			t.Errorf("Expected %s span to be within the task span", step)
+		}
+	}
+}
+
+func TestTracerFailure(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	driver := queue.NewMemoryDriver()
+	tm := queue.NewTaskManager(driver)
+
+	// Added without a trace context, so has nothing to link to:
+	if _, err := tm.AddTask("syncInvoice", "invoice1", time.Now(), "test", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := runTasks(t, driver, recorder, provider, 1)
+	task := spans["queue.task"][0]
+
+	if len(task.Links()) != 0 {
+		t.Errorf("Expected no links, but had %v", task.Links())
+	}
+
+	if task.Status().Code != codes.Error {
+		t.Errorf("Expected the task span to be marked as failed, but was %v", task.Status())
+	}
+
+	if len(spans["queue.retry"]) != 1 {
+		t.Errorf("Expected a retry span, but had %d", len(spans["queue.retry"]))
+	}
+}
@@ -0,0 +1,153 @@
+package queue
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Uniqueness How a new task is matched against tasks already in the queue,
+// so that the same task isn't added twice
+type Uniqueness string
+
+var (
+	// UniqueNone Tasks are always added
+	UniqueNone Uniqueness = ""
+	// UniqueByKey Matches tasks with the same key
+	UniqueByKey Uniqueness = "KEY"
+	// UniqueByKeyAndName Matches tasks with the same key and name
+	UniqueByKeyAndName Uniqueness = "KEY_NAME"
+	// UniqueByIdempotencyKey Matches tasks with the same idempotency key
+	UniqueByIdempotencyKey Uniqueness = "IDEMPOTENCY_KEY"
+)
+
+// ConflictPolicy What to do when a new task matches one already in the queue
+type ConflictPolicy string
+
+var (
+	// ConflictIgnore The new task is dropped
+	ConflictIgnore ConflictPolicy = ""
+	// ConflictReplaceData Matching tasks that are ready take the new task's
+	// data, and the new task is dropped
+	ConflictReplaceData ConflictPolicy = "REPLACE_DATA"
+	// ConflictResetDoAfter Matching tasks that are ready take the new task's
+	// do_after, and the new task is dropped
+	ConflictResetDoAfter ConflictPolicy = "RESET_DO_AFTER"
+)
+
+// AddTaskOption Configures a task being added to the queue
+type AddTaskOption func(*TaskInit)
+
+// WithUnique Only adds the task if it doesn't match one already in the queue.
+// Without WithUniqueWithin, only unfinished tasks are matched
+func WithUnique(u Uniqueness) AddTaskOption {
+	return func(t *TaskInit) {
+		t.Unique = u
+	}
+}
+
+// WithIdempotencyKey Stores the key against the task, and only adds the task
+// if no other task has the same key.  Useful when a request to add a task may
+// be repeated, such as when an API call is retried
+func WithIdempotencyKey(key string) AddTaskOption {
+	return func(t *TaskInit) {
+		t.IdempotencyKey = key
+		t.Unique = UniqueByIdempotencyKey
+	}
+}
+
+// WithUniqueWithin Matches tasks created within the window, whatever their
+// state, rather than only unfinished tasks.  This way a task that has already
+// been completed isn't repeated
+func WithUniqueWithin(window time.Duration) AddTaskOption {
+	return func(t *TaskInit) {
+		t.UniqueWithin = window
+	}
+}
+
+// WithOnConflict Sets what to do when the task matches one already in the
+// queue.  Defaults to ConflictIgnore
+func WithOnConflict(policy ConflictPolicy) AddTaskOption {
+	return func(t *TaskInit) {
+		t.OnConflict = policy
+	}
+}
+
+// checkUnique Returns an error if the task's uniqueness settings can't be used
+func checkUnique(t TaskInit) error {
+	switch t.Unique {
+	case UniqueNone, UniqueByKey, UniqueByKeyAndName:
+	case UniqueByIdempotencyKey:
+		if len(t.IdempotencyKey) == 0 {
+			return fmt.Errorf("unique by idempotency key, but task has no idempotency key")
+		}
+	default:
+		return fmt.Errorf("unknown uniqueness %s", t.Unique)
+	}
+
+	switch t.OnConflict {
+	case ConflictIgnore, ConflictReplaceData, ConflictResetDoAfter:
+	default:
+		return fmt.Errorf("unknown conflict policy %s", t.OnConflict)
+	}
+
+	return nil
+}
+
+// uniqueValue Identifies the tasks that t may match, for use as a lock key
+func uniqueValue(t TaskInit) string {
+	switch t.Unique {
+	case UniqueByKey:
+		return "key:" + t.Key
+	case UniqueByKeyAndName:
+		return "key_name:" + t.Key + ":" + t.Name
+	default:
+		return "idempotency_key:" + t.IdempotencyKey
+	}
+}
+
+// uniqueCondition Returns a SQL condition matching the tasks that t would
+// duplicate, with placeholders numbered from first.  cutoff is the earliest
+// creation time matched, in the driver's representation, and is only used
+// if t.UniqueWithin is set
+func uniqueCondition(t TaskInit, first int, cutoff interface{}) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	arg := func(column string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf("%s = $%d", column, first+len(args)-1))
+	}
+
+	switch t.Unique {
+	case UniqueByKey:
+		arg("task_key", t.Key)
+	case UniqueByKeyAndName:
+		arg("task_key", t.Key)
+		arg("task_name", t.Name)
+	default:
+		arg("idempotency_key", t.IdempotencyKey)
+	}
+
+	if t.UniqueWithin > 0 {
+		args = append(args, cutoff)
+		conditions = append(conditions, fmt.Sprintf("created_at > $%d", first+len(args)-1))
+	} else {
+		conditions = append(conditions, "state IN ('"+string(TaskReady)+"', '"+string(TaskInProgress)+"', '"+string(TaskRetry)+"')")
+	}
+
+	return strings.Join(conditions, " AND "), args
+}
+
+// conflictUpdate Returns the SET clause and value applying t's conflict
+// policy to the tasks it matches, or an empty clause if they're left as is
+func conflictUpdate(t TaskInit, data interface{}, doAfter interface{}) (string, interface{}) {
+	switch t.OnConflict {
+	case ConflictReplaceData:
+		return "data", data
+	case ConflictResetDoAfter:
+		return "do_after", doAfter
+	default:
+		return "", nil
+	}
+}